@@ -3,17 +3,18 @@ package makasero
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/generative-ai-go/genai"
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/pankona/makasero/mlog"
 	"github.com/samber/lo"
-	"google.golang.org/api/option"
 )
 
 func mustMarshalIndent(v interface{}) []byte {
@@ -25,15 +26,30 @@ func mustMarshalIndent(v interface{}) []byte {
 }
 
 type Agent struct {
-	client     *genai.Client
-	model      *genai.GenerativeModel
-	chat       *genai.ChatSession
-	session    *Session
-	functions  map[string]FunctionDefinition
-	mcpManager *MCPClientManager
-	apiKey     string
-	modelName  string
-	sessionDir string
+	provider         Provider
+	providerWrapper  func(Provider) Provider
+	systemPrompt     string
+	session          *Session
+	functions        map[string]FunctionDefinition
+	mcpManager       *MCPClientManager
+	apiKey           string
+	modelName        string
+	sessionDir       string
+	eventHandlers    []EventHandler
+	turn             int
+	budget           *Budget
+	run              *budgetTracker
+	toolTimeout      time.Duration
+	serverTimeouts   map[string]time.Duration
+	maxParallelTools int
+	retry            *RetryPolicy
+	compaction       *Compaction
+	lastInputTokens  int
+	prices           map[string]ModelPrice
+	generation       *GenerationConfig
+	outputSchema     *Schema
+	workspace        string
+	shell            *ShellPolicy
 }
 
 type AgentOption func(*Agent)
@@ -65,14 +81,58 @@ func WithSessionDir(sessionDir string) AgentOption {
 	}
 }
 
-func NewAgent(ctx context.Context, apiKey string, config *MCPConfig, opts ...AgentOption) (*Agent, error) {
-	if apiKey == "" {
-		return nil, fmt.Errorf("API key is required")
+// WithToolTimeout limits how long each function call may run. It overrides
+// the toolTimeout in the config, but not the timeout of individual MCP servers.
+func WithToolTimeout(timeout time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.toolTimeout = timeout
+	}
+}
+
+// WithMaxParallelTools limits how many concurrency-safe function calls of one
+// model turn run at the same time. It overrides maxParallelTools in the config.
+func WithMaxParallelTools(n int) AgentOption {
+	return func(a *Agent) {
+		a.maxParallelTools = n
+	}
+}
+
+// WithWorkspace sets the directory read_file, write_file, list_dir and
+// apply_patch work in. It overrides the workspace in the config.
+func WithWorkspace(dir string) AgentOption {
+	return func(a *Agent) {
+		a.workspace = dir
+	}
+}
+
+// WithShellPolicy enables run_shell with the policy. It overrides the shell
+// section of the config.
+func WithShellPolicy(policy *ShellPolicy) AgentOption {
+	return func(a *Agent) {
+		a.shell = policy
 	}
+}
+
+// WithProvider sets the LLM provider. When omitted, the provider is created
+// from the "provider" section of the config (Gemini by default).
+func WithProvider(provider Provider) AgentOption {
+	return func(a *Agent) {
+		a.provider = provider
+	}
+}
+
+// WithProviderWrapper wraps the provider chosen by NewAgent, e.g. to record the conversation.
+func WithProviderWrapper(wrap func(Provider) Provider) AgentOption {
+	return func(a *Agent) {
+		a.providerWrapper = wrap
+	}
+}
 
+// NewAgent creates an Agent. apiKey is the Gemini API key and may be empty
+// when another provider is configured or given via WithProvider.
+func NewAgent(ctx context.Context, apiKey string, config *MCPConfig, opts ...AgentOption) (*Agent, error) {
 	agent := &Agent{
 		apiKey:     apiKey,
-		modelName:  "gemini-2.0-flash-lite", // default model
 		functions:  make(map[string]FunctionDefinition),
 		sessionDir: SessionDir,
 	}
@@ -81,74 +141,162 @@ func NewAgent(ctx context.Context, apiKey string, config *MCPConfig, opts ...Age
 		opt(agent)
 	}
 
+	if agent.workspace == "" {
+		agent.workspace = config.Workspace
+	}
+	workspace, err := workspaceDir(agent.workspace)
+	if err != nil {
+		return nil, err
+	}
+	agent.workspace = workspace
+
+	// 既存セッションは保存された生成パラメータで再開する
+	if agent.generation == nil && agent.session != nil {
+		agent.generation = agent.session.Generation
+	}
+	if agent.generation == nil {
+		agent.generation = config.Generation
+	}
+	if err := agent.generation.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid generation config: %v", err)
+	}
+
+	if agent.shell == nil {
+		agent.shell = config.Shell
+	}
+	if err := agent.shell.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid shell policy: %v", err)
+	}
+
+	if agent.outputSchema == nil && agent.session != nil {
+		agent.outputSchema = agent.session.OutputSchema
+	}
+	if agent.outputSchema != nil {
+		if err := ValidateOutputSchema(agent.outputSchema); err != nil {
+			return nil, fmt.Errorf("invalid output schema: %v", err)
+		}
+	}
+
+	// プロバイダを設定から作った場合の設定。セッションに保存する
+	var providerConfig *ProviderConfig
+	if agent.provider == nil {
+		providerConfig = config.Provider
+		// 既存セッションは作成時のプロバイダとモデルで再開する
+		if agent.session != nil && agent.session.Provider != "" && agent.session.Provider != providerConfig.ProviderType() {
+			if agent.session.ProviderConfig == nil {
+				return nil, fmt.Errorf("session %s was created with the %s provider, whose settings were not saved; configure the %s provider to resume it",
+					agent.session.ID, agent.session.Provider, agent.session.Provider)
+			}
+			mlog.Infof(ctx, "Resuming session %s with its original provider: %s", agent.session.ID, agent.session.Provider)
+			saved := *agent.session.ProviderConfig
+			providerConfig = &saved
+		}
+		if agent.session != nil && agent.session.Model != "" && agent.session.Model != agent.modelName {
+			mlog.Infof(ctx, "Resuming session %s with its original model: %s", agent.session.ID, agent.session.Model)
+			agent.modelName = agent.session.Model
+		}
+
+		provider, err := NewProviderFromConfig(ctx, providerConfig, apiKey, agent.modelName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize provider: %v", err)
+		}
+		agent.provider = provider
+	}
+	if agent.providerWrapper != nil {
+		agent.provider = agent.providerWrapper(agent.provider)
+	}
+
 	mcpManager := NewMCPClientManager()
 	if err := mcpManager.InitializeFromConfig(ctx, config); err != nil {
+		mcpManager.Close(ctx)
+		agent.provider.Close()
 		return nil, fmt.Errorf("failed to initialize MCP clients: %v", err)
 	}
 	agent.mcpManager = mcpManager
 
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize client: %v", err)
-	}
-	agent.client = client
-
-	model := client.GenerativeModel(agent.modelName)
-	
 	// Use system prompt from config, fallback to default if empty
-	systemPrompt := config.SystemPrompt
-	if systemPrompt == "" {
-		systemPrompt = "You are an AI assistant.\n" +
+	agent.systemPrompt = config.SystemPrompt
+	if agent.systemPrompt == "" {
+		agent.systemPrompt = "You are an AI assistant.\n" +
 			"Execute tasks from users and always call the 'complete' function when a task is finished.\n" +
 			"When calling functions, do not write the function name as text, but actually call the function."
 	}
-	
-	model.SystemInstruction = &genai.Content{
-		Parts: []genai.Part{
-			genai.Text(systemPrompt),
-		},
+
+	if agent.budget == nil {
+		agent.budget = config.Budget
+	}
+	if agent.retry == nil {
+		agent.retry = config.Retry
+	}
+	if agent.compaction == nil {
+		agent.compaction = config.Compaction
+	}
+	if agent.prices == nil {
+		agent.prices = config.Prices
+	}
+	if agent.toolTimeout == 0 {
+		agent.toolTimeout = time.Duration(config.ToolTimeout)
+	}
+	agent.serverTimeouts = make(map[string]time.Duration)
+	for name, server := range config.MCPServers {
+		if server.Timeout > 0 {
+			agent.serverTimeouts[name] = time.Duration(server.Timeout)
+		}
+	}
+	if agent.maxParallelTools == 0 {
+		agent.maxParallelTools = config.MaxParallelTools
+	}
+	if agent.maxParallelTools == 0 {
+		agent.maxParallelTools = DefaultMaxParallelTools
 	}
-	agent.model = model
 
 	maps.Copy(agent.functions, builtinFunctions)
+	maps.Copy(agent.functions, fileFunctions(agent.workspace))
+	maps.Copy(agent.functions, searchFunctions(agent.workspace))
+	maps.Copy(agent.functions, gitFunctions(agent.workspace))
+	maps.Copy(agent.functions, githubFunctions(&ghCLI{dir: agent.workspace}))
+	if agent.shell != nil {
+		agent.functions["run_shell"] = shellFunction(agent.workspace, agent.shell)
+	}
+	if agent.outputSchema != nil {
+		agent.functions["complete"] = completeFunction(agent.outputSchema)
+	}
 
 	mcpFuncDecls, err := mcpManager.GenerateAllFunctionDefinitions(ctx)
 	if err != nil {
+		mcpManager.Close(ctx)
+		agent.provider.Close()
 		return nil, fmt.Errorf("failed to generate MCP tools: %v", err)
 	}
 
 	for _, fn := range mcpFuncDecls {
+		if server, ok := config.MCPServers[mcpServerName(fn.Declaration.Name)]; ok && server.Concurrent {
+			fn.Concurrent = true
+		}
 		agent.functions[fn.Declaration.Name] = fn
 	}
 
-	var allFuncDeclarations []*genai.FunctionDeclaration
-	for _, fn := range agent.functions {
-		allFuncDeclarations = append(allFuncDeclarations, fn.Declaration)
-	}
-
-	model.Tools = []*genai.Tool{
-		{
-			FunctionDeclarations: allFuncDeclarations,
-		},
-	}
-
-	model.ToolConfig = &genai.ToolConfig{
-		FunctionCallingConfig: &genai.FunctionCallingConfig{
-			Mode: genai.FunctionCallingAuto,
-		},
-	}
-
 	if agent.session == nil {
 		agent.session = &Session{
 			ID:        generateSessionID(),
 			CreatedAt: time.Now(),
 		}
 	}
-
-	agent.chat = model.StartChat()
-	if len(agent.session.History) > 0 {
-		agent.chat.History = agent.session.History
+	if agent.session.Provider == "" {
+		agent.session.Provider = agent.provider.Name()
+	}
+	if agent.session.Model == "" {
+		agent.session.Model = modelNameOf(agent.provider)
 	}
+	if agent.session.ProviderConfig == nil && providerConfig != nil && providerConfig.ProviderType() == agent.session.Provider {
+		// API キーは保存しない。再開時は環境変数から読む
+		saved := *providerConfig
+		saved.Type = providerConfig.ProviderType()
+		saved.APIKey = ""
+		agent.session.ProviderConfig = &saved
+	}
+	agent.session.Generation = agent.generation
+	agent.session.OutputSchema = agent.outputSchema
 
 	mcpManager.SetupNotificationHandlers(func(serverName string, notification mcp.JSONRPCNotification) {
 		mlog.Debugf(ctx, "[%s] Notification: %v", serverName, notification)
@@ -159,28 +307,186 @@ func NewAgent(ctx context.Context, apiKey string, config *MCPConfig, opts ...Age
 }
 
 func (a *Agent) Close() error {
-	if a.client != nil {
-		a.client.Close()
+	if a.provider != nil {
+		a.provider.Close()
 	}
 	return nil
 }
 
-func (a *Agent) ProcessMessage(ctx context.Context, userInput string) error {
-	mlog.Infof(ctx, "--- Start session ---")
-	mlog.Infof(ctx, "🗣️ Sending message to AI:\n%s", strings.TrimSpace(userInput))
+// ProcessMessage sends userInput to the model and runs the functions it calls
+// until it completes, asks a question or stops. The result tells which.
+func (a *Agent) ProcessMessage(ctx context.Context, userInput string) (*Result, error) {
+	mlog.Debugf(ctx, "🗣️ Sending message to AI:\n%s", strings.TrimSpace(userInput))
+
+	return a.execute(ctx, func(ctx context.Context, result *Result) error {
+		// 質問に答えずにメッセージを送った場合は、質問は取り下げる
+		a.session.PendingQuestion = nil
+		// 前回の実行が関数の途中で止まっていた場合は未実行として返してから続ける
+		parts := append(unansweredCallResponses(a.session.History), Text(userInput))
+		resp, err := a.sendMessage(ctx, parts...)
+		if err != nil {
+			return fmt.Errorf("failed to send message to AI: %w", err)
+		}
+		return a.processLoop(ctx, resp, result)
+	})
+}
+
+// Resume continues a session that stopped before finishing (see Session.Resumable).
+// Functions the model called but that did not run are executed first.
+func (a *Agent) Resume(ctx context.Context) (*Result, error) {
+	history := a.session.History
+	if len(history) == 0 {
+		return nil, fmt.Errorf("session %s has no history to resume", a.session.ID)
+	}
+	mlog.Debugf(ctx, "Resuming session %s (status: %s)", a.session.ID, a.session.Status)
+
+	return a.execute(ctx, func(ctx context.Context, result *Result) error {
+		last := history[len(history)-1]
+		if last.Role == RoleModel {
+			return a.processLoop(ctx, &GenerateResponse{Message: last}, result)
+		}
+
+		resp, err := a.generate(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to send message to AI: %w", err)
+		}
+		return a.processLoop(ctx, resp, result)
+	})
+}
+
+// Answer replies to the question the model asked with ask_question (see
+// Session.PendingQuestion) and continues the run. The answer is sent to the
+// model as the result of the call.
+func (a *Agent) Answer(ctx context.Context, answer string) (*Result, error) {
+	question := a.session.PendingQuestion
+	if question == nil {
+		return nil, fmt.Errorf("session %s has no pending question", a.session.ID)
+	}
+	mlog.Debugf(ctx, "🗣️ Answering the question:\n%s", strings.TrimSpace(answer))
+
+	return a.execute(ctx, func(ctx context.Context, result *Result) error {
+		a.session.PendingQuestion = nil
+		parts := append(unansweredCallResponses(a.session.History), FunctionResponse{
+			ID:   question.CallID,
+			Name: "ask_question",
+			Response: map[string]any{
+				"is_error": false,
+				"output":   answer,
+			},
+		})
+		resp, err := a.sendMessage(ctx, parts...)
+		if err != nil {
+			return fmt.Errorf("failed to send message to AI: %w", err)
+		}
+		return a.processLoop(ctx, resp, result)
+	})
+}
+
+// execute runs fn as one run of the agent. The session is checkpointed while
+// running, and saved with the final status however the run ends. fn is given
+// a context that ends when the MaxDuration of the budget is reached.
+func (a *Agent) execute(ctx context.Context, fn func(ctx context.Context, result *Result) error) (*Result, error) {
+	a.run = newBudgetTracker(a.budget)
+	a.session.Status = SessionStatusRunning
+	a.session.Output = nil
+	a.checkpoint(ctx)
+
+	runCtx := ctx
+	if max := time.Duration(a.run.budget.MaxDuration); max > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, max)
+		defer cancel()
+	}
+
+	result, finish := a.newRunResult()
+	err := fn(runCtx, result)
+	// 実行時間の上限で止まったモデルや関数の呼び出しは、予算の超過として扱う
+	if err != nil && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		if budgetErr := a.run.checkDuration(); budgetErr != nil {
+			err = budgetErr
+		}
+	}
 
-	resp, err := a.chat.SendMessage(ctx, genai.Text(userInput))
+	var budgetErr *BudgetExceededError
+	switch {
+	case err == nil && result.Outcome == OutcomeQuestion:
+		a.session.Status = SessionStatusAwaitingAnswer
+	case err == nil:
+		a.session.Status = SessionStatusCompleted
+	case errors.As(err, &budgetErr):
+		a.session.Status = SessionStatusBudgetExceeded
+		err = budgetErr
+	case ctx.Err() != nil:
+		a.session.Status = SessionStatusInterrupted
+	default:
+		a.session.Status = SessionStatusFailed
+	}
 	if err != nil {
-		return fmt.Errorf("failed to send message to AI: %v", err)
+		mlog.Warnf(ctx, "Stopping: %v", err)
+		result.Outcome = outcomeOf(a.session.Status)
+	} else if result.Outcome == "" {
+		result.Outcome = OutcomeStopped
 	}
+	result.Output = a.session.Output
 
-	mlog.Debugf(ctx, "🔍 Debug received response:\n%s", string(mustMarshalIndent(resp)))
+	a.session.UpdatedAt = time.Now()
+	if saveErr := a.SaveSession(a.session); saveErr != nil {
+		mlog.Errorf(ctx, "Failed to save session: %v", saveErr)
+		if err == nil {
+			err = fmt.Errorf("failed to save session: %v", saveErr)
+		}
+	}
+	mlog.Debugf(ctx, "Session ID: %s", a.session.ID)
+	finish()
 
+	if err != nil {
+		a.emit(Event{Type: EventError, Error: err.Error()})
+		return result, err
+	}
+	a.emit(Event{Type: EventCompleted, Text: result.Message, Output: result.Output})
+	return result, nil
+}
+
+// unansweredCallResponses returns error responses for the function calls of
+// the last model turn when the previous run stopped before running them.
+func unansweredCallResponses(history []*Message) []Part {
+	if len(history) == 0 || history[len(history)-1].Role != RoleModel {
+		return nil
+	}
+
+	var parts []Part
+	for _, call := range history[len(history)-1].FunctionCalls() {
+		if call.Name == "complete" || call.Name == "ask_question" {
+			continue
+		}
+		parts = append(parts, FunctionResponse{
+			ID:   call.ID,
+			Name: call.Name,
+			Response: map[string]any{
+				"is_error": true,
+				"output":   "the call was interrupted before it finished",
+			},
+		})
+	}
+	return parts
+}
+
+// checkpoint saves the session in the middle of a run so that the progress
+// survives crashes and can be observed by other processes.
+func (a *Agent) checkpoint(ctx context.Context) {
+	a.session.UpdatedAt = time.Now()
+	if err := a.SaveSession(a.session); err != nil {
+		mlog.Warnf(ctx, "Failed to checkpoint session: %v", err)
+	}
+}
+
+// processLoop runs the conversation loop from resp. How it ends is stored in result.
+func (a *Agent) processLoop(ctx context.Context, resp *GenerateResponse, result *Result) error {
 	// continue loop until shouldStop is true
 	for {
-		newResp, shouldStop, err := a.processResponse(ctx, resp)
+		newResp, shouldStop, err := a.processResponse(ctx, resp, result)
 		if err != nil {
-			return fmt.Errorf("failed to process response: %v", err)
+			return fmt.Errorf("failed to process response: %w", err)
 		}
 
 		if shouldStop {
@@ -189,16 +495,15 @@ func (a *Agent) ProcessMessage(ctx context.Context, userInput string) error {
 
 		// shouldStop が false で resp が nil ということはまだタスクが終わっていないので続けてもらう
 		if newResp == nil {
-			newResp, err := a.chat.SendMessage(ctx,
-				genai.Text("Task may not be finished. Please continue.\n"+
+			newResp, err := a.sendMessage(ctx,
+				Text("Task may not be finished. Please continue.\n"+
 					"If you have finished the task, please call the 'complete' function.\n"+
-					"If you have any questions, please call the 'askQuestion' function."))
+					"If you have any questions, please call the 'ask_question' function."))
 			if err != nil {
 				mlog.Errorf(ctx, "Failed to send message to AI: %v", err)
-				return fmt.Errorf("failed to send message to AI: %v", err)
+				return fmt.Errorf("failed to send message to AI: %w", err)
 			}
 
-			mlog.Infof(ctx, "🗣️ Please continue the conversation:")
 			resp = newResp
 
 			continue
@@ -207,104 +512,337 @@ func (a *Agent) ProcessMessage(ctx context.Context, userInput string) error {
 		resp = newResp
 	}
 
-	mlog.Infof(ctx, "--- Finish session ---")
-	a.session.History = a.chat.History
-	a.session.UpdatedAt = time.Now()
-	if err := a.SaveSession(a.session); err != nil {
-		mlog.Errorf(ctx, "Failed to save session: %v", err)
-		return fmt.Errorf("failed to save session: %v", err)
+	return nil
+}
+
+// sendMessage appends parts as a user turn to the history and sends the
+// conversation to the provider. When the budget is exhausted, the turn is
+// recorded but not sent.
+func (a *Agent) sendMessage(ctx context.Context, parts ...Part) (*GenerateResponse, error) {
+	history := a.session.History
+	if n := len(history); n > 0 && history[n-1].Role == RoleUser {
+		// 前回送られなかったユーザーのターンにまとめて、user と model が交互になるようにする
+		history[n-1].Parts = append(history[n-1].Parts, parts...)
+	} else {
+		a.session.History = append(history, NewUserMessage(parts...))
 	}
-	mlog.Infof(ctx, "Session ID: %s", a.session.ID)
+	a.checkpoint(ctx)
 
-	return nil
+	return a.generate(ctx)
 }
 
-func (a *Agent) processResponse(ctx context.Context, resp *genai.GenerateContentResponse) (*genai.GenerateContentResponse, bool, error) {
-	var functionCallingResponses []genai.FunctionResponse
-
-	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			mlog.Debugf(ctx, "🔍 len parts: %d", len(cand.Content.Parts))
-			for _, part := range cand.Content.Parts {
-				switch p := part.(type) {
-				case genai.FunctionCall:
-					fnCtx := context.Background()
-					mlog.Infof(fnCtx, "🔧 AI uses function calling: %s", p.Name)
-
-					mlog.Debugf(fnCtx, "🔍 Debug function call:\n%s", string(mustMarshalIndent(p)))
-
-					var result map[string]any
-					if strings.HasPrefix(p.Name, "mcp_") {
-						// mcp functions
-						var err error
-						result, err = a.mcpManager.CallMCPTool(ctx, p.Name, p.Args)
-						if err != nil {
-							mlog.Errorf(ctx, "MCP function %s failed: %v", p.Name, err)
-							result = map[string]any{
-								"is_error": true,
-								"output":   fmt.Sprintf("MCP function %s failed: %v", p.Name, err),
-							}
-						}
-					} else {
-						// builtin functions
-						fn, exists := a.functions[p.Name]
-						if !exists {
-							mlog.Errorf(ctx, "Unknown function: %s", p.Name)
-							result = map[string]any{
-								"is_error": true,
-								"output":   fmt.Sprintf("unknown function: %s", p.Name),
-							}
-						}
+// generate sends the whole conversation to the provider and records the model's reply.
+func (a *Agent) generate(ctx context.Context) (*GenerateResponse, error) {
+	if err := a.run.checkTurn(); err != nil {
+		return nil, err
+	}
+	a.maybeCompact(ctx)
 
-						var err error
-						result, err = fn.Handler(ctx, p.Args)
-						if err != nil {
-							mlog.Errorf(ctx, "Function %s failed: %v", p.Name, err)
-							result = map[string]any{
-								"is_error": true,
-								"output":   fmt.Sprintf("function %s failed: %v", p.Name, err),
-							}
-						}
+	req := &GenerateRequest{
+		SystemInstruction: a.systemPrompt,
+		Tools:             a.functionDeclarations(),
+		Messages:          a.requestMessages(),
+		Config:            a.generation,
+	}
 
-						if p.Name == "complete" || p.Name == "askQuestion" {
-							return nil, true, nil
-						}
-					}
+	a.turn++
+	a.emit(Event{Type: EventTurnStarted})
+
+	resp, err := a.generateWithRetry(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	a.run.turns++
+	a.recordUsage(resp)
+	a.lastInputTokens = 0
+	if resp.Usage != nil {
+		a.lastInputTokens = resp.Usage.InputTokens
+	}
+
+	mlog.Debugf(ctx, "🔍 Debug received response:\n%s", string(mustMarshalIndent(resp)))
 
-					mlog.Debugf(ctx, "🔍 Debug function result:\n%s", string(mustMarshalIndent(result)))
-					functionCallingResponses = append(functionCallingResponses, genai.FunctionResponse{
-						Name:     p.Name,
-						Response: result,
-					})
-				case genai.Text:
-					mlog.Infof(ctx, "🤖 Response from AI:\n%s", strings.TrimSpace(string(p)))
-				default:
-					mlog.Warnf(ctx, "Unknown response type: %T", part)
+	if resp.Message != nil {
+		a.session.History = append(a.session.History, resp.Message)
+		a.checkpoint(ctx)
+	}
+	return resp, nil
+}
+
+func (a *Agent) functionDeclarations() []*FunctionDeclaration {
+	// 毎回同じ順で送り、プロバイダのプロンプトキャッシュや記録したリクエストが一致するようにする
+	decls := make([]*FunctionDeclaration, 0, len(a.functions))
+	for _, name := range slices.Sorted(maps.Keys(a.functions)) {
+		decls = append(decls, a.functions[name].Declaration)
+	}
+	return decls
+}
+
+// processResponse runs the functions called in resp and sends their results.
+// A call of 'complete' or 'ask_question' ends the run and is stored in result.
+func (a *Agent) processResponse(ctx context.Context, resp *GenerateResponse, result *Result) (*GenerateResponse, bool, error) {
+	if resp.Message == nil {
+		mlog.Warnf(ctx, "Response content is nil")
+		return nil, true, nil
+	}
+
+	var texts []string
+	for _, part := range resp.Message.Parts {
+		if text, ok := part.(Text); ok && strings.TrimSpace(string(text)) != "" {
+			texts = append(texts, strings.TrimSpace(string(text)))
+		}
+	}
+	if len(texts) > 0 {
+		a.emit(Event{Type: EventText, Text: strings.Join(texts, "\n")})
+	}
+
+	var calls []FunctionCall
+	mlog.Debugf(ctx, "🔍 len parts: %d", len(resp.Message.Parts))
+	for _, part := range resp.Message.Parts {
+		switch p := part.(type) {
+		case FunctionCall:
+			calls = append(calls, p)
+		case Text:
+			// EventText として通知済み
+		default:
+			mlog.Warnf(ctx, "Unknown response type: %T", part)
+		}
+	}
+
+	var functionCallingResponses []FunctionResponse
+	var stopErr error
+	// complete または ask_question で実行を終える場合に true
+	finished := false
+
+	for len(calls) > 0 && !finished {
+		// 並列実行できる関数が続く間はまとめて実行する
+		batch := calls[:a.batchSize(calls)]
+		calls = calls[len(batch):]
+
+		results := make([]map[string]any, len(batch))
+		var run []int
+		for i, p := range batch {
+			mlog.Debugf(ctx, "🔍 Debug function call:\n%s", string(mustMarshalIndent(p)))
+			a.emit(Event{Type: EventFunctionCall, Function: p.Name, CallID: p.ID, Args: p.Args})
+
+			if stopErr == nil {
+				stopErr = ctx.Err()
+			}
+			if stopErr == nil && p.Name != "complete" && p.Name != "ask_question" {
+				stopErr = a.run.checkToolCall()
+				a.run.toolCalls++
+			}
+
+			if stopErr != nil {
+				// 中断または予算切れのため実行しない
+				results[i] = map[string]any{
+					"is_error": true,
+					"output":   fmt.Sprintf("function %s was not run: %v", p.Name, stopErr),
 				}
+				continue
 			}
+			run = append(run, i)
+		}
 
-			if len(functionCallingResponses) > 0 {
-				parts := lo.Map(functionCallingResponses, func(fnResp genai.FunctionResponse, _ int) genai.Part { return fnResp })
+		if len(run) > 0 {
+			a.callFunctions(ctx, batch, run, results)
+			// 実行中に中断された場合も結果は残す
+			stopErr = ctx.Err()
+		}
 
-				var err error
-				mlog.Debugf(ctx, "🔍 Debug send message:\n%s", string(mustMarshalIndent(parts)))
-				resp, err = a.chat.SendMessage(ctx, parts...)
-				if err != nil {
-					mlog.Errorf(ctx, "Failed to send function response: %v", err)
-					return nil, false, fmt.Errorf("failed to send function response: %v", err)
+		for i, p := range batch {
+			fnResult := results[i]
+			if lo.Contains(run, i) {
+				switch p.Name {
+				case "complete":
+					if err := a.setOutput(p.Args); err != nil {
+						// 結果が出力スキーマに合わない場合はモデルに直させる
+						fnResult = map[string]any{
+							"is_error": true,
+							"output":   fmt.Sprintf("the result does not match the output schema: %v", err),
+						}
+						break
+					}
+					result.Outcome = OutcomeCompleted
+					result.Message, _ = p.Args["message"].(string)
+					finished = true
+					continue
+				case "ask_question":
+					event := questionEvent(p.Args)
+					a.emit(event)
+					result.Outcome = OutcomeQuestion
+					result.Question, result.Options = event.Text, event.Options
+					a.session.PendingQuestion = &PendingQuestion{CallID: p.ID, Question: event.Text, Options: event.Options}
+					finished = true
+					continue
 				}
-
-				mlog.Debugf(ctx, "🔍 Debug received response:\n%s", string(mustMarshalIndent(resp)))
-				return resp, false, nil
 			}
-		} else {
-			mlog.Warnf(ctx, "Response content is nil")
+
+			mlog.Debugf(ctx, "🔍 Debug function result:\n%s", string(mustMarshalIndent(fnResult)))
+			isError, _ := fnResult["is_error"].(bool)
+			a.emit(Event{Type: EventFunctionResult, Function: p.Name, CallID: p.ID, Result: fnResult, IsError: isError})
+			functionCallingResponses = append(functionCallingResponses, FunctionResponse{
+				ID:       p.ID,
+				Name:     p.Name,
+				Response: fnResult,
+			})
 		}
 	}
 
+	if finished {
+		// 一緒に呼ばれた関数の結果は履歴に残し、続けて呼ばれた関数は実行しない
+		for _, p := range calls {
+			functionCallingResponses = append(functionCallingResponses, FunctionResponse{
+				ID:   p.ID,
+				Name: p.Name,
+				Response: map[string]any{
+					"is_error": true,
+					"output":   fmt.Sprintf("function %s was not run: the run has already finished", p.Name),
+				},
+			})
+		}
+		if len(functionCallingResponses) > 0 {
+			parts := lo.Map(functionCallingResponses, func(fnResp FunctionResponse, _ int) Part { return fnResp })
+			a.session.History = append(a.session.History, NewUserMessage(parts...))
+			a.checkpoint(ctx)
+		}
+		return nil, true, nil
+	}
+
+	if stopErr != nil {
+		// 結果は履歴に残し、モデルには送らない
+		parts := lo.Map(functionCallingResponses, func(fnResp FunctionResponse, _ int) Part { return fnResp })
+		a.session.History = append(a.session.History, NewUserMessage(parts...))
+		return nil, false, stopErr
+	}
+
+	if len(functionCallingResponses) > 0 {
+		parts := lo.Map(functionCallingResponses, func(fnResp FunctionResponse, _ int) Part { return fnResp })
+
+		mlog.Debugf(ctx, "🔍 Debug send message:\n%s", string(mustMarshalIndent(parts)))
+		resp, err := a.sendMessage(ctx, parts...)
+		if err != nil {
+			mlog.Errorf(ctx, "Failed to send function response: %v", err)
+			return nil, false, fmt.Errorf("failed to send function response: %w", err)
+		}
+
+		return resp, false, nil
+	}
+
 	return nil, true, nil
 }
 
+// batchSize returns how many of the leading calls can run together. Calls to
+// functions that are not marked Concurrent run one at a time.
+func (a *Agent) batchSize(calls []FunctionCall) int {
+	n := 0
+	for _, call := range calls {
+		if !a.functions[call.Name].Concurrent {
+			break
+		}
+		n++
+	}
+	return max(n, 1)
+}
+
+// callFunctions runs calls[i] for each i in indexes and stores the results in
+// results[i]. At most maxParallelTools calls run at the same time.
+func (a *Agent) callFunctions(ctx context.Context, calls []FunctionCall, indexes []int, results []map[string]any) {
+	if len(indexes) == 1 {
+		results[indexes[0]] = a.callFunction(ctx, calls[indexes[0]])
+		return
+	}
+
+	sem := make(chan struct{}, max(a.maxParallelTools, 1))
+	var wg sync.WaitGroup
+	for _, i := range indexes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = a.callFunction(ctx, calls[i])
+		}()
+	}
+	wg.Wait()
+}
+
+// callFunction runs a builtin or MCP function within the tool timeout.
+// Failures are reported to the model as results with is_error set.
+func (a *Agent) callFunction(ctx context.Context, call FunctionCall) map[string]any {
+	parent := ctx
+	timeout := a.toolTimeoutFor(call.Name)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var result map[string]any
+	var err error
+	if strings.HasPrefix(call.Name, "mcp_") {
+		result, err = a.mcpManager.CallMCPTool(ctx, call.Name, call.Args)
+		if err != nil {
+			err = fmt.Errorf("MCP function %s failed: %v", call.Name, err)
+		}
+	} else if fn, exists := a.functions[call.Name]; !exists {
+		err = fmt.Errorf("unknown function: %s", call.Name)
+	} else {
+		result, err = fn.Handler(ctx, call.Args)
+		if err != nil {
+			err = fmt.Errorf("function %s failed: %v", call.Name, err)
+		}
+	}
+
+	// 親のコンテキストが生きていてタイムアウトした場合はその旨を返す
+	if ctx.Err() != nil && parent.Err() == nil {
+		err = fmt.Errorf("function %s timed out after %s", call.Name, timeout)
+	}
+
+	if err != nil {
+		mlog.Errorf(ctx, "%v", err)
+		return map[string]any{
+			"is_error": true,
+			"output":   err.Error(),
+		}
+	}
+	return result
+}
+
+// toolTimeoutFor returns the timeout for the named function. MCP servers may
+// override the default timeout, and run_shell has the timeout of its policy.
+func (a *Agent) toolTimeoutFor(name string) time.Duration {
+	if name == "run_shell" {
+		// run_shell はシェルのポリシーのタイムアウトで止め、それまでの出力を返す
+		return 0
+	}
+	if timeout, ok := a.serverTimeouts[mcpServerName(name)]; ok {
+		return timeout
+	}
+	return a.toolTimeout
+}
+
+// mcpServerName returns the server part of an MCP function name
+// (mcp_<server>_<tool>), or "" for other functions.
+func mcpServerName(name string) string {
+	if parts := strings.SplitN(name, "_", 3); len(parts) == 3 && parts[0] == "mcp" {
+		return parts[1]
+	}
+	return ""
+}
+
+func questionEvent(args map[string]any) Event {
+	event := Event{Type: EventQuestionAsked}
+	event.Text, _ = args["question"].(string)
+	if options, ok := args["options"].([]any); ok {
+		for _, option := range options {
+			if s, ok := option.(string); ok {
+				event.Options = append(event.Options, s)
+			}
+		}
+	}
+	return event
+}
+
 func (a *Agent) GetSession() *Session {
 	return a.session
 }
@@ -315,11 +853,32 @@ func (a *Agent) LoadSession(sessionID string) error {
 		return err
 	}
 	a.session = session
-	a.chat = a.model.StartChat()
-	a.chat.History = session.History
 	return nil
 }
 
+// Fork continues the conversation in a new session that starts with a copy of
+// the current history. The original session is saved as it is; usage is
+// counted in the new session from the fork on.
+func (a *Agent) Fork() (*Session, error) {
+	fork := *a.session
+	fork.ID = generateSessionID()
+	fork.ForkedFrom = a.session.ID
+	fork.CreatedAt = time.Now()
+	fork.UpdatedAt = fork.CreatedAt
+	fork.Usage, fork.TotalUsage = nil, nil
+	// 送られていないユーザーのターンには後からパーツが足されるので、メッセージも複製する
+	fork.History = make([]*Message, len(a.session.History))
+	for i, msg := range a.session.History {
+		fork.History[i] = &Message{Role: msg.Role, Parts: slices.Clone(msg.Parts)}
+	}
+
+	if err := a.SaveSession(&fork); err != nil {
+		return nil, fmt.Errorf("failed to save the forked session: %v", err)
+	}
+	a.session = &fork
+	return &fork, nil
+}
+
 // SessionExists checks if a session exists in the agent's session directory
 func (a *Agent) SessionExists(id string) bool {
 	return SessionExistsInDir(a.sessionDir, id)
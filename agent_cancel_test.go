@@ -0,0 +1,80 @@
+package makasero
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addBlockingFunction registers a function that runs until its context is done.
+func addBlockingFunction(agent *Agent, name string, onStart func()) {
+	agent.functions[name] = FunctionDefinition{
+		Declaration: &FunctionDeclaration{Name: name, Description: "blocks until cancelled"},
+		Handler: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			if onStart != nil {
+				onStart()
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+}
+
+func TestProcessMessageToolTimeout(t *testing.T) {
+	isError := true
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "slow"}}},
+		{
+			ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "slow", IsError: &isError, Contains: "timed out after 50ms"}},
+			FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "gave up"}}},
+		},
+	}}
+	agent, provider := newScriptedAgent(t, script, WithToolTimeout(50*time.Millisecond))
+	addBlockingFunction(agent, "slow", nil)
+
+	if _, err := agent.ProcessMessage(context.Background(), "run slow"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if n := provider.Remaining(); n != 0 {
+		t.Errorf("expected the whole script to be consumed, %d turns left", n)
+	}
+}
+
+func TestProcessMessageCancelledDuringTool(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "slow"}, {Name: "git_status", Args: map[string]any{"path_to_status": "."}}}},
+	}}
+	agent, provider := newScriptedAgent(t, script)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addBlockingFunction(agent, "slow", cancel)
+
+	_, err := agent.ProcessMessage(ctx, "run slow")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n := len(provider.Requests()); n != 1 {
+		t.Errorf("expected no request after cancellation, got %d requests", n)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.Status != SessionStatusInterrupted {
+		t.Errorf("expected status %s, got %q", SessionStatusInterrupted, saved.Status)
+	}
+
+	// the partial session keeps a response for every call
+	last := saved.History[len(saved.History)-1]
+	if last.Role != RoleUser || len(last.Parts) != 2 {
+		t.Fatalf("expected both function responses in the last message, got %+v", last)
+	}
+	skipped := last.Parts[1].(FunctionResponse)
+	if output, _ := skipped.Response["output"].(string); !strings.Contains(output, "was not run") {
+		t.Errorf("expected git_status to be skipped, got %+v", skipped.Response)
+	}
+}
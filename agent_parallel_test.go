@@ -0,0 +1,136 @@
+package makasero
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// addProbeFunction registers a function that waits a little and records the
+// largest number of calls that ran at the same time in peak.
+func addProbeFunction(agent *Agent, name string, concurrent bool, peak *int32) {
+	var running int32
+	var mu sync.Mutex
+	agent.functions[name] = FunctionDefinition{
+		Declaration: &FunctionDeclaration{Name: name, Description: "records concurrency"},
+		Handler: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			mu.Lock()
+			if n > *peak {
+				*peak = n
+			}
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+			return map[string]any{"is_error": false, "output": args["label"]}, nil
+		},
+		Concurrent: concurrent,
+	}
+}
+
+func parallelScript(name string, labels ...string) *Script {
+	var calls []ScriptFunctionCall
+	var expects []ScriptResponseExpectation
+	for _, label := range labels {
+		calls = append(calls, ScriptFunctionCall{Name: name, Args: map[string]any{"label": label}})
+		expects = append(expects, ScriptResponseExpectation{Name: name, Contains: label})
+	}
+	return &Script{Turns: []ScriptTurn{
+		{FunctionCalls: calls},
+		{
+			ExpectFunctionResponses: expects,
+			FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+		},
+	}}
+}
+
+func TestProcessMessageRunsConcurrentCallsInParallel(t *testing.T) {
+	var peak int32
+	agent, provider := newScriptedAgent(t, parallelScript("read", "one", "two", "three", "four", "five"), WithMaxParallelTools(3))
+	addProbeFunction(agent, "read", true, &peak)
+
+	if _, err := agent.ProcessMessage(context.Background(), "read them all"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if n := provider.Remaining(); n != 0 {
+		t.Errorf("expected the whole script to be consumed, %d turns left", n)
+	}
+	if peak != 3 {
+		t.Errorf("expected 3 calls to run at the same time, got %d", peak)
+	}
+}
+
+func TestProcessMessageRunsOtherCallsSerially(t *testing.T) {
+	var peak int32
+	agent, _ := newScriptedAgent(t, parallelScript("write", "one", "two", "three"))
+	addProbeFunction(agent, "write", false, &peak)
+
+	if _, err := agent.ProcessMessage(context.Background(), "write them all"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if peak != 1 {
+		t.Errorf("expected calls to run one at a time, got %d at once", peak)
+	}
+}
+
+func TestProcessMessageKeepsResultsOfCallsBeforeComplete(t *testing.T) {
+	var peak int32
+	agent, _ := newScriptedAgent(t, &Script{Turns: []ScriptTurn{{FunctionCalls: []ScriptFunctionCall{
+		{Name: "read", Args: map[string]any{"label": "one"}},
+		{Name: "complete", Args: map[string]any{"message": "done"}},
+		{Name: "read", Args: map[string]any{"label": "two"}},
+	}}}})
+	addProbeFunction(agent, "read", true, &peak)
+
+	result, err := agent.ProcessMessage(context.Background(), "read and finish")
+	if err != nil || result.Outcome != OutcomeCompleted {
+		t.Fatalf("expected the run to complete, got %+v (%v)", result, err)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	// user prompt, model calls, function responses
+	if len(saved.History) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(saved.History))
+	}
+	var responses []FunctionResponse
+	for _, part := range saved.History[2].Parts {
+		if resp, ok := part.(FunctionResponse); ok {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) != 2 || responses[0].Response["is_error"] != false || responses[1].Response["is_error"] != true {
+		t.Errorf("expected the result of the first read and the second read not to run, got %+v", responses)
+	}
+}
+
+func TestAnswerSendsResultsOfCallsBeforeQuestion(t *testing.T) {
+	var peak int32
+	agent, provider := newScriptedAgent(t, &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{
+			{Name: "read", Args: map[string]any{"label": "one"}},
+			{Name: "ask_question", Args: map[string]any{"question": "which one?"}},
+		}},
+		{
+			ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "read", Contains: "one"}, {Name: "ask_question", Contains: "the first"}},
+			FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+		},
+	}})
+	addProbeFunction(agent, "read", true, &peak)
+
+	result, err := agent.ProcessMessage(context.Background(), "read and ask")
+	if err != nil || result.Outcome != OutcomeQuestion {
+		t.Fatalf("expected a question, got %+v (%v)", result, err)
+	}
+	if _, err := agent.Answer(context.Background(), "the first"); err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	if n := provider.Remaining(); n != 0 {
+		t.Errorf("expected the whole script to be consumed, %d turns left", n)
+	}
+}
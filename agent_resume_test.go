@@ -0,0 +1,160 @@
+package makasero
+
+import (
+	"context"
+	"testing"
+)
+
+// crashedSession is a session whose process died while git_status was running.
+func crashedSession() *Session {
+	return &Session{
+		ID:     "crashed",
+		Status: SessionStatusRunning,
+		History: []*Message{
+			NewUserMessage(Text("show me the status")),
+			{Role: RoleModel, Parts: []Part{FunctionCall{ID: "call_0_0", Name: "git_status", Args: map[string]any{"path_to_status": "."}}}},
+		},
+	}
+}
+
+func TestProcessMessageCheckpointsEachTurn(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}}},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}}},
+	}}
+
+	var agent *Agent
+	var checkpoints []*Session
+	agent, _ = newScriptedAgent(t, script, WithEventHandler(func(e Event) {
+		if e.Type != EventTurnStarted && e.Type != EventFunctionCall {
+			return
+		}
+		saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+		if err != nil {
+			t.Fatalf("session was not saved before %s: %v", e.Type, err)
+		}
+		checkpoints = append(checkpoints, saved)
+	}))
+
+	if _, err := agent.ProcessMessage(context.Background(), "status"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	// turn 1 started, git_status called, turn 2 started, complete called
+	wantLengths := []int{1, 2, 3, 4}
+	if len(checkpoints) != len(wantLengths) {
+		t.Fatalf("expected %d checkpoints, got %d", len(wantLengths), len(checkpoints))
+	}
+	for i, saved := range checkpoints {
+		if saved.Status != SessionStatusRunning {
+			t.Errorf("checkpoint %d: expected status %s, got %q", i, SessionStatusRunning, saved.Status)
+		}
+		if len(saved.History) != wantLengths[i] {
+			t.Errorf("checkpoint %d: expected %d messages, got %d", i, wantLengths[i], len(saved.History))
+		}
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.Status != SessionStatusCompleted {
+		t.Errorf("expected status %s, got %q", SessionStatusCompleted, saved.Status)
+	}
+}
+
+func TestResumeRunsPendingCalls(t *testing.T) {
+	isError := false
+	script := &Script{Turns: []ScriptTurn{{
+		ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "git_status", IsError: &isError}},
+		FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+	}}}
+	session := crashedSession()
+	if !session.Resumable() {
+		t.Fatal("expected a running session to be resumable")
+	}
+	agent, provider := newScriptedAgent(t, script, WithSession(session))
+
+	if _, err := agent.Resume(context.Background()); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if n := provider.Remaining(); n != 0 {
+		t.Errorf("expected the whole script to be consumed, %d turns left", n)
+	}
+	if agent.GetSession().Status != SessionStatusCompleted || agent.GetSession().Resumable() {
+		t.Errorf("expected a completed session, got %q", agent.GetSession().Status)
+	}
+}
+
+func TestResumeResendsUnansweredTurn(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{{
+		ExpectText:    "show me the status",
+		FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+	}}}
+	session := &Session{
+		ID:      "failed",
+		Status:  SessionStatusFailed,
+		History: []*Message{NewUserMessage(Text("show me the status"))},
+	}
+	agent, provider := newScriptedAgent(t, script, WithSession(session))
+
+	if _, err := agent.Resume(context.Background()); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if n := len(provider.Requests()[0].Messages); n != 1 {
+		t.Errorf("expected the history to be resent as is, got %d messages", n)
+	}
+}
+
+func TestProcessMessageAnswersCallsLeftByCrash(t *testing.T) {
+	isError := true
+	script := &Script{Turns: []ScriptTurn{{
+		ExpectText:              "try again",
+		ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "git_status", IsError: &isError, Contains: "interrupted"}},
+		FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+	}}}
+	agent, _ := newScriptedAgent(t, script, WithSession(crashedSession()))
+
+	if _, err := agent.ProcessMessage(context.Background(), "try again"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+}
+
+func TestForkContinuesInANewSession(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "first"}}}},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "second"}}}},
+	}}
+	agent, _ := newScriptedAgent(t, script)
+
+	if _, err := agent.ProcessMessage(context.Background(), "one"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	original := agent.GetSession().ID
+
+	fork, err := agent.Fork()
+	if err != nil {
+		t.Fatalf("Fork failed: %v", err)
+	}
+	if fork.ID == original || fork.ForkedFrom != original || agent.GetSession() != fork {
+		t.Fatalf("expected the agent to continue in a new session forked from %s, got %+v", original, fork)
+	}
+	if _, err := agent.ProcessMessage(context.Background(), "two"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	saved, err := agent.LoadSessionFromDir(original)
+	if err != nil {
+		t.Fatalf("failed to load the original session: %v", err)
+	}
+	if len(saved.History) != 2 {
+		t.Errorf("expected the original session to be left as it was, got %d messages", len(saved.History))
+	}
+	forked, err := agent.LoadSessionFromDir(fork.ID)
+	if err != nil {
+		t.Fatalf("failed to load the forked session: %v", err)
+	}
+	if len(forked.History) != 4 || forked.TotalUsage.Requests != 1 {
+		t.Errorf("expected the fork to hold both turns and only its own usage, got %d messages, %+v", len(forked.History), forked.TotalUsage)
+	}
+}
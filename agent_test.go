@@ -0,0 +1,136 @@
+package makasero
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newScriptedAgent(t *testing.T, script *Script, opts ...AgentOption) (*Agent, *ScriptedProvider) {
+	t.Helper()
+
+	provider := NewScriptedProvider(script)
+	opts = append([]AgentOption{WithProvider(provider), WithSessionDir(t.TempDir())}, opts...)
+	agent, err := NewAgent(context.Background(), "", &MCPConfig{}, opts...)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	return agent, provider
+}
+
+func TestProcessMessageWithScript(t *testing.T) {
+	script, err := LoadScript(filepath.Join("testdata", "scripts", "git_status_complete.json"))
+	if err != nil {
+		t.Fatalf("failed to load script: %v", err)
+	}
+	agent, provider := newScriptedAgent(t, script)
+
+	if _, err := agent.ProcessMessage(context.Background(), "show me the git status"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	if n := provider.Remaining(); n != 0 {
+		t.Errorf("expected the whole script to be consumed, %d turns left", n)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.Provider != ProviderScripted {
+		t.Errorf("expected provider %s, got %s", ProviderScripted, saved.Provider)
+	}
+	// user prompt, model call, function response, model complete
+	if len(saved.History) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(saved.History))
+	}
+	if calls := saved.History[3].FunctionCalls(); len(calls) != 1 || calls[0].Name != "complete" {
+		t.Errorf("expected the last turn to call complete, got %+v", saved.History[3])
+	}
+}
+
+func TestProcessMessageScriptExpectationFailure(t *testing.T) {
+	isError := true
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}}},
+		{
+			ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "git_status", IsError: &isError}},
+			FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+		},
+	}}
+	agent, _ := newScriptedAgent(t, script)
+
+	_, err := agent.ProcessMessage(context.Background(), "status please")
+	if err == nil || !strings.Contains(err.Error(), "expected is_error=true") {
+		t.Fatalf("expected an expectation failure, got %v", err)
+	}
+}
+
+func TestProcessMessageEmitsEvents(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{Text: "looking", FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}}},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}}},
+	}}
+	var events []Event
+	agent, _ := newScriptedAgent(t, script, WithEventHandler(func(e Event) { events = append(events, e) }))
+
+	if _, err := agent.ProcessMessage(context.Background(), "status"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	want := []struct {
+		typ  EventType
+		turn int
+		text string
+		fn   string
+	}{
+		{EventTurnStarted, 1, "", ""},
+		{EventTextDelta, 1, "looking", ""},
+		{EventText, 1, "looking", ""},
+		{EventFunctionCall, 1, "", "git_status"},
+		{EventFunctionResult, 1, "", "git_status"},
+		{EventTurnStarted, 2, "", ""},
+		{EventFunctionCall, 2, "", "complete"},
+		{EventCompleted, 2, "done", ""},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Type != w.typ || e.Turn != w.turn || e.Text != w.text || e.Function != w.fn {
+			t.Errorf("event %d: expected %+v, got %+v", i, w, e)
+		}
+		if e.SessionID != agent.GetSession().ID {
+			t.Errorf("event %d: expected session %s, got %s", i, agent.GetSession().ID, e.SessionID)
+		}
+	}
+}
+
+func TestProcessMessageEmitsErrorEvent(t *testing.T) {
+	var last Event
+	agent, _ := newScriptedAgent(t, &Script{}, WithEventHandler(func(e Event) { last = e }))
+
+	if _, err := agent.ProcessMessage(context.Background(), "hello"); err == nil {
+		t.Fatal("expected an error from an empty script")
+	}
+	if last.Type != EventError || !strings.Contains(last.Error, "script exhausted") {
+		t.Errorf("expected an error event, got %+v", last)
+	}
+}
+
+func TestFunctionDeclarationsAreSorted(t *testing.T) {
+	agent, _ := newScriptedAgent(t, &Script{})
+
+	decls := agent.functionDeclarations()
+	names := make([]string, len(decls))
+	for i, decl := range decls {
+		names[i] = decl.Name
+	}
+	if !slices.IsSorted(names) {
+		t.Errorf("expected the declarations to be sorted by name, got %v", names)
+	}
+}
@@ -0,0 +1,111 @@
+package makasero
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Budget limits a single ProcessMessage run. Zero values mean no limit.
+type Budget struct {
+	MaxTurns       int      `json:"maxTurns,omitempty"`       // requests sent to the model
+	MaxToolCalls   int      `json:"maxToolCalls,omitempty"`   // functions executed
+	MaxDuration    Duration `json:"maxDuration,omitempty"`    // wall-clock time, e.g. "30m"
+	MaxTotalTokens int      `json:"maxTotalTokens,omitempty"` // total tokens reported by the provider
+}
+
+// Duration is a time.Duration that is written as a string such as "1h30m" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+const (
+	BudgetTurns       = "turns"
+	BudgetToolCalls   = "tool_calls"
+	BudgetDuration    = "duration"
+	BudgetTotalTokens = "total_tokens"
+)
+
+// BudgetExceededError is returned by ProcessMessage when a Budget limit is hit.
+// The session is saved with SessionStatusBudgetExceeded.
+type BudgetExceededError struct {
+	Limit string // one of BudgetTurns, BudgetToolCalls, BudgetDuration or BudgetTotalTokens
+	Max   string
+	Used  string
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("budget exceeded: %s limit %s reached (used %s)", e.Limit, e.Max, e.Used)
+}
+
+// WithBudget limits each ProcessMessage run. It overrides the budget in the config.
+func WithBudget(b Budget) AgentOption {
+	return func(a *Agent) {
+		a.budget = &b
+	}
+}
+
+// budgetTracker counts what one ProcessMessage run has consumed.
+type budgetTracker struct {
+	budget    Budget
+	startedAt time.Time
+	turns     int
+	toolCalls int
+	tokens    int
+}
+
+func newBudgetTracker(b *Budget) *budgetTracker {
+	t := &budgetTracker{startedAt: time.Now()}
+	if b != nil {
+		t.budget = *b
+	}
+	return t
+}
+
+// checkTurn is called before a request is sent to the model.
+func (t *budgetTracker) checkTurn() error {
+	if t.budget.MaxTurns > 0 && t.turns >= t.budget.MaxTurns {
+		return &BudgetExceededError{Limit: BudgetTurns, Max: fmt.Sprint(t.budget.MaxTurns), Used: fmt.Sprint(t.turns)}
+	}
+	if t.budget.MaxTotalTokens > 0 && t.tokens >= t.budget.MaxTotalTokens {
+		return &BudgetExceededError{Limit: BudgetTotalTokens, Max: fmt.Sprint(t.budget.MaxTotalTokens), Used: fmt.Sprint(t.tokens)}
+	}
+	return t.checkDuration()
+}
+
+// checkToolCall is called before a function is executed.
+func (t *budgetTracker) checkToolCall() error {
+	if t.budget.MaxToolCalls > 0 && t.toolCalls >= t.budget.MaxToolCalls {
+		return &BudgetExceededError{Limit: BudgetToolCalls, Max: fmt.Sprint(t.budget.MaxToolCalls), Used: fmt.Sprint(t.toolCalls)}
+	}
+	return t.checkDuration()
+}
+
+func (t *budgetTracker) checkDuration() error {
+	max := time.Duration(t.budget.MaxDuration)
+	if elapsed := time.Since(t.startedAt); max > 0 && elapsed >= max {
+		return &BudgetExceededError{Limit: BudgetDuration, Max: max.String(), Used: elapsed.Round(time.Second).String()}
+	}
+	return nil
+}
+
+func (t *budgetTracker) addUsage(u *Usage) {
+	if u != nil {
+		t.tokens += u.TotalTokens
+	}
+}
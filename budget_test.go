@@ -0,0 +1,151 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// loopingScript never calls 'complete'.
+func loopingScript(turns int, usage *Usage) *Script {
+	script := &Script{}
+	for i := 0; i < turns; i++ {
+		script.Turns = append(script.Turns, ScriptTurn{
+			FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}},
+			Usage:         usage,
+		})
+	}
+	return script
+}
+
+func TestProcessMessageBudgetExceeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		budget    Budget
+		usage     *Usage
+		wantLimit string
+		wantTurns int // requests the provider received
+	}{
+		{name: "turns", budget: Budget{MaxTurns: 3}, wantLimit: BudgetTurns, wantTurns: 3},
+		{name: "tool calls", budget: Budget{MaxToolCalls: 2}, wantLimit: BudgetToolCalls, wantTurns: 3},
+		{name: "tokens", budget: Budget{MaxTotalTokens: 250}, usage: &Usage{TotalTokens: 100}, wantLimit: BudgetTotalTokens, wantTurns: 3},
+		{name: "duration", budget: Budget{MaxDuration: Duration(time.Nanosecond)}, wantLimit: BudgetDuration, wantTurns: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, provider := newScriptedAgent(t, loopingScript(10, tt.usage), WithBudget(tt.budget))
+
+			_, err := agent.ProcessMessage(context.Background(), "loop forever")
+
+			var budgetErr *BudgetExceededError
+			if !errors.As(err, &budgetErr) {
+				t.Fatalf("expected BudgetExceededError, got %v", err)
+			}
+			if budgetErr.Limit != tt.wantLimit {
+				t.Errorf("expected limit %s, got %s", tt.wantLimit, budgetErr.Limit)
+			}
+			if n := len(provider.Requests()); n != tt.wantTurns {
+				t.Errorf("expected %d requests, got %d", tt.wantTurns, n)
+			}
+
+			saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+			if err != nil {
+				t.Fatalf("failed to load saved session: %v", err)
+			}
+			if saved.Status != SessionStatusBudgetExceeded {
+				t.Errorf("expected status %s, got %q", SessionStatusBudgetExceeded, saved.Status)
+			}
+		})
+	}
+}
+
+// blockingProvider replays a script, then blocks until the request is cancelled.
+type blockingProvider struct {
+	*ScriptedProvider
+}
+
+func (p *blockingProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	if p.Remaining() > 0 {
+		return p.ScriptedProvider.Generate(ctx, req)
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestProcessMessageDurationStopsBlockedCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		script *Script
+	}{
+		{name: "model", script: &Script{}},
+		{name: "function", script: &Script{Turns: []ScriptTurn{{FunctionCalls: []ScriptFunctionCall{{Name: "slow"}}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &blockingProvider{NewScriptedProvider(tt.script)}
+			agent, err := NewAgent(context.Background(), "", &MCPConfig{},
+				WithProvider(provider), WithSessionDir(t.TempDir()), WithBudget(Budget{MaxDuration: Duration(50 * time.Millisecond)}))
+			if err != nil {
+				t.Fatalf("failed to create agent: %v", err)
+			}
+			defer agent.Close()
+			addBlockingFunction(agent, "slow", nil)
+
+			_, err = agent.ProcessMessage(context.Background(), "block")
+
+			var budgetErr *BudgetExceededError
+			if !errors.As(err, &budgetErr) || budgetErr.Limit != BudgetDuration {
+				t.Fatalf("expected the duration budget to be exceeded, got %v", err)
+			}
+			saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+			if err != nil {
+				t.Fatalf("failed to load saved session: %v", err)
+			}
+			if saved.Status != SessionStatusBudgetExceeded {
+				t.Errorf("expected status %s, got %q", SessionStatusBudgetExceeded, saved.Status)
+			}
+		})
+	}
+}
+
+func TestProcessMessageToolBudgetKeepsResults(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{{
+		FunctionCalls: []ScriptFunctionCall{
+			{Name: "git_status", Args: map[string]any{"path_to_status": "."}},
+			{Name: "git_status", Args: map[string]any{"path_to_status": "."}},
+		},
+	}}}
+	agent, _ := newScriptedAgent(t, script, WithBudget(Budget{MaxToolCalls: 1}))
+
+	if _, err := agent.ProcessMessage(context.Background(), "status twice"); err == nil {
+		t.Fatal("expected the tool call budget to be exceeded")
+	}
+
+	// every call must have a response so that the session can be resumed
+	history := agent.GetSession().History
+	last := history[len(history)-1]
+	if last.Role != RoleUser || len(last.Parts) != 2 {
+		t.Fatalf("expected both function responses in the last message, got %+v", last)
+	}
+	if isError, _ := last.Parts[1].(FunctionResponse).Response["is_error"].(bool); !isError {
+		t.Errorf("expected the call over budget to be reported as an error, got %+v", last.Parts[1])
+	}
+}
+
+func TestBudgetConfigJSON(t *testing.T) {
+	var config MCPConfig
+	if err := json.Unmarshal([]byte(`{"budget": {"maxTurns": 20, "maxDuration": "1h30m"}}`), &config); err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if config.Budget.MaxTurns != 20 || time.Duration(config.Budget.MaxDuration) != 90*time.Minute {
+		t.Errorf("unexpected budget: %+v", config.Budget)
+	}
+
+	if err := json.Unmarshal([]byte(`{"budget": {"maxDuration": 60}}`), &config); err == nil {
+		t.Error("expected an error for a numeric duration")
+	}
+}
@@ -0,0 +1,252 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/pankona/makasero/mlog"
+)
+
+// Cassette is a recorded conversation with a model. Each interaction holds all
+// the messages of a request and the model's reply. The whole list is recorded,
+// since requests do not only grow: compaction sends a shorter history and a
+// separate summary request.
+//
+// Only the model is replayed. The functions the model calls, such as run_shell
+// or git_commit, run for real during a replay.
+type Cassette struct {
+	Provider     string         `json:"provider"`
+	Model        string         `json:"model,omitempty"`
+	Interactions []*Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  []*SerializableContent `json:"request"`
+	Response *SerializableContent   `json:"response,omitempty"`
+	Usage    *Usage                 `json:"usage,omitempty"`
+	Model    string                 `json:"model,omitempty"` // when a fallback model served the request
+	Error    string                 `json:"error,omitempty"`
+	// Transient is set when the error was worth retrying, so that replays retry as well.
+	Transient bool `json:"transient,omitempty"`
+}
+
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %v", err)
+	}
+
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette: %v", err)
+	}
+	return &cassette, nil
+}
+
+// RecordingProvider wraps a Provider and writes every exchange to a cassette
+// file. The file is rewritten after each interaction so that it survives crashes.
+type RecordingProvider struct {
+	mu       sync.Mutex
+	inner    Provider
+	path     string
+	cassette *Cassette
+}
+
+func NewRecordingProvider(inner Provider, path string) *RecordingProvider {
+	return &RecordingProvider{
+		inner:    inner,
+		path:     path,
+		cassette: &Cassette{Provider: inner.Name(), Model: modelNameOf(inner)},
+	}
+}
+
+func (p *RecordingProvider) Name() string {
+	return p.inner.Name()
+}
+
+func (p *RecordingProvider) ModelName() string {
+	return p.cassette.Model
+}
+
+func (p *RecordingProvider) Close() error {
+	return p.inner.Close()
+}
+
+func (p *RecordingProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	resp, err := p.inner.Generate(ctx, req)
+	p.record(ctx, req, resp, err)
+	return resp, err
+}
+
+func (p *RecordingProvider) GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	resp, err := generateStream(ctx, p.inner, req, onText)
+	p.record(ctx, req, resp, err)
+	return resp, err
+}
+
+func (p *RecordingProvider) record(ctx context.Context, req *GenerateRequest, resp *GenerateResponse, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	interaction := &Interaction{Request: serializeMessages(req.Messages)}
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.Transient, _ = isTransient(err)
+	} else {
+		interaction.Usage = resp.Usage
+		interaction.Model = resp.Model
+		if resp.Message != nil {
+			interaction.Response = serializeMessage(resp.Message)
+		}
+	}
+	p.cassette.Interactions = append(p.cassette.Interactions, interaction)
+
+	if writeErr := writeFileAtomic(p.path, mustMarshalIndent(p.cassette), 0644); writeErr != nil {
+		mlog.Errorf(ctx, "Failed to write cassette %s: %v", p.path, writeErr)
+	}
+}
+
+// ReplayProvider answers requests from a cassette without contacting a model.
+// It fails as soon as the agent sends something different from the recording.
+// The functions called by the recorded replies are run by the agent as usual.
+type ReplayProvider struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	next     int
+}
+
+func NewReplayProvider(cassette *Cassette) *ReplayProvider {
+	return &ReplayProvider{cassette: cassette}
+}
+
+func (p *ReplayProvider) Name() string {
+	return p.cassette.Provider
+}
+
+func (p *ReplayProvider) ModelName() string {
+	return p.cassette.Model
+}
+
+func (p *ReplayProvider) Close() error {
+	return nil
+}
+
+// Remaining returns the number of recorded interactions not replayed yet.
+func (p *ReplayProvider) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.cassette.Interactions) - p.next
+}
+
+func (p *ReplayProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next >= len(p.cassette.Interactions) {
+		return nil, fmt.Errorf("replay diverged: unexpected request %d, the cassette has only %d interactions", p.next+1, len(p.cassette.Interactions))
+	}
+	index := p.next
+	interaction := p.cassette.Interactions[index]
+	p.next++
+
+	if err := compareReplayedMessages(ctx, deserializeMessages(interaction.Request), req.Messages); err != nil {
+		return nil, fmt.Errorf("replay diverged at interaction %d: %v", index+1, err)
+	}
+
+	if interaction.Error != "" {
+		if interaction.Transient {
+			return nil, &TransientError{Err: errors.New(interaction.Error)}
+		}
+		return nil, errors.New(interaction.Error)
+	}
+	if interaction.Response == nil {
+		return &GenerateResponse{Usage: interaction.Usage, Model: interaction.Model}, nil
+	}
+
+	return &GenerateResponse{Message: deserializeMessage(interaction.Response), Usage: interaction.Usage, Model: interaction.Model}, nil
+}
+
+// compareReplayedMessages checks that the agent sent the recorded messages.
+// Tool outputs may legitimately differ between runs (e.g. git status), so only
+// the function name, call ID and is_error of function responses must match.
+func compareReplayedMessages(ctx context.Context, want, got []*Message) error {
+	if len(want) != len(got) {
+		return fmt.Errorf("expected %d messages, got %d", len(want), len(got))
+	}
+
+	for i := range want {
+		if want[i].Role != got[i].Role {
+			return fmt.Errorf("message %d: expected role %s, got %s", i, want[i].Role, got[i].Role)
+		}
+		if len(want[i].Parts) != len(got[i].Parts) {
+			return fmt.Errorf("message %d: expected %d parts, got %d", i, len(want[i].Parts), len(got[i].Parts))
+		}
+
+		for j := range want[i].Parts {
+			if err := compareReplayedPart(ctx, want[i].Parts[j], got[i].Parts[j]); err != nil {
+				return fmt.Errorf("message %d part %d: %v", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compareReplayedPart(ctx context.Context, want, got Part) error {
+	switch w := want.(type) {
+	case Text:
+		g, ok := got.(Text)
+		if !ok {
+			return fmt.Errorf("expected text, got %T", got)
+		}
+		if w != g {
+			return fmt.Errorf("expected text %q, got %q", w, g)
+		}
+	case FunctionCall:
+		g, ok := got.(FunctionCall)
+		if !ok {
+			return fmt.Errorf("expected function call %s, got %T", w.Name, got)
+		}
+		if w.Name != g.Name {
+			return fmt.Errorf("expected function call %s, got %s", w.Name, g.Name)
+		}
+		if !jsonEqual(w.Args, g.Args) {
+			return fmt.Errorf("function call %s: expected args %s, got %s", w.Name, mustMarshalObject(w.Args), mustMarshalObject(g.Args))
+		}
+	case FunctionResponse:
+		g, ok := got.(FunctionResponse)
+		if !ok {
+			return fmt.Errorf("expected function response %s, got %T", w.Name, got)
+		}
+		if w.Name != g.Name || w.ID != g.ID {
+			return fmt.Errorf("expected function response %s (%s), got %s (%s)", w.Name, w.ID, g.Name, g.ID)
+		}
+		wantErr, _ := w.Response["is_error"].(bool)
+		gotErr, _ := g.Response["is_error"].(bool)
+		if wantErr != gotErr {
+			return fmt.Errorf("function response %s: expected is_error=%v, got %v: %s", w.Name, wantErr, gotErr, mustMarshalObject(g.Response))
+		}
+		if !jsonEqual(w.Response, g.Response) {
+			mlog.Warnf(ctx, "Replay: output of %s differs from the recording", w.Name)
+		}
+	default:
+		return fmt.Errorf("unknown part type %T", want)
+	}
+	return nil
+}
+
+// jsonEqual compares values after a JSON round trip so that e.g. int and float64 compare equal.
+func jsonEqual(a, b map[string]any) bool {
+	var na, nb any
+	if err := json.Unmarshal(mustMarshalObject(a), &na); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(mustMarshalObject(b), &nb); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(na, nb)
+}
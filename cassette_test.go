@@ -0,0 +1,109 @@
+package makasero
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func recordScriptedSession(t *testing.T, prompt string) string {
+	t.Helper()
+
+	cassettePath := filepath.Join(t.TempDir(), "cassette.json")
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}}},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}}},
+	}}
+	agent, _ := newScriptedAgent(t, script, WithProviderWrapper(func(p Provider) Provider {
+		return NewRecordingProvider(p, cassettePath)
+	}))
+	if _, err := agent.ProcessMessage(context.Background(), prompt); err != nil {
+		t.Fatalf("ProcessMessage failed while recording: %v", err)
+	}
+	return cassettePath
+}
+
+func TestCassetteRecordAndReplay(t *testing.T) {
+	cassettePath := recordScriptedSession(t, "check the status")
+
+	cassette, err := LoadCassette(cassettePath)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	if len(cassette.Interactions) != 2 || cassette.Provider != ProviderScripted {
+		t.Fatalf("unexpected cassette: provider=%s interactions=%d", cassette.Provider, len(cassette.Interactions))
+	}
+	// the second request carries the whole history: prompt, git_status call and its result
+	if got := len(cassette.Interactions[1].Request); got != 3 {
+		t.Errorf("expected 3 messages in the second request, got %d", got)
+	}
+
+	replay := NewReplayProvider(cassette)
+	agent, err := NewAgent(context.Background(), "", &MCPConfig{}, WithProvider(replay), WithSessionDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	defer agent.Close()
+
+	if _, err := agent.ProcessMessage(context.Background(), "check the status"); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if n := replay.Remaining(); n != 0 {
+		t.Errorf("expected all interactions to be replayed, %d left", n)
+	}
+}
+
+func TestCassetteReplayDivergence(t *testing.T) {
+	cassettePath := recordScriptedSession(t, "check the status")
+
+	cassette, err := LoadCassette(cassettePath)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	// pretend the agent ran a different function when the cassette was recorded
+	cassette.Interactions[1].Request[2].Parts[0].Content.(map[string]any)["Name"] = "git_diff"
+
+	agent, err := NewAgent(context.Background(), "", &MCPConfig{}, WithProvider(NewReplayProvider(cassette)), WithSessionDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	defer agent.Close()
+
+	_, err = agent.ProcessMessage(context.Background(), "check the status")
+	if err == nil || !strings.Contains(err.Error(), "replay diverged at interaction 2") {
+		t.Fatalf("expected a divergence error, got %v", err)
+	}
+}
+
+func TestCassetteReplaysShorterRequests(t *testing.T) {
+	cassettePath := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := NewRecordingProvider(NewScriptedProvider(&Script{Turns: []ScriptTurn{{Text: "first"}, {Text: "summary"}}}), cassettePath)
+
+	// 要約のように、前のリクエストより短いリクエストを送る
+	long := &GenerateRequest{Messages: []*Message{NewUserMessage(Text("one")), {Role: RoleModel, Parts: []Part{Text("two")}}, NewUserMessage(Text("three"))}}
+	short := &GenerateRequest{Messages: []*Message{NewUserMessage(Text("summarize"))}}
+	for _, req := range []*GenerateRequest{long, short} {
+		if _, err := recorder.Generate(context.Background(), req); err != nil {
+			t.Fatalf("recording failed: %v", err)
+		}
+	}
+
+	cassette, err := LoadCassette(cassettePath)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	replay := NewReplayProvider(cassette)
+	for _, req := range []*GenerateRequest{long, short} {
+		if _, err := replay.Generate(context.Background(), req); err != nil {
+			t.Fatalf("replay failed: %v", err)
+		}
+	}
+
+	// 同じ長さでも内容が違えば食い違いとして検出する
+	replay = NewReplayProvider(cassette)
+	replay.Generate(context.Background(), long)
+	if _, err := replay.Generate(context.Background(), &GenerateRequest{Messages: []*Message{NewUserMessage(Text("something else"))}}); err == nil {
+		t.Error("expected a different request to diverge")
+	}
+}
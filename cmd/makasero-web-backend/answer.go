@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/pankona/makasero"
+	"github.com/pankona/makasero/mlog"
+)
+
+type AnswerQuestionRequest struct {
+	Answer string `json:"answer"`
+}
+
+type AnswerQuestionResponse struct {
+	Message string `json:"message"`
+}
+
+// handleAnswerQuestion はモデルの質問 (pending_question) への回答を ask_question の結果として送り、
+// セッションの処理を再開する
+func handleAnswerQuestion(w http.ResponseWriter, r *http.Request, sm *SessionManager, sessionID string) {
+	var req AnswerQuestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Answer == "" {
+		http.Error(w, "Answer is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+
+	// 同時に送られた回答が同じ質問から 2 回再開しないよう、質問を確かめる前に実行を登録する。
+	// POST /api/sessions/{sessionId}/cancel で中断できるようにもなる
+	gCtx, done, err := sm.runs.start(sessionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v: %s", err, sessionID), http.StatusConflict)
+		return
+	}
+
+	loadedSession, err := sm.sessionLoader.LoadSession(sessionID)
+	if err != nil {
+		done()
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("Session not found: %s", sessionID), http.StatusNotFound)
+		} else {
+			log.Printf("Failed to load session %s: %v", sessionID, err)
+			http.Error(w, "Failed to load session data", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if loadedSession.PendingQuestion == nil {
+		done()
+		http.Error(w, "Session has no pending question: "+sessionID, http.StatusConflict)
+		return
+	}
+
+	config, err := sm.configLoader.LoadMCPConfig(sm.configPath)
+	if err != nil {
+		done()
+		log.Printf("Error loading MCP config from %s: %v", sm.configPath, err)
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	opts := []makasero.AgentOption{
+		makasero.WithSession(loadedSession),
+		makasero.WithModelName(sm.modelName),
+	}
+	if sm.streams != nil {
+		opts = append(opts, makasero.WithEventHandler(sm.streams.handler(sessionID)))
+	}
+
+	agentProcessor, err := sm.agentCreator.NewAgent(ctx, sm.apiKey, config, opts...)
+	if err != nil {
+		done()
+		log.Printf("Failed to create agent for session %s answer: %v", sessionID, err)
+		http.Error(w, "Failed to initialize session for answer: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go func() {
+		defer done()
+		gLogger := log.New(os.Stderr, "[makasero-answer-"+sessionID+"] ", log.LstdFlags|log.Lshortfile)
+		gLogger.Printf("Resuming session %s with the answer", sessionID)
+
+		if result, err := agentProcessor.Answer(gCtx, req.Answer); err != nil {
+			mlog.Errorf(gCtx, "Error processing answer for session %s: %v", sessionID, err)
+		} else {
+			mlog.Infof(gCtx, "Successfully finished processing the answer for session %s (%s)", sessionID, result.Outcome)
+		}
+		if err := agentProcessor.Close(); err != nil {
+			mlog.Errorf(gCtx, "Error closing agent for session %s answer: %v", sessionID, err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(AnswerQuestionResponse{Message: "Answer accepted"}); err != nil {
+		log.Printf("Error writing answer response for session %s: %v", sessionID, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+)
+
+type CancelSessionResponse struct {
+	Message string `json:"message"`
+}
+
+// runRegistry は実行中のセッションを中断するための cancel 関数を保持する。ゼロ値で使える
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*run
+}
+
+type run struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// errAlreadyRunning は実行中のセッションをさらに実行しようとしたときのエラー
+var errAlreadyRunning = errors.New("session is already running")
+
+// start はセッションの実行用コンテキストを作る。実行が終わったら done を呼ぶこと。
+// 同じセッションの実行が終わっていなければ errAlreadyRunning を返す。
+// 2 つの実行が同じセッションファイルに書き込まないよう、セッションを読み込む前に呼ぶ
+func (r *runRegistry) start(sessionID string) (ctx context.Context, done func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.runs[sessionID]; ok {
+		return nil, nil, errAlreadyRunning
+	}
+	if r.runs == nil {
+		r.runs = make(map[string]*run)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.runs[sessionID] = &run{ctx: ctx, cancel: cancel}
+
+	return ctx, func() {
+		cancel()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.runs, sessionID)
+	}, nil
+}
+
+// cancel は実行中のセッションを中断する。実行中でなければ false を返す。
+// 中断した実行は done が呼ばれるまで残り、その間は新しい実行を始められない
+func (r *runRegistry) cancel(sessionID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.runs[sessionID]
+	if !ok || current.ctx.Err() != nil {
+		return false
+	}
+	current.cancel()
+	return true
+}
+
+func handleCancelSession(w http.ResponseWriter, r *http.Request, sm *SessionManager, sessionID string) {
+	if !sm.runs.cancel(sessionID) {
+		http.Error(w, "Session is not running: "+sessionID, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(CancelSessionResponse{Message: "Cancellation requested"}); err != nil {
+		log.Printf("Error writing cancel response for session %s: %v", sessionID, err)
+	}
+}
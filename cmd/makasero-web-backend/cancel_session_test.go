@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pankona/makasero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelSession(t *testing.T) {
+	started := make(chan struct{})
+	mockAgent := NewMockAgent()
+	mockAgent.ProcessMessageFunc = func(ctx context.Context, userInput string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	agentCreator := &mockAgentCreator{
+		NewAgentFunc: func(ctx context.Context, apiKey string, config *makasero.MCPConfig, opts ...makasero.AgentOption) (AgentProcessor, error) {
+			return mockAgent, nil
+		},
+	}
+	sm := setupTestSessionManager(t, "", nil, agentCreator, nil)
+	server := createTestServer(t, sm)
+	defer server.Close()
+
+	jsonBody, _ := json.Marshal(CreateSessionRequest{Prompt: "long task"})
+	resp, err := http.Post(server.URL+"/api/sessions", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	var created CreateSessionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	resp.Body.Close()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ProcessMessage が開始されなかった")
+	}
+
+	cancelURL := server.URL + "/api/sessions/" + created.SessionID + "/cancel"
+	resp, err = http.Post(cancelURL, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case <-mockAgent.CloseChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("中断後にエージェントが Close されなかった")
+	}
+
+	// 実行中でなければ 404
+	resp, err = http.Post(cancelURL, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRunningSessionRejectsNewRuns(t *testing.T) {
+	started := make(chan struct{})
+	mockAgent := NewMockAgent()
+	mockAgent.ProcessMessageFunc = func(ctx context.Context, userInput string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	agentCreator := &mockAgentCreator{
+		NewAgentFunc: func(ctx context.Context, apiKey string, config *makasero.MCPConfig, opts ...makasero.AgentOption) (AgentProcessor, error) {
+			return mockAgent, nil
+		},
+	}
+	sessionLoader := &mockSessionLoader{
+		LoadSessionFunc: func(id string) (*makasero.Session, error) {
+			session := createDummySession(id)
+			session.PendingQuestion = &makasero.PendingQuestion{CallID: "call_0_0", Question: "which branch?"}
+			return session, nil
+		},
+	}
+	sm := setupTestSessionManager(t, "", nil, agentCreator, sessionLoader)
+	server := createTestServer(t, sm)
+	defer server.Close()
+
+	jsonBody, _ := json.Marshal(CreateSessionRequest{Prompt: "long task"})
+	resp, err := http.Post(server.URL+"/api/sessions", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	var created CreateSessionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	resp.Body.Close()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ProcessMessage が開始されなかった")
+	}
+
+	// 実行中のセッションには新しいコマンドを送れない
+	jsonBody, _ = json.Marshal(SendCommandRequest{Command: "another task"})
+	resp, err = http.Post(server.URL+"/api/sessions/"+created.SessionID+"/commands", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// 同時に送られた回答も、質問が残っていても受け付けない
+	jsonBody, _ = json.Marshal(AnswerQuestionRequest{Answer: "main"})
+	resp, err = http.Post(server.URL+"/api/sessions/"+created.SessionID+"/answer", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/api/sessions/"+created.SessionID+"/cancel", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	select {
+	case <-mockAgent.CloseChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("中断後にエージェントが Close されなかった")
+	}
+}
@@ -105,3 +105,29 @@ func TestCreateSession_EmptyPrompt(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "空プロンプトの場合は 400 Bad Request であるべき")
 }
+
+func TestCreateSession_InvalidOutputSchema(t *testing.T) {
+	sm := &SessionManager{
+		apiKey:        "test-api-key",
+		modelName:     "test-model",
+		configPath:    "/fake/config.json",
+		configLoader:  &mockConfigLoader{},
+		agentCreator:  &mockAgentCreator{},
+		sessionLoader: &mockSessionLoader{},
+	}
+	server := createTestServer(t, sm)
+	defer server.Close()
+
+	reqBody := CreateSessionRequest{Prompt: "summarize", OutputSchema: &makasero.Schema{Type: makasero.TypeString}}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/sessions", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "object 以外の output_schema は 400 Bad Request であるべき")
+}
@@ -13,7 +13,8 @@ type AgentCreator interface {
 
 // Agentの主要な処理を行うインターフェース
 type AgentProcessor interface {
-	ProcessMessage(ctx context.Context, userInput string) error
+	ProcessMessage(ctx context.Context, userInput string) (*makasero.Result, error)
+	Answer(ctx context.Context, answer string) (*makasero.Result, error)
 	Close() error
 }
 
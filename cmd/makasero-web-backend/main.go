@@ -18,6 +18,8 @@ import (
 
 type CreateSessionRequest struct {
 	Prompt string `json:"prompt"`
+	// OutputSchema を指定すると、検証済みの実行結果がセッションの output に保存される
+	OutputSchema *makasero.Schema `json:"output_schema,omitempty"`
 }
 
 type CreateSessionResponse struct {
@@ -40,18 +42,18 @@ type SessionManager struct {
 	configLoader  ConfigLoader
 	agentCreator  AgentCreator
 	sessionLoader SessionLoader
+	streams       *streamHub
+	runs          runRegistry
 }
 
 func NewSessionManager() (*SessionManager, error) {
+	// Gemini 以外のプロバイダを使う場合は設定ファイルの provider セクションで指定する
 	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("GEMINI_API_KEY environment variable is not set")
-	}
 
+	// 未設定の場合は設定ファイルまたはプロバイダの既定のモデルを使う (CLI と同じ)
 	modelName := os.Getenv("MODEL_NAME")
 	if modelName == "" {
-		modelName = "gemini-1.5-flash-latest"
-		log.Printf("MODEL_NAME not set, using default: %s", modelName)
+		log.Printf("MODEL_NAME not set, using the model of the config")
 	}
 
 	_, configPath, _, err := setupMakaseroEnvironment()
@@ -67,6 +69,7 @@ func NewSessionManager() (*SessionManager, error) {
 		configLoader:  &defaultConfigLoader{},
 		agentCreator:  &defaultAgentCreator{},
 		sessionLoader: &defaultSessionLoader{},
+		streams:       newStreamHub(),
 	}, nil
 }
 
@@ -139,11 +142,26 @@ func handleCreateSession(w http.ResponseWriter, r *http.Request, sm *SessionMana
 		return
 	}
 
+	if req.OutputSchema != nil {
+		if err := makasero.ValidateOutputSchema(req.OutputSchema); err != nil {
+			http.Error(w, "Invalid output_schema: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	sessionID := uuid.New().String()
 	ctx := context.Background()
 
+	// POST /api/sessions/{sessionId}/cancel で中断できるようにする
+	gCtx, done, err := sm.runs.start(sessionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v: %s", err, sessionID), http.StatusConflict)
+		return
+	}
+
 	config, err := sm.configLoader.LoadMCPConfig(sm.configPath)
 	if err != nil {
+		done()
 		log.Printf("Error loading MCP config from %s: %v", sm.configPath, err)
 		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
 		return
@@ -153,23 +171,30 @@ func handleCreateSession(w http.ResponseWriter, r *http.Request, sm *SessionMana
 		makasero.WithCustomSessionID(sessionID),
 		makasero.WithModelName(sm.modelName),
 	}
+	if req.OutputSchema != nil {
+		opts = append(opts, makasero.WithOutputSchema(req.OutputSchema))
+	}
+	if sm.streams != nil {
+		opts = append(opts, makasero.WithEventHandler(sm.streams.handler(sessionID)))
+	}
 
 	agentProcessor, err := sm.agentCreator.NewAgent(ctx, sm.apiKey, config, opts...)
 	if err != nil {
+		done()
 		log.Printf("Failed to create agent for session %s: %v", sessionID, err)
 		http.Error(w, "Failed to initialize session: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	go func() {
-		gCtx := context.Background()
+		defer done()
 		gLogger := log.New(os.Stderr, "[makasero-session-"+sessionID+"] ", log.LstdFlags|log.Lshortfile)
 		gLogger.Printf("Starting background processing for session %s", sessionID)
 
-		if err := agentProcessor.ProcessMessage(gCtx, req.Prompt); err != nil {
+		if result, err := agentProcessor.ProcessMessage(gCtx, req.Prompt); err != nil {
 			mlog.Errorf(gCtx, "Error processing message for session %s: %v", sessionID, err)
 		} else {
-			mlog.Infof(gCtx, "Successfully finished processing for session %s", sessionID)
+			mlog.Infof(gCtx, "Successfully finished processing for session %s (%s)", sessionID, result.Outcome)
 		}
 		if err := agentProcessor.Close(); err != nil {
 			mlog.Errorf(gCtx, "Error closing agent for session %s: %v", sessionID, err)
@@ -202,8 +227,16 @@ func handleSendCommand(w http.ResponseWriter, r *http.Request, sm *SessionManage
 
 	ctx := context.Background()
 
+	// POST /api/sessions/{sessionId}/cancel で中断できるようにする
+	gCtx, done, err := sm.runs.start(sessionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v: %s", err, sessionID), http.StatusConflict)
+		return
+	}
+
 	loadedSession, err := sm.sessionLoader.LoadSession(sessionID)
 	if err != nil {
+		done()
 		if os.IsNotExist(err) {
 			http.Error(w, fmt.Sprintf("Session not found: %s", sessionID), http.StatusNotFound)
 		} else {
@@ -215,6 +248,7 @@ func handleSendCommand(w http.ResponseWriter, r *http.Request, sm *SessionManage
 
 	config, err := sm.configLoader.LoadMCPConfig(sm.configPath)
 	if err != nil {
+		done()
 		log.Printf("Error loading MCP config from %s: %v", sm.configPath, err)
 		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
 		return
@@ -224,23 +258,27 @@ func handleSendCommand(w http.ResponseWriter, r *http.Request, sm *SessionManage
 		makasero.WithSession(loadedSession),
 		makasero.WithModelName(sm.modelName),
 	}
+	if sm.streams != nil {
+		opts = append(opts, makasero.WithEventHandler(sm.streams.handler(sessionID)))
+	}
 
 	agentProcessor, err := sm.agentCreator.NewAgent(ctx, sm.apiKey, config, opts...)
 	if err != nil {
+		done()
 		log.Printf("Failed to create agent for session %s command: %v", sessionID, err)
 		http.Error(w, "Failed to initialize session for command: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	go func() {
-		gCtx := context.Background()
+		defer done()
 		gLogger := log.New(os.Stderr, "[makasero-cmd-"+sessionID+"] ", log.LstdFlags|log.Lshortfile)
 		gLogger.Printf("Starting background command processing for session %s", sessionID)
 
-		if err := agentProcessor.ProcessMessage(gCtx, req.Command); err != nil {
+		if result, err := agentProcessor.ProcessMessage(gCtx, req.Command); err != nil {
 			mlog.Errorf(gCtx, "Error processing command for session %s: %v", sessionID, err)
 		} else {
-			mlog.Infof(gCtx, "Successfully finished command processing for session %s", sessionID)
+			mlog.Infof(gCtx, "Successfully finished command processing for session %s (%s)", sessionID, result.Outcome)
 		}
 		if err := agentProcessor.Close(); err != nil {
 			mlog.Errorf(gCtx, "Error closing agent for session %s command: %v", sessionID, err)
@@ -304,23 +342,23 @@ func setupDefaultStaticDir() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to get config directory: %w", err)
 	}
-	
+
 	defaultStaticDir := filepath.Join(makaseroDir, "web-frontend")
-	
+
 	if _, err := os.Stat(defaultStaticDir); err == nil {
 		return defaultStaticDir, nil
 	}
-	
+
 	if err := os.MkdirAll(defaultStaticDir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create default static directory: %w", err)
 	}
-	
+
 	indexContent := []byte("<html><body><h1>Makasero Web Frontend</h1><p>This directory is ready to serve static frontend files.</p></body></html>")
 	indexPath := filepath.Join(defaultStaticDir, "index.html")
 	if err := os.WriteFile(indexPath, indexContent, 0644); err != nil {
 		return defaultStaticDir, fmt.Errorf("created directory but failed to create placeholder index.html: %w", err)
 	}
-	
+
 	return defaultStaticDir, nil
 }
 
@@ -387,6 +425,24 @@ func main() {
 			} else {
 				http.Error(w, "Method not allowed for /api/sessions/{sessionID}/commands", http.StatusMethodNotAllowed)
 			}
+		} else if len(pathSegments) == 4 && pathSegments[3] == "answer" {
+			if r.Method == http.MethodPost {
+				handleAnswerQuestion(w, r, sessionManager, sessionID)
+			} else {
+				http.Error(w, "Method not allowed for /api/sessions/{sessionID}/answer", http.StatusMethodNotAllowed)
+			}
+		} else if len(pathSegments) == 4 && pathSegments[3] == "cancel" {
+			if r.Method == http.MethodPost {
+				handleCancelSession(w, r, sessionManager, sessionID)
+			} else {
+				http.Error(w, "Method not allowed for /api/sessions/{sessionID}/cancel", http.StatusMethodNotAllowed)
+			}
+		} else if len(pathSegments) == 4 && pathSegments[3] == "stream" {
+			if r.Method == http.MethodGet {
+				handleStreamSession(w, r, sessionManager, sessionID)
+			} else {
+				http.Error(w, "Method not allowed for /api/sessions/{sessionID}/stream", http.StatusMethodNotAllowed)
+			}
 		} else {
 			http.Error(w, fmt.Sprintf("Invalid path under /api/sessions/%s", sessionID), http.StatusBadRequest)
 		}
@@ -403,14 +459,14 @@ func main() {
 		}
 		*staticDir = defaultDir
 	}
-	
+
 	if _, err := os.Stat(*staticDir); os.IsNotExist(err) {
 		log.Fatalf("Static directory '%s' does not exist", *staticDir)
 	}
-	
+
 	log.Printf("Serving static files from: %s", *staticDir)
 	fs := http.FileServer(http.Dir(*staticDir))
-	
+
 	mainMux.Handle("/", fs)
 
 	handler := corsMiddleware(mainMux)
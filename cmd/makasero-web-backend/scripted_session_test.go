@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pankona/makasero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCreateSession_ScriptedProvider は実際の Agent とスクリプト化したプロバイダを使い、
+// セッション作成から保存・取得までをネットワークなしで通しで確認する
+func TestCreateSession_ScriptedProvider(t *testing.T) {
+	tempDir := t.TempDir()
+	originalSessionDir := makasero.SessionDir
+	makasero.SessionDir = tempDir
+	t.Cleanup(func() {
+		makasero.SessionDir = originalSessionDir
+	})
+
+	scriptPath := filepath.Join(tempDir, "script.json")
+	script := []byte(`{
+  "turns": [
+    {"expect_text": "hello", "function_calls": [{"name": "complete", "args": {"message": "hi there"}}]}
+  ]
+}`)
+	require.NoError(t, os.WriteFile(scriptPath, script, 0644))
+
+	configLoader := &mockConfigLoader{
+		LoadMCPConfigFunc: func(path string) (*makasero.MCPConfig, error) {
+			return &makasero.MCPConfig{
+				Provider: &makasero.ProviderConfig{Type: makasero.ProviderScripted, Script: scriptPath},
+			}, nil
+		},
+	}
+
+	sm := &SessionManager{
+		configPath:    "/fake/config.json",
+		configLoader:  configLoader,
+		agentCreator:  &defaultAgentCreator{},
+		sessionLoader: &defaultSessionLoader{},
+	}
+
+	server := createTestServer(t, sm)
+	defer server.Close()
+
+	jsonBody, _ := json.Marshal(CreateSessionRequest{Prompt: "hello agent"})
+	resp, err := http.Post(server.URL+"/api/sessions", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var created CreateSessionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+	var session makasero.Session
+	require.Eventually(t, func() bool {
+		statusResp, err := http.Get(server.URL + "/api/sessions/" + created.SessionID)
+		if err != nil {
+			return false
+		}
+		defer statusResp.Body.Close()
+		if statusResp.StatusCode != http.StatusOK {
+			return false
+		}
+		// 実行中も途中経過が保存されるので、完了するまで待つ
+		return json.NewDecoder(statusResp.Body).Decode(&session) == nil && session.Status == makasero.SessionStatusCompleted
+	}, 5*time.Second, 50*time.Millisecond, "セッションが完了して取得できるべき")
+
+	assert.Equal(t, created.SessionID, session.ID)
+	assert.Equal(t, makasero.ProviderScripted, session.Provider)
+	require.Len(t, session.History, 2, "ユーザープロンプトとモデルの complete 呼び出しが保存されるべき")
+	calls := session.History[1].FunctionCalls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "complete", calls[0].Name)
+}
+
+// TestAnswerQuestion_ScriptedProvider はモデルの質問にセッションが回答待ちになり、
+// POST /api/sessions/{id}/answer の回答を ask_question の結果として続きを実行することを確認する
+func TestAnswerQuestion_ScriptedProvider(t *testing.T) {
+	tempDir := t.TempDir()
+	originalSessionDir := makasero.SessionDir
+	makasero.SessionDir = tempDir
+	t.Cleanup(func() {
+		makasero.SessionDir = originalSessionDir
+	})
+
+	// エージェントは実行ごとに作り直されるので、実行ごとのスクリプトを用意する
+	scripts := []string{
+		`{"turns": [{"function_calls": [{"name": "ask_question", "args": {"question": "which branch?", "options": ["main", "develop"]}}]}]}`,
+		`{"turns": [{
+  "expect_function_responses": [{"name": "ask_question", "is_error": false, "contains": "develop"}],
+  "function_calls": [{"name": "complete", "args": {"message": "merged into develop"}}]
+}]}`,
+	}
+	var scriptPaths []string
+	for i, script := range scripts {
+		path := filepath.Join(tempDir, fmt.Sprintf("script%d.json", i))
+		require.NoError(t, os.WriteFile(path, []byte(script), 0644))
+		scriptPaths = append(scriptPaths, path)
+	}
+
+	var loads atomic.Int32
+	configLoader := &mockConfigLoader{
+		LoadMCPConfigFunc: func(path string) (*makasero.MCPConfig, error) {
+			n := loads.Add(1) - 1
+			return &makasero.MCPConfig{
+				Provider: &makasero.ProviderConfig{Type: makasero.ProviderScripted, Script: scriptPaths[n]},
+			}, nil
+		},
+	}
+
+	sm := &SessionManager{
+		configPath:    "/fake/config.json",
+		configLoader:  configLoader,
+		agentCreator:  &defaultAgentCreator{},
+		sessionLoader: &defaultSessionLoader{},
+	}
+
+	server := createTestServer(t, sm)
+	defer server.Close()
+
+	waitForStatus := func(sessionID, status string) makasero.Session {
+		var session makasero.Session
+		require.Eventually(t, func() bool {
+			statusResp, err := http.Get(server.URL + "/api/sessions/" + sessionID)
+			if err != nil {
+				return false
+			}
+			defer statusResp.Body.Close()
+			return json.NewDecoder(statusResp.Body).Decode(&session) == nil && session.Status == status
+		}, 5*time.Second, 50*time.Millisecond, "セッションが %s になるべき", status)
+		return session
+	}
+
+	jsonBody, _ := json.Marshal(CreateSessionRequest{Prompt: "merge it"})
+	resp, err := http.Post(server.URL+"/api/sessions", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var created CreateSessionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+	session := waitForStatus(created.SessionID, makasero.SessionStatusAwaitingAnswer)
+	require.NotNil(t, session.PendingQuestion)
+	assert.Equal(t, "which branch?", session.PendingQuestion.Question)
+	assert.Equal(t, []string{"main", "develop"}, session.PendingQuestion.Options)
+
+	jsonBody, _ = json.Marshal(AnswerQuestionRequest{Answer: "develop"})
+	answerResp, err := http.Post(server.URL+"/api/sessions/"+created.SessionID+"/answer", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	defer answerResp.Body.Close()
+	require.Equal(t, http.StatusAccepted, answerResp.StatusCode)
+
+	session = waitForStatus(created.SessionID, makasero.SessionStatusCompleted)
+	assert.Nil(t, session.PendingQuestion, "回答後は質問が消えるべき")
+
+	// 質問がなくなったセッションへの回答は受け付けない
+	answerResp, err = http.Post(server.URL+"/api/sessions/"+created.SessionID+"/answer", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	defer answerResp.Body.Close()
+	assert.Equal(t, http.StatusConflict, answerResp.StatusCode)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pankona/makasero"
+)
+
+// 購読者ごとのバッファ。これを超えて溜まったイベントは捨てる
+const streamSubscriberBuffer = 256
+
+// streamHub はセッションごとにイベントを購読者へ配る
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan makasero.Event]struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		subscribers: make(map[string]map[chan makasero.Event]struct{}),
+	}
+}
+
+// subscribe はセッションのイベントを受け取るチャネルと購読解除用の関数を返す
+func (h *streamHub) subscribe(sessionID string) (<-chan makasero.Event, func()) {
+	ch := make(chan makasero.Event, streamSubscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[sessionID] == nil {
+		h.subscribers[sessionID] = make(map[chan makasero.Event]struct{})
+	}
+	h.subscribers[sessionID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[sessionID], ch)
+		if len(h.subscribers[sessionID]) == 0 {
+			delete(h.subscribers, sessionID)
+		}
+	}
+}
+
+// publish は購読者がいなければ何もしない。nil の hub でも呼び出せる
+func (h *streamHub) publish(sessionID string, event makasero.Event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[sessionID] {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Stream subscriber of session %s is too slow, dropping %s event", sessionID, event.Type)
+		}
+	}
+}
+
+// handler はエージェントのイベントをセッションの購読者へ転送する EventHandler を返す
+func (h *streamHub) handler(sessionID string) makasero.EventHandler {
+	return func(event makasero.Event) {
+		h.publish(sessionID, event)
+	}
+}
+
+func handleStreamSession(w http.ResponseWriter, r *http.Request, sm *SessionManager, sessionID string) {
+	if sm.streams == nil {
+		http.Error(w, "Streaming is not available", http.StatusNotImplemented)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := sm.streams.subscribe(sessionID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	// 購読が始まったことをクライアントに知らせる
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to marshal stream event for session %s: %v", sessionID, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
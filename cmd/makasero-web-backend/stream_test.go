@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pankona/makasero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readStreamEvents は SSE のストリームから completed か error が届くまでイベントを読む
+func readStreamEvents(t *testing.T, resp *http.Response) []makasero.Event {
+	t.Helper()
+
+	var events []makasero.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event makasero.Event
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		events = append(events, event)
+		if event.Type == makasero.EventCompleted || event.Type == makasero.EventError {
+			return events
+		}
+	}
+	require.NoError(t, scanner.Err())
+	t.Fatalf("ストリームが completed を受け取る前に終了した: %+v", events)
+	return nil
+}
+
+func TestStreamSession_ForwardsAgentOutput(t *testing.T) {
+	tempDir := t.TempDir()
+	originalSessionDir := makasero.SessionDir
+	makasero.SessionDir = tempDir
+	t.Cleanup(func() {
+		makasero.SessionDir = originalSessionDir
+	})
+
+	sessionID := "stream-session"
+	require.NoError(t, makasero.SaveSession(&makasero.Session{ID: sessionID, CreatedAt: time.Now()}))
+
+	scriptPath := filepath.Join(tempDir, "script.json")
+	script := []byte(`{
+  "turns": [
+    {"text": "streamed answer", "function_calls": [{"name": "complete", "args": {"message": "done"}}]}
+  ]
+}`)
+	require.NoError(t, os.WriteFile(scriptPath, script, 0644))
+
+	sm := &SessionManager{
+		configPath: "/fake/config.json",
+		configLoader: &mockConfigLoader{
+			LoadMCPConfigFunc: func(path string) (*makasero.MCPConfig, error) {
+				return &makasero.MCPConfig{
+					Provider: &makasero.ProviderConfig{Type: makasero.ProviderScripted, Script: scriptPath},
+				}, nil
+			},
+		},
+		agentCreator:  &defaultAgentCreator{},
+		sessionLoader: &defaultSessionLoader{},
+		streams:       newStreamHub(),
+	}
+
+	server := createTestServer(t, sm)
+	defer server.Close()
+
+	streamResp, err := http.Get(server.URL + "/api/sessions/" + sessionID + "/stream")
+	require.NoError(t, err)
+	defer streamResp.Body.Close()
+	require.Equal(t, http.StatusOK, streamResp.StatusCode)
+	assert.Equal(t, "text/event-stream", streamResp.Header.Get("Content-Type"))
+
+	jsonBody, _ := json.Marshal(SendCommandRequest{Command: "answer me"})
+	resp, err := http.Post(server.URL+"/api/sessions/"+sessionID+"/commands", "application/json", bytes.NewBuffer(jsonBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	events := readStreamEvents(t, streamResp)
+	var types []makasero.EventType
+	for _, event := range events {
+		assert.Equal(t, sessionID, event.SessionID)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []makasero.EventType{
+		makasero.EventTurnStarted,
+		makasero.EventTextDelta,
+		makasero.EventText,
+		makasero.EventFunctionCall,
+		makasero.EventCompleted,
+	}, types)
+	assert.Equal(t, "streamed answer", events[1].Text)
+	assert.Equal(t, "done", events[4].Text)
+}
+
+func TestStreamHub_PublishWithoutSubscribers(t *testing.T) {
+	var nilHub *streamHub
+	assert.NotPanics(t, func() {
+		nilHub.publish("any", makasero.Event{Type: makasero.EventCompleted})
+		newStreamHub().publish("any", makasero.Event{Type: makasero.EventCompleted})
+	})
+}
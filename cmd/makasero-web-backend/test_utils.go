@@ -53,7 +53,7 @@ func (m *mockAgent) Close() error {
 	return nil
 }
 
-func (m *mockAgent) ProcessMessage(ctx context.Context, userInput string) error {
+func (m *mockAgent) ProcessMessage(ctx context.Context, userInput string) (*makasero.Result, error) {
 	m.mu.Lock()
 	m.ProcessCalled = true
 	m.ProcessMessageArgs = append(m.ProcessMessageArgs, userInput)
@@ -66,7 +66,14 @@ func (m *mockAgent) ProcessMessage(ctx context.Context, userInput string) error
 	// 結果に関わらずチャネルに通知 (goroutine テスト用)
 	m.ProcessMessageChan <- userInput
 
-	return err
+	if err != nil {
+		return &makasero.Result{Outcome: makasero.OutcomeFailed}, err
+	}
+	return &makasero.Result{Outcome: makasero.OutcomeCompleted}, nil
+}
+
+func (m *mockAgent) Answer(ctx context.Context, answer string) (*makasero.Result, error) {
+	return m.ProcessMessage(ctx, answer)
 }
 
 // --- モック用のインターフェース実装 ---
@@ -121,9 +128,6 @@ func setupTestSessionManager(t *testing.T, configPath string, cl ConfigLoader, a
 	t.Setenv("GEMINI_API_KEY", "test-api-key")
 	apiKey := os.Getenv("GEMINI_API_KEY")
 	modelName := os.Getenv("MODEL_NAME")
-	if modelName == "" {
-		modelName = "gemini-1.5-flash-latest"
-	}
 	if configPath == "" {
 		tempDir := t.TempDir()
 		_, _, configPath = SetupTestEnvironment(t, tempDir)
@@ -202,6 +206,12 @@ func createTestServer(t *testing.T, sm *SessionManager) *httptest.Server {
 			handleGetSessionStatus(w, r, sm, sessionID)
 		} else if len(pathSegments) == 4 && pathSegments[3] == "commands" && r.Method == http.MethodPost {
 			handleSendCommand(w, r, sm, sessionID)
+		} else if len(pathSegments) == 4 && pathSegments[3] == "answer" && r.Method == http.MethodPost {
+			handleAnswerQuestion(w, r, sm, sessionID)
+		} else if len(pathSegments) == 4 && pathSegments[3] == "cancel" && r.Method == http.MethodPost {
+			handleCancelSession(w, r, sm, sessionID)
+		} else if len(pathSegments) == 4 && pathSegments[3] == "stream" && r.Method == http.MethodGet {
+			handleStreamSession(w, r, sm, sessionID)
 		} else {
 			if len(pathSegments) == 3 {
 				http.Error(w, "Method not allowed for /api/sessions/{sessionID}", http.StatusMethodNotAllowed)
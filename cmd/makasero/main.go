@@ -1,34 +1,107 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pankona/makasero"
 	"github.com/pankona/makasero/mlog"
 )
 
 var (
-	debug            = flag.Bool("debug", false, "debug mode")
-	promptFile       = flag.String("f", "", "prompt file")
-	editorPrompt     = flag.Bool("e", false, "エディタを使ってプロンプトを入力")
-	configFilePath   = flag.String("config", "", "path to config file")
-	listSessionsFlag = flag.Bool("ls", false, "利用可能なセッション一覧を表示")
-	sessionID        = flag.String("s", "", "継続するセッションID（存在しないIDを指定すると新規セッションを開始）")
-	showHistory      = flag.String("sh", "", "指定したセッションIDの会話履歴全文を表示")
+	debug             = flag.Bool("debug", false, "debug mode")
+	promptFile        = flag.String("f", "", "prompt file")
+	editorPrompt      = flag.Bool("e", false, "エディタを使ってプロンプトを入力")
+	configFilePath    = flag.String("config", "", "path to config file")
+	listSessionsFlag  = flag.Bool("ls", false, "利用可能なセッション一覧を表示")
+	sessionID         = flag.String("s", "", "継続するセッションID（存在しないIDを指定すると新規セッションを開始）")
+	showHistory       = flag.String("sh", "", "指定したセッションIDの会話履歴全文を表示")
 	listFunctionsFlag = flag.Bool("lf", false, "利用可能な function calling 一覧を表示")
+	recordFile        = flag.String("record", "", "モデルとのやり取りとツールの結果を指定したファイルに記録")
+	replayFile        = flag.String("replay", "", "-record で記録したモデルの応答を API キーなしで再生し、挙動が変わったらエラーにする (関数は実際に実行される)")
+	maxTurns          = flag.Int("max-turns", 0, "1回の実行でモデルに送るリクエスト数の上限 (0 は設定ファイルに従う)")
+	maxToolCalls      = flag.Int("max-tool-calls", 0, "1回の実行で呼び出す関数の数の上限 (0 は設定ファイルに従う)")
+	maxDuration       = flag.Duration("max-duration", 0, "1回の実行の所要時間の上限 (例: 30m, 0 は設定ファイルに従う)")
+	maxTokens         = flag.Int("max-tokens", 0, "1回の実行で消費するトークン数の上限 (0 は設定ファイルに従う)")
+	toolTimeout       = flag.Duration("tool-timeout", 0, "関数呼び出し1回あたりの所要時間の上限 (例: 2m, 0 は設定ファイルに従う)")
+	workspace         = flag.String("workspace", "", "read_file などのファイル操作の関数が扱うディレクトリ (省略時は設定ファイルの workspace、なければカレントディレクトリ)")
+	temperature       = flag.Float64("temperature", -1, "生成時の temperature (負の値は設定ファイルに従う)")
+	topP              = flag.Float64("top-p", -1, "生成時の top-p (負の値は設定ファイルに従う)")
+	topK              = flag.Int("top-k", 0, "生成時の top-k (0 は設定ファイルに従う)")
+	maxOutputTokens   = flag.Int("max-output-tokens", 0, "1回の応答で出力するトークン数の上限 (0 は設定ファイルに従う)")
+	stopSequences     = flag.String("stop", "", "生成を止める文字列 (カンマ区切り)")
+	safetySettings    = flag.String("safety", "", "Gemini の安全性設定 (例: dangerous_content=block_only_high,harassment=block_none)")
+	interactive       = flag.Bool("i", false, "対話モード (REPL) で起動し、1つのセッションで指示を続けて送る")
+	outputSchemaFile  = flag.String("output-schema", "", "実行結果の JSON Schema ファイル。検証済みの結果の JSON だけを標準出力に書き、進行状況は標準エラー出力に表示する")
 )
 
+// 終了コード。エージェントの実行がどう終わったかを呼び出し元が区別できるようにする
+const (
+	exitFailed         = 1
+	exitQuestion       = 3 // モデルが質問して回答を待っている
+	exitBudgetExceeded = 4
+	exitStopped        = 5 // モデルが complete せずに止まった
+	exitInterrupted    = 130
+)
+
+// exitError は終了コードを指定して終了するためのエラー。err が nil なら何も表示しない
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// outcomeExitCode は実行結果を終了コードに対応させる
+func outcomeExitCode(outcome makasero.Outcome) int {
+	switch outcome {
+	case makasero.OutcomeCompleted:
+		return 0
+	case makasero.OutcomeQuestion:
+		return exitQuestion
+	case makasero.OutcomeBudgetExceeded:
+		return exitBudgetExceeded
+	case makasero.OutcomeStopped:
+		return exitStopped
+	case makasero.OutcomeInterrupted:
+		return exitInterrupted
+	}
+	return exitFailed
+}
 
 func main() {
 	if err := run(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		code := exitFailed
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.code
+		}
+		if exitErr == nil || exitErr.err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(code)
 	}
 }
 
@@ -51,7 +124,7 @@ func readPromptFromEditor() (string, error) {
 		return "", fmt.Errorf("failed to create temporary file: %v", err)
 	}
 	defer os.Remove(tmpFile.Name())
-	
+
 	if err := tmpFile.Close(); err != nil {
 		return "", fmt.Errorf("failed to close temporary file %s: %v", tmpFile.Name(), err)
 	}
@@ -74,30 +147,37 @@ func readPromptFromEditor() (string, error) {
 }
 
 // initializeAgent はエージェントの初期化処理を共通化する関数
-func initializeAgent(ctx context.Context) (*makasero.Agent, error) {
+// -replay 指定時は再生に使うプロバイダも返す
+func initializeAgent(ctx context.Context) (*makasero.Agent, *makasero.ReplayProvider, error) {
 	// 設定ファイルの読み込み
 	config, err := makasero.LoadMCPConfig(*configFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load or initialize MCP config: %v", err)
+		return nil, nil, fmt.Errorf("failed to load or initialize MCP config: %v", err)
 	}
 
-	// APIキーの取得
+	// APIキーの取得 (Gemini 以外のプロバイダでは設定ファイルや各プロバイダの環境変数を使う)
 	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("GEMINI_API_KEY environment variable is not set")
-	}
 
 	// エージェントオプションの準備
 	var agentOptions []makasero.AgentOption
 
+	// 生成パラメータの基準は再開するセッションの値、なければ設定ファイルの値
+	baseGeneration := config.Generation
+	// 実行結果の形式が指定されている場合は結果だけを標準出力に書く
+	structuredOutput := *outputSchemaFile != ""
+
 	// セッションIDが指定されている場合
 	if *sessionID != "" {
 		if makasero.SessionExists(*sessionID) {
 			// 既存のセッションを読み込む
 			session, err := makasero.LoadSession(*sessionID)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
+			if session.Generation != nil {
+				baseGeneration = session.Generation
+			}
+			structuredOutput = structuredOutput || session.OutputSchema != nil
 			agentOptions = append(agentOptions, makasero.WithSession(session))
 		} else {
 			agentOptions = append(agentOptions, makasero.WithCustomSessionID(*sessionID))
@@ -111,15 +191,231 @@ func initializeAgent(ctx context.Context) (*makasero.Agent, error) {
 		agentOptions = append(agentOptions, makasero.WithModelName(modelName))
 	}
 
+	// 予算の指定がある場合は設定ファイルの値を上書きする
+	if budget, ok := budgetFromFlags(config.Budget); ok {
+		agentOptions = append(agentOptions, makasero.WithBudget(budget))
+	}
+
+	if *toolTimeout > 0 {
+		agentOptions = append(agentOptions, makasero.WithToolTimeout(*toolTimeout))
+	}
+
+	if *workspace != "" {
+		agentOptions = append(agentOptions, makasero.WithWorkspace(*workspace))
+	}
+
+	// 生成パラメータの指定がある場合は基準の値に重ねる
+	generation, ok, err := generationFromFlags(baseGeneration)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		agentOptions = append(agentOptions, makasero.WithGenerationConfig(generation))
+	}
+
+	if *outputSchemaFile != "" {
+		schema, err := makasero.LoadOutputSchema(*outputSchemaFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		agentOptions = append(agentOptions, makasero.WithOutputSchema(schema))
+	}
+
+	// エージェントの進行状況を表示する
+	printer := &eventPrinter{w: os.Stdout}
+	if structuredOutput {
+		printer.w = os.Stderr
+	}
+	agentOptions = append(agentOptions, makasero.WithEventHandler(printer.handle))
+
+	// 記録・再生の指定がある場合
+	var replay *makasero.ReplayProvider
+	if *recordFile != "" && *replayFile != "" {
+		return nil, nil, fmt.Errorf("please specify only one of -record or -replay")
+	}
+	if *recordFile != "" {
+		agentOptions = append(agentOptions, makasero.WithProviderWrapper(func(p makasero.Provider) makasero.Provider {
+			return makasero.NewRecordingProvider(p, *recordFile)
+		}))
+	}
+	if *replayFile != "" {
+		cassette, err := makasero.LoadCassette(*replayFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		replay = makasero.NewReplayProvider(cassette)
+		agentOptions = append(agentOptions, makasero.WithProvider(replay))
+	}
+
 	// エージェントの初期化
 	agent, err := makasero.NewAgent(ctx, apiKey, config, agentOptions...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize agent: %v", err)
+		return nil, nil, fmt.Errorf("failed to initialize agent: %v", err)
+	}
+
+	return agent, replay, nil
+}
+
+// budgetFromFlags は設定ファイルの予算にコマンドラインの指定を重ねる。
+// どのフラグも指定されていなければ false を返す
+func budgetFromFlags(base *makasero.Budget) (makasero.Budget, bool) {
+	var budget makasero.Budget
+	if base != nil {
+		budget = *base
+	}
+
+	overridden := false
+	if *maxTurns > 0 {
+		budget.MaxTurns = *maxTurns
+		overridden = true
+	}
+	if *maxToolCalls > 0 {
+		budget.MaxToolCalls = *maxToolCalls
+		overridden = true
+	}
+	if *maxDuration > 0 {
+		budget.MaxDuration = makasero.Duration(*maxDuration)
+		overridden = true
+	}
+	if *maxTokens > 0 {
+		budget.MaxTotalTokens = *maxTokens
+		overridden = true
+	}
+	return budget, overridden
+}
+
+// generationFromFlags は生成パラメータの基準の値にコマンドラインの指定を重ねる。
+// どのフラグも指定されていなければ false を返す
+func generationFromFlags(base *makasero.GenerationConfig) (makasero.GenerationConfig, bool, error) {
+	var generation makasero.GenerationConfig
+	if base != nil {
+		generation = *base
+		generation.SafetySettings = maps.Clone(base.SafetySettings)
+	}
+
+	overridden := false
+	if *temperature >= 0 {
+		t := float32(*temperature)
+		generation.Temperature = &t
+		overridden = true
+	}
+	if *topP >= 0 {
+		p := float32(*topP)
+		generation.TopP = &p
+		overridden = true
 	}
+	if *topK > 0 {
+		generation.TopK = topK
+		overridden = true
+	}
+	if *maxOutputTokens > 0 {
+		generation.MaxOutputTokens = *maxOutputTokens
+		overridden = true
+	}
+	if *stopSequences != "" {
+		generation.StopSequences = strings.Split(*stopSequences, ",")
+		overridden = true
+	}
+	if *safetySettings != "" {
+		if generation.SafetySettings == nil {
+			generation.SafetySettings = make(map[string]string)
+		}
+		for _, setting := range strings.Split(*safetySettings, ",") {
+			category, threshold, found := strings.Cut(setting, "=")
+			if !found {
+				return generation, false, fmt.Errorf("invalid -safety setting %q (expected category=threshold)", setting)
+			}
+			generation.SafetySettings[strings.TrimSpace(category)] = strings.TrimSpace(threshold)
+		}
+		overridden = true
+	}
+	return generation, overridden, nil
+}
+
+// eventPrinter はエージェントのイベントを標準出力に表示する。
+// モデルの出力は届いた順にそのまま表示する
+type eventPrinter struct {
+	w         io.Writer
+	streaming bool
+}
+
+func (p *eventPrinter) handle(event makasero.Event) {
+	switch event.Type {
+	case makasero.EventTextDelta:
+		if !p.streaming {
+			fmt.Fprintln(p.w, "🤖 Response from AI:")
+			p.streaming = true
+		}
+		fmt.Fprint(p.w, event.Text)
+	case makasero.EventText:
+		if p.streaming {
+			fmt.Fprintln(p.w)
+			p.streaming = false
+		}
+	case makasero.EventFunctionCall:
+		fmt.Fprintf(p.w, "🔧 AI uses function calling: %s\n", event.Function)
+	case makasero.EventFunctionResult:
+		if event.IsError {
+			fmt.Fprintf(p.w, "⚠️ %s returned an error: %v\n", event.Function, event.Result["output"])
+		}
+	case makasero.EventRetry:
+		if p.streaming {
+			fmt.Fprintln(p.w)
+			p.streaming = false
+		}
+		fmt.Fprintf(p.w, "⏳ Retrying in %s (attempt %d): %s\n", time.Duration(event.Delay).Round(100*time.Millisecond), event.Attempt, event.Error)
+	case makasero.EventQuestionAsked:
+		printQuestion(p.w, event.Text, event.Options)
+	case makasero.EventCompleted:
+		if event.Text != "" {
+			fmt.Fprintf(p.w, "🤖 Task completed!:\n%s\n", strings.TrimSpace(event.Text))
+		}
+		fmt.Fprintf(p.w, "Session ID: %s\n", event.SessionID)
+	}
+}
+
+// printQuestion はモデルの質問と、番号で選べる選択肢を表示する
+func printQuestion(w io.Writer, question string, options []string) {
+	fmt.Fprintf(w, "🤖 Question:\n%s\n", strings.TrimSpace(question))
+	if len(options) > 0 {
+		fmt.Fprintf(w, "🤖 Options:\n")
+		for i, option := range options {
+			fmt.Fprintf(w, "  %d. %s\n", i+1, option)
+		}
+	}
+}
+
+// readAnswer は端末から質問への回答を読む。選択肢の番号を入力するとその選択肢を回答にする
+func readAnswer(r *bufio.Reader, options []string) (string, error) {
+	for {
+		if len(options) > 0 {
+			fmt.Fprintf(os.Stderr, "回答を入力してください (1-%d で選択肢を選択): ", len(options))
+		} else {
+			fmt.Fprintf(os.Stderr, "回答を入力してください: ")
+		}
+		line, err := r.ReadString('\n')
+		if answer := strings.TrimSpace(line); answer != "" {
+			return chooseOption(answer, options), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
 
-	return agent, nil
+// chooseOption は回答が選択肢の番号ならその選択肢を返す
+func chooseOption(answer string, options []string) string {
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+		return options[n-1]
+	}
+	return answer
 }
 
+// isTerminal は f が端末かどうかを返す
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
 func run() error {
 	// コマンドライン引数の処理
@@ -141,8 +437,22 @@ func run() error {
 		ctx = mlog.ContextWithDebug(ctx)
 	}
 
+	// Ctrl-C で実行中のモデル呼び出しや関数を中断する。中断してもそこまでのセッションは保存される
+	// 対話モードでは Ctrl-C は実行中のターンだけを中断する (runTurn)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if *interactive {
+		signals = []os.Signal{syscall.SIGTERM}
+	}
+	ctx, stop := signal.NotifyContext(ctx, signals...)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// 2回目の Ctrl-C ではすぐに終了できるようにする
+		stop()
+	}()
+
 	// エージェントの初期化
-	agent, err := initializeAgent(ctx)
+	agent, replay, err := initializeAgent(ctx)
 	if err != nil {
 		return err
 	}
@@ -157,7 +467,11 @@ func run() error {
 	// プロンプトの取得
 	args := flag.Args()
 	var userInput string
-	
+	resume := false
+	// 回答待ちの質問があるセッションでは、プロンプトを質問への回答として送る
+	pending := agent.GetSession().PendingQuestion
+	stdin := bufio.NewReader(os.Stdin)
+
 	// オプションの競合チェック
 	optionCount := 0
 	if *editorPrompt {
@@ -169,11 +483,11 @@ func run() error {
 	if len(args) > 0 {
 		optionCount++
 	}
-	
+
 	if optionCount > 1 {
 		return fmt.Errorf("please specify only one of: command line arguments, -f option, or -e option")
 	}
-	
+
 	if *editorPrompt {
 		// エディタからプロンプトを読み込む
 		prompt, err := readPromptFromEditor()
@@ -191,6 +505,20 @@ func run() error {
 	} else if len(args) > 0 {
 		// コマンドライン引数からプロンプトを取得
 		userInput = strings.Join(args, " ")
+	} else if *interactive {
+		// 対話モードではプロンプトなしで始められる
+	} else if pending != nil && isTerminal(os.Stdin) {
+		// プロンプトがなければ質問を表示して端末から回答を受け付ける
+		printQuestion(os.Stderr, pending.Question, pending.Options)
+		answer, err := readAnswer(stdin, pending.Options)
+		if err != nil {
+			return fmt.Errorf("failed to read the answer: %v", err)
+		}
+		userInput = answer
+	} else if *sessionID != "" && agent.GetSession().Resumable() {
+		// 途中で止まったセッションはプロンプトなしで続きから再開する
+		fmt.Fprintf(os.Stderr, "セッション %s を再開します (前回の状態: %s)\n", *sessionID, agent.GetSession().Status)
+		resume = true
 	} else {
 		// パラメータが指定されていない場合はヘルプを表示
 		flag.Usage()
@@ -205,10 +533,53 @@ func run() error {
 		}(reader)
 	}
 
+	if *interactive {
+		return runREPL(ctx, agent, userInput)
+	}
+
 	// メッセージの処理
-	if err := agent.ProcessMessage(ctx, userInput); err != nil {
+	process := func(ctx context.Context) (*makasero.Result, error) { return agent.ProcessMessage(ctx, userInput) }
+	switch {
+	case resume:
+		process = agent.Resume
+	case pending != nil:
+		process = func(ctx context.Context) (*makasero.Result, error) { return agent.Answer(ctx, userInput) }
+	}
+	result, err := process(ctx)
+	// 端末で実行している場合は、質問されたら回答を受け付けて続ける
+	for err == nil && result.Outcome == makasero.OutcomeQuestion && isTerminal(os.Stdin) {
+		answer, readErr := readAnswer(stdin, result.Options)
+		if readErr != nil {
+			break
+		}
+		result, err = agent.Answer(ctx, answer)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "中断しました。-s %s で再開できます\n", agent.GetSession().ID)
+		}
+		if result != nil {
+			return &exitError{code: outcomeExitCode(result.Outcome), err: err}
+		}
 		return err
 	}
 
+	if replay != nil {
+		if n := replay.Remaining(); n > 0 {
+			return fmt.Errorf("replay diverged: the agent finished with %d recorded interactions left", n)
+		}
+	}
+
+	if result.Outcome != makasero.OutcomeCompleted {
+		// 質問の内容はイベントとして表示済み
+		return &exitError{code: outcomeExitCode(result.Outcome)}
+	}
+
+	if agent.GetSession().OutputSchema != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result.Output)
+	}
+
 	return nil
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chzyer/readline"
+	"github.com/pankona/makasero"
+)
+
+const replHelp = `/tools           利用可能な関数の一覧を表示
+/history         セッションの会話履歴を表示
+/model           セッションのプロバイダとモデルを表示
+/save [file]     セッションを保存する。ファイルを指定するとセッションの JSON を書き出す
+/fork            現在の履歴を複製した新しいセッションで対話を続ける
+/help            このヘルプを表示
+/exit            終了する (Ctrl-D でも終了)`
+
+// runREPL は1つのセッションでユーザーとの対話を繰り返す。
+// Agent と MCP サーバーとの接続はターンをまたいで使い回す
+func runREPL(ctx context.Context, agent *makasero.Agent, firstInput string) error {
+	historyFile := ""
+	if dir, err := makasero.GetConfigDir(); err == nil {
+		historyFile = filepath.Join(dir, "repl_history")
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          "makasero> ",
+		HistoryFile:     historyFile,
+		AutoComplete:    replCompleter(),
+		InterruptPrompt: "^C",
+		EOFPrompt:       "/exit",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start the interactive mode: %v", err)
+	}
+	defer rl.Close()
+
+	fmt.Fprintf(os.Stderr, "セッション %s で対話を開始します。/help でコマンドの一覧を表示します\n", agent.GetSession().ID)
+
+	if q := agent.GetSession().PendingQuestion; q != nil && firstInput == "" {
+		printQuestion(os.Stdout, q.Question, q.Options)
+	}
+	if firstInput != "" {
+		runTurn(ctx, agent, firstInput)
+	}
+
+	for {
+		if agent.GetSession().PendingQuestion != nil {
+			// 質問への回答は番号で選択肢を選べる
+			rl.SetPrompt("answer> ")
+		} else {
+			rl.SetPrompt("makasero> ")
+		}
+
+		line, err := rl.Readline()
+		if errors.Is(err, readline.ErrInterrupt) {
+			// 入力中の Ctrl-C は行を消すだけ
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "/"):
+			quit, err := runCommand(agent, line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			}
+			if quit {
+				return nil
+			}
+		default:
+			runTurn(ctx, agent, line)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// runTurn は input をモデルに送り、タスクが終わるか質問されるまで処理する。
+// Ctrl-C はこのターンだけを中断し、対話は続ける
+func runTurn(ctx context.Context, agent *makasero.Agent, input string) {
+	turnCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	var err error
+	if q := agent.GetSession().PendingQuestion; q != nil {
+		_, err = agent.Answer(turnCtx, chooseOption(input, q.Options))
+	} else {
+		_, err = agent.ProcessMessage(turnCtx, input)
+	}
+	if err == nil {
+		return
+	}
+	if turnCtx.Err() != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "中断しました。続けて指示を入力できます")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+}
+
+// runCommand はスラッシュコマンドを実行する。終了する場合は true を返す
+func runCommand(agent *makasero.Agent, line string) (bool, error) {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	session := agent.GetSession()
+
+	switch name {
+	case "/exit", "/quit":
+		return true, nil
+	case "/help":
+		fmt.Println(replHelp)
+	case "/tools":
+		functions := agent.GetAvailableFunctions()
+		slices.Sort(functions)
+		for _, name := range functions {
+			fmt.Printf("  %s\n", name)
+		}
+	case "/history":
+		return false, makasero.PrintSessionHistory(session.ID)
+	case "/model":
+		fmt.Printf("プロバイダ: %s\nモデル: %s\n", session.Provider, session.Model)
+		if session.TotalUsage != nil {
+			fmt.Printf("使用量: %s\n", session.TotalUsage)
+		}
+	case "/save":
+		if arg == "" {
+			if err := agent.SaveSession(session); err != nil {
+				return false, err
+			}
+			fmt.Printf("セッション %s を保存しました\n", session.ID)
+			return false, nil
+		}
+		data, err := json.MarshalIndent(session, "", "  ")
+		if err != nil {
+			return false, fmt.Errorf("failed to marshal session: %v", err)
+		}
+		if err := os.WriteFile(arg, data, 0644); err != nil {
+			return false, fmt.Errorf("failed to write session: %v", err)
+		}
+		fmt.Printf("セッション %s を %s に書き出しました\n", session.ID, arg)
+	case "/fork":
+		fork, err := agent.Fork()
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("セッション %s を複製しました。以降は新しいセッション %s で続けます\n", fork.ForkedFrom, fork.ID)
+	default:
+		return false, fmt.Errorf("unknown command %s (/help でコマンドの一覧を表示します)", name)
+	}
+	return false, nil
+}
+
+func replCompleter() *readline.PrefixCompleter {
+	return readline.NewPrefixCompleter(
+		readline.PcItem("/tools"),
+		readline.PcItem("/history"),
+		readline.PcItem("/model"),
+		readline.PcItem("/save"),
+		readline.PcItem("/fork"),
+		readline.PcItem("/help"),
+		readline.PcItem("/exit"),
+	)
+}
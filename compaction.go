@@ -0,0 +1,199 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pankona/makasero/mlog"
+)
+
+// Compaction keeps long sessions within the model's context window. When a
+// request reaches Threshold input tokens, the older messages are summarized by
+// the model and sent as a single message from then on. Session.History keeps
+// every message, so the saved session remains a complete record.
+type Compaction struct {
+	Threshold       int `json:"threshold"`                 // input tokens that trigger compaction; 0 disables it
+	KeepMessages    int `json:"keepMessages,omitempty"`    // recent messages always sent verbatim
+	MaxResponseSize int `json:"maxResponseSize,omitempty"` // bytes of older function results sent as is
+}
+
+const (
+	defaultKeepMessages    = 10
+	defaultMaxResponseSize = 4000
+)
+
+// WithCompaction enables history compaction. It overrides the compaction section of the config.
+func WithCompaction(c Compaction) AgentOption {
+	return func(a *Agent) {
+		a.compaction = &c
+	}
+}
+
+func (c *Compaction) withDefaults() Compaction {
+	var compaction Compaction
+	if c != nil {
+		compaction = *c
+	}
+	if compaction.KeepMessages <= 0 {
+		compaction.KeepMessages = defaultKeepMessages
+	}
+	if compaction.MaxResponseSize <= 0 {
+		compaction.MaxResponseSize = defaultMaxResponseSize
+	}
+	return compaction
+}
+
+const summaryInstruction = "The conversation is getting long. Summarize everything above for yourself so that you can continue the task " +
+	"with the summary in place of the conversation: the user's requests, decisions made, files and functions involved, " +
+	"results of function calls that are still relevant, and what remains to be done. Reply with the summary only, without calling functions."
+
+// requestMessages returns the messages sent to the model: the summary of the
+// compacted messages followed by the rest of the history. Large function
+// results outside the most recent messages are shortened.
+func (a *Agent) requestMessages() []*Message {
+	history := a.session.History
+	var messages []*Message
+	if a.session.Summary != "" && a.session.SummarizedUntil <= len(history) {
+		messages = append(messages, summaryMessage(a.session.Summary))
+		history = history[a.session.SummarizedUntil:]
+	}
+	messages = append(messages, history...)
+
+	if a.compaction == nil || a.compaction.Threshold <= 0 {
+		return messages
+	}
+	compaction := a.compaction.withDefaults()
+	return trimFunctionResponses(messages, len(messages)-compaction.KeepMessages, compaction.MaxResponseSize)
+}
+
+func summaryMessage(summary string) *Message {
+	return NewUserMessage(Text("Summary of the earlier conversation:\n" + summary))
+}
+
+// trimFunctionResponses replaces the results of the first n messages that are
+// larger than maxSize bytes. The messages are copied, not modified.
+func trimFunctionResponses(messages []*Message, n, maxSize int) []*Message {
+	trimmed := make([]*Message, len(messages))
+	for i, msg := range messages {
+		trimmed[i] = msg
+		if i >= n {
+			continue
+		}
+		for j, part := range msg.Parts {
+			resp, ok := part.(FunctionResponse)
+			if !ok {
+				continue
+			}
+			size := len(mustMarshalIndent(resp.Response))
+			if size <= maxSize {
+				continue
+			}
+			if trimmed[i] == msg {
+				trimmed[i] = &Message{Role: msg.Role, Parts: append([]Part(nil), msg.Parts...)}
+			}
+			isError, _ := resp.Response["is_error"].(bool)
+			resp.Response = map[string]any{
+				"is_error": isError,
+				"output":   fmt.Sprintf("(%d bytes of output omitted to save context)", size),
+			}
+			trimmed[i].Parts[j] = resp
+		}
+	}
+	return trimmed
+}
+
+// estimateTokens roughly counts the tokens of messages, for when the
+// provider has not reported the usage yet.
+func estimateTokens(messages []*Message) int {
+	data, err := json.Marshal(serializeMessages(messages))
+	if err != nil {
+		return 0
+	}
+	return len(data) / 4
+}
+
+// maybeCompact summarizes older messages when the last request reached the
+// compaction threshold. Failures are logged and the history is sent as is.
+func (a *Agent) maybeCompact(ctx context.Context) {
+	if a.compaction == nil || a.compaction.Threshold <= 0 {
+		return
+	}
+	compaction := a.compaction.withDefaults()
+
+	tokens := a.lastInputTokens
+	if tokens == 0 {
+		tokens = estimateTokens(a.requestMessages())
+	}
+	if tokens < compaction.Threshold {
+		return
+	}
+
+	if err := a.compact(ctx, compaction); err != nil {
+		mlog.Warnf(ctx, "Failed to compact the history: %v", err)
+		return
+	}
+	a.lastInputTokens = 0
+}
+
+// compact summarizes the history up to the cut point chosen by compactionCut.
+func (a *Agent) compact(ctx context.Context, compaction Compaction) error {
+	history := a.session.History
+	cut := compactionCut(history, a.session.SummarizedUntil, len(history)-compaction.KeepMessages)
+	if cut <= 0 {
+		return fmt.Errorf("no older messages to summarize")
+	}
+
+	var messages []*Message
+	if a.session.Summary != "" {
+		messages = append(messages, summaryMessage(a.session.Summary))
+	}
+	messages = append(messages, history[a.session.SummarizedUntil:cut]...)
+	messages = trimFunctionResponses(messages, len(messages), compaction.MaxResponseSize)
+	// history[cut-1] はユーザーのターンなので、指示はそこに加える
+	last := messages[len(messages)-1]
+	messages[len(messages)-1] = &Message{Role: last.Role, Parts: append(append([]Part(nil), last.Parts...), Text(summaryInstruction))}
+
+	mlog.Infof(ctx, "Compacting %d messages of session %s", cut-a.session.SummarizedUntil, a.session.ID)
+	resp, err := a.provider.Generate(ctx, &GenerateRequest{
+		SystemInstruction: a.systemPrompt,
+		Tools:             a.functionDeclarations(),
+		Messages:          messages,
+		Config:            a.generation,
+	})
+	if err != nil {
+		return err
+	}
+	a.recordUsage(resp)
+
+	var texts []string
+	if resp.Message != nil {
+		for _, part := range resp.Message.Parts {
+			if text, ok := part.(Text); ok && strings.TrimSpace(string(text)) != "" {
+				texts = append(texts, strings.TrimSpace(string(text)))
+			}
+		}
+	}
+	if len(texts) == 0 {
+		return fmt.Errorf("the model returned no summary")
+	}
+
+	a.session.Summary = strings.Join(texts, "\n")
+	a.session.SummarizedUntil = cut
+	a.checkpoint(ctx)
+	return nil
+}
+
+// compactionCut returns the index of the first message kept after the summary.
+// It is a model turn at or before limit, so that the summary (a user turn) is
+// followed by the model and no function result is separated from its call.
+// It returns 0 when there is nothing to summarize after from.
+func compactionCut(history []*Message, from, limit int) int {
+	for i := min(limit, len(history)-1); i > from; i-- {
+		if history[i].Role == RoleModel && history[i-1].Role == RoleUser {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package makasero
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestProcessMessageCompactsHistory(t *testing.T) {
+	big := strings.Repeat("x", 5000)
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "echo", Args: map[string]any{"text": big}}}},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "echo", Args: map[string]any{"text": "small"}}}, Usage: &Usage{InputTokens: 6000}},
+		// 閾値を超えたので次のリクエストの前に要約する
+		{ExpectText: "Summarize everything above", Text: "the user asked to echo twice"},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}}},
+	}}
+	agent, provider := newScriptedAgent(t, script, WithCompaction(Compaction{Threshold: 5000, KeepMessages: 2, MaxResponseSize: 100}))
+	agent.functions["echo"] = FunctionDefinition{
+		Declaration: &FunctionDeclaration{Name: "echo"},
+		Handler: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			return map[string]any{"is_error": false, "output": args["text"]}, nil
+		},
+	}
+
+	if _, err := agent.ProcessMessage(context.Background(), "echo twice"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	requests := provider.Requests()
+	if len(requests) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(requests))
+	}
+	summarize := requests[2].Messages
+	if output := summarize[2].Parts[0].(FunctionResponse).Response["output"].(string); !strings.Contains(output, "omitted") {
+		t.Errorf("expected the large result to be omitted from the summary request, got %d bytes", len(output))
+	}
+
+	// summary, model call of turn 2, its result
+	last := requests[3].Messages
+	if len(last) != 3 {
+		t.Fatalf("expected the summary and 2 recent messages, got %d messages", len(last))
+	}
+	if text, _ := last[0].Parts[0].(Text); !strings.Contains(string(text), "the user asked to echo twice") {
+		t.Errorf("expected the summary first, got %+v", last[0])
+	}
+	if last[1].Role != RoleModel {
+		t.Errorf("expected the summary to be followed by a model turn, got %s", last[1].Role)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.SummarizedUntil != 3 || saved.Summary != "the user asked to echo twice" {
+		t.Errorf("expected the summary of 3 messages to be saved, got %d: %q", saved.SummarizedUntil, saved.Summary)
+	}
+	// 元の履歴はすべて残す
+	if len(saved.History) != 6 {
+		t.Errorf("expected the full history of 6 messages, got %d", len(saved.History))
+	}
+	if output := saved.History[2].Parts[0].(FunctionResponse).Response["output"]; output != big {
+		t.Error("expected the saved history to keep the full function result")
+	}
+}
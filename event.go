@@ -0,0 +1,81 @@
+package makasero
+
+import "time"
+
+type EventType string
+
+const (
+	// EventTurnStarted is emitted before each request to the model.
+	EventTurnStarted EventType = "turn_started"
+	// EventTextDelta carries a chunk of the model's text as it is generated.
+	EventTextDelta EventType = "text_delta"
+	// EventText carries the whole text of a model turn.
+	EventText EventType = "text"
+	// EventFunctionCall is emitted before a function requested by the model runs.
+	EventFunctionCall EventType = "function_call"
+	// EventFunctionResult carries the result sent back to the model.
+	EventFunctionResult EventType = "function_result"
+	// EventRetry is emitted when a request to the model failed with a transient
+	// error and will be sent again. The text deltas emitted since the last
+	// EventTurnStarted or EventRetry belong to the failed request; consumers
+	// that accumulate them must discard them, as the retried request streams
+	// its text from the beginning.
+	EventRetry EventType = "retry"
+	// EventQuestionAsked is emitted when the model asks the user a question.
+	EventQuestionAsked EventType = "question_asked"
+	// EventCompleted is emitted when ProcessMessage finishes successfully.
+	EventCompleted EventType = "completed"
+	// EventError is emitted when ProcessMessage fails.
+	EventError EventType = "error"
+)
+
+// Event describes the agent's progress. Only the fields relevant to Type are set.
+type Event struct {
+	Type      EventType `json:"type"`
+	SessionID string    `json:"session_id"`
+	Time      time.Time `json:"time"`
+	// Turn counts the requests sent to the model by the agent, starting at 1.
+	Turn int `json:"turn,omitempty"`
+
+	// Text is the model's text, the 'complete' message or the question.
+	Text    string   `json:"text,omitempty"`
+	Options []string `json:"options,omitempty"`
+	// Output is the structured result of the run (EventCompleted, see WithOutputSchema).
+	Output map[string]any `json:"output,omitempty"`
+
+	Function string         `json:"function,omitempty"`
+	CallID   string         `json:"call_id,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+	Result   map[string]any `json:"result,omitempty"`
+	IsError  bool           `json:"is_error,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// Attempt is the number of the upcoming request and Delay the wait before it (EventRetry).
+	Attempt int      `json:"attempt,omitempty"`
+	Delay   Duration `json:"delay,omitempty"`
+}
+
+// EventHandler is called synchronously from the goroutine running the agent.
+type EventHandler func(Event)
+
+// WithEventHandler subscribes h to the agent's events. It may be given more than once.
+func WithEventHandler(h EventHandler) AgentOption {
+	return func(a *Agent) {
+		a.eventHandlers = append(a.eventHandlers, h)
+	}
+}
+
+func (a *Agent) emit(event Event) {
+	if len(a.eventHandlers) == 0 {
+		return
+	}
+	event.SessionID = a.session.ID
+	event.Time = time.Now()
+	if event.Turn == 0 {
+		event.Turn = a.turn
+	}
+	for _, h := range a.eventHandlers {
+		h(event)
+	}
+}
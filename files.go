@@ -0,0 +1,819 @@
+package makasero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxReadLines is how many lines read_file returns when no range is given.
+	maxReadLines = 2000
+	// maxListEntries is how many entries list_dir returns.
+	maxListEntries = 1000
+)
+
+// fileFunctions returns read_file, write_file, list_dir and apply_patch.
+// Paths are relative to the workspace root, and the functions can not reach
+// outside it, even through symbolic links.
+func fileFunctions(root string) map[string]FunctionDefinition {
+	return map[string]FunctionDefinition{
+		"read_file": {
+			Declaration: &FunctionDeclaration{
+				Name:        "read_file",
+				Description: fmt.Sprintf("ワークスペース内のファイルを読みます。範囲を指定しない場合は先頭から %d 行までを返します。", maxReadLines),
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"path": {
+							Type:        TypeString,
+							Description: "読むファイルのパス (ワークスペースからの相対パス)",
+						},
+						"start_line": {
+							Type:        TypeInteger,
+							Description: "読み始める行 (1 始まり)",
+						},
+						"end_line": {
+							Type:        TypeInteger,
+							Description: "読み終える行 (この行を含む)",
+						},
+					},
+					Required: []string{"path"},
+				},
+			},
+			Handler:    inWorkspace(root, readFile),
+			Concurrent: true,
+		},
+		"write_file": {
+			Declaration: &FunctionDeclaration{
+				Name:        "write_file",
+				Description: "ワークスペース内のファイルに内容全体を書き込みます。ファイルやディレクトリがなければ作成します。",
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"path": {
+							Type:        TypeString,
+							Description: "書き込むファイルのパス (ワークスペースからの相対パス)",
+						},
+						"content": {
+							Type:        TypeString,
+							Description: "ファイルの内容",
+						},
+					},
+					Required: []string{"path", "content"},
+				},
+			},
+			Handler: inWorkspace(root, writeFile),
+		},
+		"list_dir": {
+			Declaration: &FunctionDeclaration{
+				Name:        "list_dir",
+				Description: fmt.Sprintf("ワークスペース内のディレクトリの内容を一覧します。最大 %d 件まで返します。", maxListEntries),
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"path": {
+							Type:        TypeString,
+							Description: "一覧するディレクトリのパス (省略時はワークスペースのルート)",
+						},
+						"pattern": {
+							Type:        TypeString,
+							Description: "絞り込むグロブパターン (例: *.go)。/ を含む場合は path からの相対パスと照合します",
+						},
+						"recursive": {
+							Type:        TypeBoolean,
+							Description: "サブディレクトリも一覧するかどうか (.git は除きます)",
+						},
+					},
+				},
+			},
+			Handler:    inWorkspace(root, listDir),
+			Concurrent: true,
+		},
+		"apply_patch": {
+			Declaration: &FunctionDeclaration{
+				Name: "apply_patch",
+				Description: "ワークスペース内のファイルを編集します。unified diff 形式の patch か、path と edits (検索と置換) のどちらかを指定します。" +
+					"適用できない箇所が1つでもあればどのファイルも変更せず、衝突した箇所を返します。",
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"patch": {
+							Type:        TypeString,
+							Description: "unified diff 形式のパッチ。複数ファイルを含められますが、1つのファイルの差分は1か所にまとめます。/dev/null からの差分はファイルの作成、/dev/null への差分は削除になります",
+						},
+						"path": {
+							Type:        TypeString,
+							Description: "edits を適用するファイルのパス",
+						},
+						"edits": {
+							Type:        TypeArray,
+							Description: "順に適用する置換。search はファイル中にちょうど1回現れる必要があります",
+							Items: &Schema{
+								Type: TypeObject,
+								Properties: map[string]*Schema{
+									"search": {
+										Type:        TypeString,
+										Description: "置き換える文字列",
+									},
+									"replace": {
+										Type:        TypeString,
+										Description: "置き換え後の文字列",
+									},
+								},
+								Required: []string{"search", "replace"},
+							},
+						},
+					},
+				},
+			},
+			Handler: inWorkspace(root, applyPatch),
+		},
+	}
+}
+
+// workspaceDir returns the absolute path of the workspace directory, the
+// current directory if dir is empty.
+func workspaceDir(dir string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the workspace %s: %v", dir, err)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the workspace: %v", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("workspace %s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// inWorkspace opens root for each call, so that the handler can only access
+// the files under it.
+func inWorkspace(root string, handler func(ctx context.Context, r *os.Root, args map[string]any) map[string]any) FunctionHandler {
+	return func(ctx context.Context, args map[string]any) (map[string]any, error) {
+		r, err := os.OpenRoot(root)
+		if err != nil {
+			return toolError("failed to open the workspace: %v", err), nil
+		}
+		defer r.Close()
+		return handler(ctx, r, args), nil
+	}
+}
+
+func toolError(format string, args ...any) map[string]any {
+	return map[string]any{
+		"is_error": true,
+		"output":   fmt.Sprintf(format, args...),
+	}
+}
+
+// workspacePath converts a path given by the model to a slash-separated path
+// relative to the root. Absolute paths are accepted when they are inside it.
+func workspacePath(r *os.Root, name string) (string, error) {
+	rel := name
+	if filepath.IsAbs(name) {
+		abs, err := filepath.Abs(r.Name())
+		if err != nil {
+			return "", err
+		}
+		if rel, err = filepath.Rel(abs, name); err != nil {
+			return "", fmt.Errorf("%s is outside the workspace", name)
+		}
+	}
+	rel = path.Clean(filepath.ToSlash(rel))
+	if !fs.ValidPath(rel) {
+		return "", fmt.Errorf("%s is outside the workspace", name)
+	}
+	return rel, nil
+}
+
+// workspaceSubdir resolves dir, the argument called name, to a directory of the
+// workspace for the functions that run commands. Like the file functions, it
+// can not point outside the workspace, even through symbolic links. An empty
+// dir is the workspace.
+func workspaceSubdir(workspace, name, dir string) (string, error) {
+	r, err := os.OpenRoot(workspace)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the workspace: %v", err)
+	}
+	defer r.Close()
+
+	rel, err := workspacePath(r, dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := r.Stat(rel)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", name, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s %s is not a directory", name, rel)
+	}
+	return filepath.Join(workspace, filepath.FromSlash(rel)), nil
+}
+
+func readFile(ctx context.Context, r *os.Root, args map[string]any) map[string]any {
+	name, ok := args["path"].(string)
+	if !ok || name == "" {
+		return toolError("path is required")
+	}
+	name, err := workspacePath(r, name)
+	if err != nil {
+		return toolError("%v", err)
+	}
+
+	data, err := fs.ReadFile(r.FS(), name)
+	if err != nil {
+		return toolError("failed to read %s: %v", name, err)
+	}
+	if isBinary(data) {
+		return toolError("%s is a binary file", name)
+	}
+
+	lines := splitLines(string(data))
+	start, end := 1, len(lines)
+	if v, ok := args["start_line"].(float64); ok {
+		start = int(v)
+	}
+	if v, ok := args["end_line"].(float64); ok {
+		end = min(int(v), len(lines))
+	} else if end-start+1 > maxReadLines {
+		end = start + maxReadLines - 1
+	}
+	if start < 1 || (len(lines) > 0 && start > len(lines)) || end < start-1 {
+		return toolError("invalid range %d-%d: %s has %d lines", start, end, name, len(lines))
+	}
+
+	content := strings.Join(lines[start-1:end], "")
+	return map[string]any{
+		"is_error":    false,
+		"output":      content,
+		"path":        name,
+		"start_line":  start,
+		"end_line":    end,
+		"total_lines": len(lines),
+		"truncated":   end < len(lines),
+	}
+}
+
+func writeFile(ctx context.Context, r *os.Root, args map[string]any) map[string]any {
+	name, ok := args["path"].(string)
+	if !ok || name == "" {
+		return toolError("path is required")
+	}
+	content, ok := args["content"].(string)
+	if !ok {
+		return toolError("content is required")
+	}
+	name, err := workspacePath(r, name)
+	if err != nil {
+		return toolError("%v", err)
+	}
+
+	_, err = r.Stat(name)
+	created := errors.Is(err, fs.ErrNotExist)
+	if err := writeWorkspaceFile(r, name, content); err != nil {
+		return toolError("%v", err)
+	}
+
+	action := "updated"
+	if created {
+		action = "created"
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   fmt.Sprintf("%s %s (%d bytes)", action, name, len(content)),
+		"path":     name,
+		"bytes":    len(content),
+		"created":  created,
+	}
+}
+
+// writeWorkspaceFile writes content to name, creating the missing parent
+// directories. The permissions of an existing file are kept.
+func writeWorkspaceFile(r *os.Root, name, content string) error {
+	dir := ""
+	for _, elem := range strings.Split(path.Dir(name), "/") {
+		if elem == "." {
+			continue
+		}
+		dir = path.Join(dir, elem)
+		if err := r.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	f, err := r.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+func listDir(ctx context.Context, r *os.Root, args map[string]any) map[string]any {
+	dir, _ := args["path"].(string)
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := workspacePath(r, dir)
+	if err != nil {
+		return toolError("%v", err)
+	}
+	pattern, _ := args["pattern"].(string)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return toolError("invalid pattern %q: %v", pattern, err)
+	}
+	recursive, _ := args["recursive"].(bool)
+	if info, err := fs.Stat(r.FS(), dir); err != nil {
+		return toolError("failed to list %s: %v", dir, err)
+	} else if !info.IsDir() {
+		return toolError("%s is not a directory", dir)
+	}
+
+	var entries []any
+	var lines []string
+	truncated := false
+	err = fs.WalkDir(r.FS(), dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel := strings.TrimPrefix(p, dir+"/")
+		if dir == "." {
+			rel = p
+		}
+
+		if matchesPattern(pattern, rel) {
+			if len(entries) == maxListEntries {
+				truncated = true
+				return fs.SkipAll
+			}
+			entry := map[string]any{"path": p, "type": entryType(d)}
+			line := p
+			if d.IsDir() {
+				line += "/"
+			} else if info, err := d.Info(); err == nil {
+				entry["size"] = info.Size()
+			}
+			entries = append(entries, entry)
+			lines = append(lines, line)
+		}
+
+		if d.IsDir() && (!recursive || d.Name() == ".git") {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return toolError("failed to list %s: %v", dir, err)
+	}
+
+	output := strings.Join(lines, "\n")
+	if truncated {
+		output += fmt.Sprintf("\n(%d 件を超えたため省略しました)", maxListEntries)
+	}
+	return map[string]any{
+		"is_error":  false,
+		"output":    output,
+		"entries":   entries,
+		"truncated": truncated,
+	}
+}
+
+// matchesPattern matches the base name, or the path relative to the listed
+// directory when the pattern contains a slash.
+func matchesPattern(pattern, rel string) bool {
+	if pattern == "" {
+		return true
+	}
+	name := path.Base(rel)
+	if strings.Contains(pattern, "/") {
+		name = rel
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func entryType(d fs.DirEntry) string {
+	switch {
+	case d.IsDir():
+		return "dir"
+	case d.Type()&fs.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "file"
+}
+
+// isBinary reports whether data looks like a binary file, as git does.
+func isBinary(data []byte) bool {
+	return strings.ContainsRune(string(data[:min(len(data), 8000)]), 0)
+}
+
+// splitLines splits s into lines keeping their line endings.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func applyPatch(ctx context.Context, r *os.Root, args map[string]any) map[string]any {
+	patch, _ := args["patch"].(string)
+	edits, hasEdits := args["edits"].([]any)
+	if (patch == "") == !hasEdits {
+		return toolError("either patch, or path and edits is required")
+	}
+
+	var changes []*fileChange
+	var conflicts []patchConflict
+	if patch != "" {
+		filePatches, err := parsePatch(patch)
+		if err != nil {
+			return toolError("invalid patch: %v", err)
+		}
+		seen := make(map[string]bool)
+		for _, fp := range filePatches {
+			// 同じファイルの差分が複数あると、どれも元の内容に対して適用され最後のものだけが残る
+			name := path.Clean(fp.name())
+			if seen[name] {
+				conflicts = append(conflicts, patchConflict{Path: name, Reason: "the patch has more than one section for this file, merge them into one"})
+				continue
+			}
+			seen[name] = true
+			change, fileConflicts := fp.apply(r)
+			changes = append(changes, change)
+			conflicts = append(conflicts, fileConflicts...)
+		}
+	} else {
+		name, _ := args["path"].(string)
+		if name == "" {
+			return toolError("path is required with edits")
+		}
+		change, editConflicts := applyEdits(r, name, edits)
+		changes = append(changes, change)
+		conflicts = append(conflicts, editConflicts...)
+	}
+
+	if len(conflicts) > 0 {
+		// 一部だけ適用すると状態が分かりにくくなるので、どのファイルも変更しない
+		var lines []string
+		var reported []any
+		for _, c := range conflicts {
+			lines = append(lines, c.String())
+			reported = append(reported, c.toMap())
+		}
+		return map[string]any{
+			"is_error":  true,
+			"output":    "the patch was not applied:\n" + strings.Join(lines, "\n"),
+			"conflicts": reported,
+		}
+	}
+
+	var lines []string
+	var files []any
+	for _, change := range changes {
+		if err := change.write(r); err != nil {
+			return toolError("%v", err)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", change.action, change.path))
+		files = append(files, map[string]any{"path": change.path, "action": change.action, "changes": change.count})
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   strings.Join(lines, "\n"),
+		"files":    files,
+	}
+}
+
+// fileChange is the new content of a file, written once every change of the
+// call applies.
+type fileChange struct {
+	path    string
+	action  string // "created", "updated" or "deleted"
+	content string
+	count   int // hunks or edits applied
+}
+
+func (c *fileChange) write(r *os.Root) error {
+	if c.action == "deleted" {
+		if err := r.Remove(c.path); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", c.path, err)
+		}
+		return nil
+	}
+	return writeWorkspaceFile(r, c.path, c.content)
+}
+
+// patchConflict is a hunk or an edit that could not be applied.
+type patchConflict struct {
+	Path     string
+	Index    int    // 1-based number of the hunk or the edit, 0 for the whole file
+	Reason   string // why it did not apply
+	Expected string // the lines or the text that was looked for
+}
+
+func (c patchConflict) String() string {
+	s := c.Path
+	if c.Index > 0 {
+		s += " #" + strconv.Itoa(c.Index)
+	}
+	s += ": " + c.Reason
+	if c.Expected != "" {
+		s += "\n" + c.Expected
+	}
+	return s
+}
+
+func (c patchConflict) toMap() map[string]any {
+	m := map[string]any{"path": c.Path, "reason": c.Reason}
+	if c.Index > 0 {
+		m["index"] = c.Index
+	}
+	if c.Expected != "" {
+		m["expected"] = c.Expected
+	}
+	return m
+}
+
+// readForPatch reads name for a patch. A missing file is returned as exists false.
+func readForPatch(r *os.Root, name string) (content string, exists bool, err error) {
+	data, err := fs.ReadFile(r.FS(), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+func applyEdits(r *os.Root, name string, edits []any) (*fileChange, []patchConflict) {
+	name, err := workspacePath(r, name)
+	if err != nil {
+		return nil, []patchConflict{{Path: name, Reason: err.Error()}}
+	}
+	content, exists, err := readForPatch(r, name)
+	if err != nil || !exists {
+		if err == nil {
+			err = fs.ErrNotExist
+		}
+		return nil, []patchConflict{{Path: name, Reason: fmt.Sprintf("failed to read: %v", err)}}
+	}
+
+	var conflicts []patchConflict
+	for i, e := range edits {
+		edit, _ := e.(map[string]any)
+		search, _ := edit["search"].(string)
+		replace, ok := edit["replace"].(string)
+		if search == "" || !ok {
+			conflicts = append(conflicts, patchConflict{Path: name, Index: i + 1, Reason: "search and replace are required"})
+			continue
+		}
+		switch n := strings.Count(content, search); n {
+		case 1:
+			content = strings.Replace(content, search, replace, 1)
+		case 0:
+			conflicts = append(conflicts, patchConflict{Path: name, Index: i + 1, Reason: "search text not found", Expected: search})
+		default:
+			conflicts = append(conflicts, patchConflict{Path: name, Index: i + 1, Reason: fmt.Sprintf("search text found %d times, make it unique", n), Expected: search})
+		}
+	}
+	return &fileChange{path: name, action: "updated", content: content, count: len(edits)}, conflicts
+}
+
+// filePatch is the part of a unified diff for one file.
+type filePatch struct {
+	oldPath, newPath string // "/dev/null" when the file is created or deleted
+	hunks            []*hunk
+}
+
+type hunk struct {
+	header   string
+	oldStart int // 0 when the header has no line numbers
+	lines    []string
+	// marked is set when the hunk has a "\ No newline at end of file" line,
+	// and noNewline when it follows the new side.
+	marked, noNewline bool
+}
+
+// old and new return the lines the hunk replaces and its replacement.
+func (h *hunk) old() []string { return h.side('+') }
+func (h *hunk) new() []string { return h.side('-') }
+
+func (h *hunk) side(skip byte) []string {
+	var lines []string
+	for _, l := range h.lines {
+		if l[0] != skip {
+			lines = append(lines, l[1:])
+		}
+	}
+	return lines
+}
+
+// parsePatch parses a unified diff as written by git diff or diff -u. Hunk
+// line counts are not required, and hunks without line numbers ("@@ @@") are
+// located by their context.
+func parsePatch(patch string) ([]*filePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(patch, "\r\n", "\n"), "\n")
+	var patches []*filePatch
+	var fp *filePatch
+	var h *hunk
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			fp = &filePatch{oldPath: patchFileName(line[4:], "a/"), newPath: patchFileName(lines[i+1][4:], "b/")}
+			patches = append(patches, fp)
+			h = nil
+			i++
+		case strings.HasPrefix(line, "@@"):
+			if fp == nil {
+				return nil, fmt.Errorf("hunk %q has no file header (--- / +++)", line)
+			}
+			h = &hunk{header: line, oldStart: hunkStart(line)}
+			fp.hunks = append(fp.hunks, h)
+		case h != nil && line != "" && strings.ContainsRune(" -+", rune(line[0])):
+			h.lines = append(h.lines, line)
+		case h != nil && line == "" && i < len(lines)-1:
+			// 末尾の空白を取り除かれた空行の文脈
+			h.lines = append(h.lines, " ")
+		case h != nil && strings.HasPrefix(line, `\`):
+			// "\ No newline at end of file"
+			h.marked = true
+			if n := len(h.lines); n > 0 && h.lines[n-1][0] != '-' {
+				h.noNewline = true
+			}
+		default:
+			// diff --git や index などのヘッダー
+			h = nil
+		}
+	}
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no file header (--- / +++) found")
+	}
+	for _, fp := range patches {
+		if len(fp.hunks) == 0 {
+			return nil, fmt.Errorf("%s has no hunks", fp.name())
+		}
+	}
+	return patches, nil
+}
+
+// patchFileName strips the timestamp diff -u adds and the a/ or b/ prefix of git.
+func patchFileName(s, prefix string) string {
+	s, _, _ = strings.Cut(s, "\t")
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return s
+	}
+	return strings.TrimPrefix(s, prefix)
+}
+
+// hunkStart returns the first old line of a "@@ -l,s +l,s @@" header.
+func hunkStart(header string) int {
+	fields := strings.Fields(header)
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "-") {
+		return 0
+	}
+	start, _, _ := strings.Cut(fields[1][1:], ",")
+	n, _ := strconv.Atoi(start)
+	return n
+}
+
+func (fp *filePatch) name() string {
+	if fp.newPath == "/dev/null" {
+		return fp.oldPath
+	}
+	return fp.newPath
+}
+
+// apply computes the new content of the file. Hunks are located by their
+// context, nearest to the line in their header. Trailing whitespace is
+// ignored when no exact match is found.
+func (fp *filePatch) apply(r *os.Root) (*fileChange, []patchConflict) {
+	name, err := workspacePath(r, fp.name())
+	if err != nil {
+		return nil, []patchConflict{{Path: fp.name(), Reason: err.Error()}}
+	}
+	content, exists, err := readForPatch(r, name)
+	if err != nil {
+		return nil, []patchConflict{{Path: name, Reason: fmt.Sprintf("failed to read: %v", err)}}
+	}
+
+	change := &fileChange{path: name, action: "updated", count: len(fp.hunks)}
+	switch {
+	case fp.oldPath == "/dev/null":
+		if exists {
+			return nil, []patchConflict{{Path: name, Reason: "the file to create already exists"}}
+		}
+		change.action = "created"
+	case !exists:
+		return nil, []patchConflict{{Path: name, Reason: "the file to patch does not exist"}}
+	case fp.newPath == "/dev/null":
+		change.action = "deleted"
+	}
+
+	lines := splitLines(content)
+	finalNewline := content == "" || strings.HasSuffix(content, "\n")
+	var conflicts []patchConflict
+	offset, next := 0, 0
+	for i, h := range fp.hunks {
+		old, repl := h.old(), h.new()
+		at := findHunk(lines, old, next, h.oldStart-1+offset)
+		if at < 0 {
+			reason := "context not found"
+			if h.oldStart > 0 {
+				reason = fmt.Sprintf("context not found near line %d", h.oldStart)
+			}
+			conflicts = append(conflicts, patchConflict{Path: name, Index: i + 1, Reason: reason, Expected: strings.Join(old, "\n")})
+			continue
+		}
+
+		replaced := make([]string, len(repl))
+		for j, l := range repl {
+			replaced[j] = l + "\n"
+		}
+		if at+len(old) == len(lines) && len(repl) > 0 {
+			// ファイル末尾の改行の有無は hunk の指定に従い、指定がなければ元のファイルに合わせる
+			if h.noNewline || (!finalNewline && !h.marked) {
+				replaced[len(repl)-1] = repl[len(repl)-1]
+			}
+		}
+		lines = append(lines[:at], append(replaced, lines[at+len(old):]...)...)
+		next = at + len(repl)
+		offset += len(repl) - len(old)
+	}
+
+	change.content = strings.Join(lines, "")
+	if change.action == "deleted" && change.content != "" && len(conflicts) == 0 {
+		conflicts = append(conflicts, patchConflict{Path: name, Reason: "the file to delete does not match the patch"})
+	}
+	return change, conflicts
+}
+
+// findHunk returns where old appears in lines at or after from, nearest to
+// hint. It returns -1 when old is not found.
+func findHunk(lines, old []string, from, hint int) int {
+	if len(old) == 0 {
+		// 文脈のない追加は hint の位置 (新規ファイルでは先頭) に挿入する
+		return min(max(hint+1, from), len(lines))
+	}
+	for _, equal := range []func(a, b string) bool{
+		func(a, b string) bool { return strings.TrimSuffix(a, "\n") == b },
+		func(a, b string) bool { return strings.TrimRight(a, " \t\r\n") == strings.TrimRight(b, " \t\r") },
+	} {
+		best := -1
+		for at := from; at+len(old) <= len(lines); at++ {
+			if !matchLines(lines[at:at+len(old)], old, equal) {
+				continue
+			}
+			if best < 0 || abs(at-hint) < abs(best-hint) {
+				best = at
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+	}
+	return -1
+}
+
+func matchLines(lines, old []string, equal func(a, b string) bool) bool {
+	for i := range old {
+		if !equal(lines[i], old[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,237 @@
+package makasero
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// callFunction calls one of functions and fails the test unless it succeeds.
+func callFunction(t *testing.T, functions map[string]FunctionDefinition, name string, args map[string]any) map[string]any {
+	t.Helper()
+	result, err := functions[name].Handler(context.Background(), args)
+	if err != nil {
+		t.Fatalf("%s failed: %v", name, err)
+	}
+	if result["is_error"] != false {
+		t.Fatalf("%s failed: %v", name, result["output"])
+	}
+	return result
+}
+
+func writeTestFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	p := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, root, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(root, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReadFileRange(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.txt", "one\ntwo\nthree\nfour\n")
+
+	result := callFunction(t, fileFunctions(root), "read_file", map[string]any{"path": "a.txt", "start_line": 2.0, "end_line": 3.0})
+	if result["is_error"] != false || result["output"] != "two\nthree\n" || result["total_lines"] != 4 || result["truncated"] != true {
+		t.Errorf("unexpected result: %v", result)
+	}
+
+	result, _ = fileFunctions(root)["read_file"].Handler(context.Background(), map[string]any{"path": filepath.Join(root, "a.txt"), "start_line": 9.0})
+	if result["is_error"] != true {
+		t.Errorf("expected an error for a range past the end, got %v", result)
+	}
+}
+
+func TestFileFunctionsStayInTheWorkspace(t *testing.T) {
+	outside := t.TempDir()
+	writeTestFile(t, outside, "secret.txt", "secret")
+	root := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+
+	for _, args := range []map[string]any{
+		{"path": "../secret.txt"},
+		{"path": filepath.Join(outside, "secret.txt")},
+		{"path": "link/secret.txt"},
+	} {
+		if result, _ := fileFunctions(root)["read_file"].Handler(context.Background(), args); result["is_error"] != true {
+			t.Errorf("expected %v to be rejected, got %v", args["path"], result)
+		}
+	}
+
+	result, _ := fileFunctions(root)["write_file"].Handler(context.Background(), map[string]any{"path": "link/new.txt", "content": "x"})
+	if result["is_error"] != true {
+		t.Errorf("expected writing through the link to be rejected, got %v", result)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Error("the file was written outside the workspace")
+	}
+}
+
+func TestWriteFileCreatesDirectories(t *testing.T) {
+	root := t.TempDir()
+
+	result := callFunction(t, fileFunctions(root), "write_file", map[string]any{"path": "pkg/sub/b.go", "content": "package sub\n"})
+	if result["is_error"] != false || result["created"] != true {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if got := readTestFile(t, root, "pkg/sub/b.go"); got != "package sub\n" {
+		t.Errorf("unexpected content: %q", got)
+	}
+}
+
+func TestListDirWithPattern(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.go", "")
+	writeTestFile(t, root, "README.md", "")
+	writeTestFile(t, root, "pkg/b.go", "")
+	writeTestFile(t, root, ".git/config", "")
+
+	result := callFunction(t, fileFunctions(root), "list_dir", map[string]any{"pattern": "*.go", "recursive": true})
+	if result["is_error"] != false || result["output"] != "a.go\npkg/b.go" {
+		t.Errorf("unexpected result: %v", result)
+	}
+
+	result = callFunction(t, fileFunctions(root), "list_dir", map[string]any{"path": "."})
+	if result["output"] != ".git/\nREADME.md\na.go\npkg/" {
+		t.Errorf("unexpected listing: %q", result["output"])
+	}
+}
+
+func TestApplyPatchUnifiedDiff(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "main.go", "package main\n\nfunc a() {}\n\nfunc b() {}\n\nfunc c() {}\n")
+
+	patch := `diff --git a/main.go b/main.go
+--- a/main.go
++++ b/main.go
+@@ -3,1 +3,1 @@
+-func a() {}
++func a() { b() }
+@@ -7,1 +7,2 @@
+ func c() {}
++func d() {}
+--- /dev/null
++++ b/new.go
+@@ -0,0 +1,1 @@
++package main
+`
+	result := callFunction(t, fileFunctions(root), "apply_patch", map[string]any{"patch": patch})
+	if result["is_error"] != false {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if got := readTestFile(t, root, "main.go"); got != "package main\n\nfunc a() { b() }\n\nfunc b() {}\n\nfunc c() {}\nfunc d() {}\n" {
+		t.Errorf("unexpected content: %q", got)
+	}
+	if got := readTestFile(t, root, "new.go"); got != "package main\n" {
+		t.Errorf("unexpected new file: %q", got)
+	}
+}
+
+func TestApplyPatchReportsConflicts(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.txt", "one\ntwo\n")
+	writeTestFile(t, root, "b.txt", "three\n")
+
+	patch := `--- a/a.txt
++++ b/a.txt
+@@ -1,1 +1,1 @@
+-one
++ONE
+--- a/b.txt
++++ b/b.txt
+@@ -1,1 +1,1 @@
+-four
++FOUR
+`
+	result, _ := fileFunctions(root)["apply_patch"].Handler(context.Background(), map[string]any{"patch": patch})
+	conflicts, _ := result["conflicts"].([]any)
+	if result["is_error"] != true || len(conflicts) != 1 || !strings.Contains(result["output"].(string), "b.txt #1") {
+		t.Fatalf("expected the conflict of b.txt, got %v", result)
+	}
+	if got := readTestFile(t, root, "a.txt"); got != "one\ntwo\n" {
+		t.Errorf("expected no file to change, a.txt is %q", got)
+	}
+}
+
+func TestApplyPatchRejectsDuplicateFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.txt", "one\ntwo\n")
+
+	patch := `--- a/a.txt
++++ b/a.txt
+@@ -1,1 +1,1 @@
+-one
++ONE
+--- a/a.txt
++++ b/a.txt
+@@ -2,1 +2,1 @@
+-two
++TWO
+`
+	result, _ := fileFunctions(root)["apply_patch"].Handler(context.Background(), map[string]any{"patch": patch})
+	if result["is_error"] != true || !strings.Contains(result["output"].(string), "more than one section") {
+		t.Fatalf("expected the second section of a.txt to be rejected, got %v", result)
+	}
+	if got := readTestFile(t, root, "a.txt"); got != "one\ntwo\n" {
+		t.Errorf("expected no file to change, a.txt is %q", got)
+	}
+}
+
+func TestApplyPatchSearchReplace(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.txt", "x = 1\ny = 1\n")
+
+	result, _ := fileFunctions(root)["apply_patch"].Handler(context.Background(), map[string]any{
+		"path":  "a.txt",
+		"edits": []any{map[string]any{"search": "= 1", "replace": "= 2"}},
+	})
+	if result["is_error"] != true || !strings.Contains(result["output"].(string), "found 2 times") {
+		t.Errorf("expected the ambiguous search to conflict, got %v", result)
+	}
+
+	result = callFunction(t, fileFunctions(root), "apply_patch", map[string]any{
+		"path": "a.txt",
+		"edits": []any{
+			map[string]any{"search": "x = 1", "replace": "x = 2"},
+			map[string]any{"search": "y = 1", "replace": "y = 3"},
+		},
+	})
+	if result["is_error"] != false {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if got := readTestFile(t, root, "a.txt"); got != "x = 2\ny = 3\n" {
+		t.Errorf("unexpected content: %q", got)
+	}
+}
+
+func TestAgentUsesTheWorkspace(t *testing.T) {
+	root := t.TempDir()
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "write_file", Args: map[string]any{"path": "hello.txt", "content": "hello\n"}}}},
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}}},
+	}}
+	agent, _ := newScriptedAgent(t, script, WithWorkspace(root))
+
+	if _, err := agent.ProcessMessage(context.Background(), "write hello"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if got := readTestFile(t, root, "hello.txt"); got != "hello\n" {
+		t.Errorf("unexpected content: %q", got)
+	}
+}
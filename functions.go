@@ -4,28 +4,73 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
-	"strings"
+)
+
+type Type string
 
-	"github.com/google/generative-ai-go/genai"
+const (
+	TypeString  Type = "string"
+	TypeNumber  Type = "number"
+	TypeInteger Type = "integer"
+	TypeBoolean Type = "boolean"
+	TypeArray   Type = "array"
+	TypeObject  Type = "object"
 )
 
+// Schema is a provider-neutral subset of JSON Schema used to declare function parameters.
+type Schema struct {
+	Type        Type               `json:"type,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+}
+
+type FunctionDeclaration struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Parameters  *Schema `json:"parameters,omitempty"`
+}
+
 type FunctionHandler func(ctx context.Context, args map[string]any) (map[string]any, error)
 
 type FunctionDefinition struct {
-	Declaration *genai.FunctionDeclaration
+	Declaration *FunctionDeclaration
 	Handler     FunctionHandler
+	// Concurrent reports that the function has no side effects and may run in
+	// parallel with other concurrent calls of the same model turn.
+	Concurrent bool
+}
+
+// typedFunction wraps handler so that it is only called with arguments that
+// conform to the parameters of decl. Violations are returned to the model.
+func typedFunction(decl *FunctionDeclaration, handler FunctionHandler, concurrent bool) FunctionDefinition {
+	return FunctionDefinition{
+		Declaration: decl,
+		Handler: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			if err := decl.Parameters.validate(args, "args"); err != nil {
+				return map[string]any{
+					"is_error": true,
+					"output":   fmt.Sprintf("invalid arguments for %s: %v", decl.Name, err),
+				}, nil
+			}
+			return handler(ctx, args)
+		},
+		Concurrent: concurrent,
+	}
 }
 
 var builtinFunctions = map[string]FunctionDefinition{
 	"git_add": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "git_add",
 			Description: "git add を実行します",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"path_to_add": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "git add するファイルまたはディレクトリのパス",
 					},
 				},
@@ -35,14 +80,14 @@ var builtinFunctions = map[string]FunctionDefinition{
 		Handler: handleGitAdd,
 	},
 	"git_commit": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "git_commit",
 			Description: "git commit を実行します",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"commit_message": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "git commit のメッセージ",
 					},
 				},
@@ -52,52 +97,54 @@ var builtinFunctions = map[string]FunctionDefinition{
 		Handler: handleGitCommit,
 	},
 	"git_status": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "git_status",
 			Description: "git status を実行します",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"path_to_status": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "git status を実行するパス",
 					},
 				},
 				Required: []string{"path_to_status"},
 			},
 		},
-		Handler: handleGitStatus,
+		Handler:    handleGitStatus,
+		Concurrent: true,
 	},
 	"git_diff": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "git_diff",
 			Description: "git diff を実行します",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"path_to_diff": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "git diff を実行するパス",
 					},
 					"staged": {
-						Type:        genai.TypeBoolean,
+						Type:        TypeBoolean,
 						Description: "ステージングエリアの変更を表示するかどうか",
 					},
 				},
 				Required: []string{"path_to_diff"},
 			},
 		},
-		Handler: handleGitDiff,
+		Handler:    handleGitDiff,
+		Concurrent: true,
 	},
 	"complete": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "complete",
 			Description: "タスク完了を報告します",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"message": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "完了メッセージ",
 					},
 				},
@@ -107,21 +154,21 @@ var builtinFunctions = map[string]FunctionDefinition{
 		Handler: handleComplete,
 	},
 	"ask_question": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "ask_question",
 			Description: "ユーザーに質問を投げかけます。タスクの遂行のためにさらに情報が必要である場合にこの関数を呼び出します。",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"question": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "ユーザーへの質問内容",
 					},
 					"options": {
-						Type:        genai.TypeArray,
+						Type:        TypeArray,
 						Description: "選択肢（オプション）",
-						Items: &genai.Schema{
-							Type: genai.TypeString,
+						Items: &Schema{
+							Type: TypeString,
 						},
 					},
 				},
@@ -131,54 +178,55 @@ var builtinFunctions = map[string]FunctionDefinition{
 		Handler: handleAskQuestion,
 	},
 	"gh_issue_view": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "gh_issue_view",
 			Description: "gh issue view コマンドを使って、指定された番号の GitHub issue を表示します。コメント本文も含めて表示されます。",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"issue_number": {
-						Type:        genai.TypeNumber,
+						Type:        TypeNumber,
 						Description: "表示する GitHub issue の番号",
 					},
 					"repo": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "リポジトリ名 (例: owner/repo)。指定がない場合は現在のリポジトリとみなされます。",
 					},
 					"include_comments": {
-						Type:        genai.TypeBoolean,
+						Type:        TypeBoolean,
 						Description: "コメントを含めて表示するかどうか (デフォルト: true)",
 					},
 				},
 				Required: []string{"issue_number"},
 			},
 		},
-		Handler: handleGhIssueView,
+		Handler:    handleGhIssueView,
+		Concurrent: true,
 	},
 	"gh_issue_create": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "gh_issue_create",
 			Description: "gh issue create コマンドを使って、GitHub Issue を作成します。",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"title": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "Issue のタイトル",
 					},
 					"body": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "Issue の本文",
 					},
 					"labels": {
-						Type:        genai.TypeArray,
+						Type:        TypeArray,
 						Description: "付与するラベルの配列 (例: [\"bug\", \"critical\"])",
-						Items: &genai.Schema{
-							Type: genai.TypeString,
+						Items: &Schema{
+							Type: TypeString,
 						},
 					},
 					"repo": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "リポジトリ名 (例: owner/repo)。指定がない場合は現在のリポジトリとみなされます。",
 					},
 				},
@@ -188,18 +236,18 @@ var builtinFunctions = map[string]FunctionDefinition{
 		Handler: handleGhIssueCreate,
 	},
 	"create_makasero_enhancement_issue": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "create_makasero_enhancement_issue",
 			Description: "makasero 自身の改善案を GitHub Issue として起票します。issue は pankona/makasero リポジトリの issue として起票され、自動的に 'enhancement' ラベルが付与されます。",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"title": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "Issue のタイトル",
 					},
 					"body": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "Issue の本文",
 					},
 				},
@@ -209,29 +257,30 @@ var builtinFunctions = map[string]FunctionDefinition{
 		Handler: handleCreateEnhancementIssue,
 	},
 	"gh_pr_view": {
-		Declaration: &genai.FunctionDeclaration{
+		Declaration: &FunctionDeclaration{
 			Name:        "gh_pr_view",
 			Description: "gh pr view コマンドを使って、指定された番号の GitHub Pull Request を表示します。差分の確認やレビューに役立ちます。",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
 					"pr_number": {
-						Type:        genai.TypeNumber,
+						Type:        TypeNumber,
 						Description: "表示する GitHub Pull Request の番号",
 					},
 					"repo": {
-						Type:        genai.TypeString,
+						Type:        TypeString,
 						Description: "リポジトリ名 (例: owner/repo)。指定がない場合は現在のリポジトリとみなされます。",
 					},
 					"diff": {
-						Type:        genai.TypeBoolean,
+						Type:        TypeBoolean,
 						Description: "差分を表示するかどうか (--diff オプション)",
 					},
 				},
 				Required: []string{"pr_number"},
 			},
 		},
-		Handler: handleGhPrView,
+		Handler:    handleGhPrView,
+		Concurrent: true,
 	},
 }
 
@@ -244,7 +293,7 @@ func handleGitAdd(ctx context.Context, args map[string]any) (map[string]any, err
 		}, nil
 	}
 
-	cmd := exec.Command("git", "add", pathToAdd)
+	cmd := exec.CommandContext(ctx, "git", "add", pathToAdd)
 	output, err := cmd.Output()
 	if err != nil {
 		return map[string]any{
@@ -268,7 +317,7 @@ func handleGitCommit(ctx context.Context, args map[string]any) (map[string]any,
 		}, nil
 	}
 
-	cmd := exec.Command("git", "commit", "-m", commitMessage)
+	cmd := exec.CommandContext(ctx, "git", "commit", "-m", commitMessage)
 	output, err := cmd.Output()
 	if err != nil {
 		return map[string]any{
@@ -292,7 +341,7 @@ func handleGitStatus(ctx context.Context, args map[string]any) (map[string]any,
 		}, nil
 	}
 
-	cmd := exec.Command("git", "status", "--short", "--", pathToStatus)
+	cmd := exec.CommandContext(ctx, "git", "status", "--short", "--", pathToStatus)
 	output, err := cmd.Output()
 	if err != nil {
 		return map[string]any{
@@ -318,9 +367,9 @@ func handleGitDiff(ctx context.Context, args map[string]any) (map[string]any, er
 
 	var cmd *exec.Cmd
 	if staged, ok := args["staged"].(bool); ok && staged {
-		cmd = exec.Command("git", "diff", "--staged", "--", pathToDiff)
+		cmd = exec.CommandContext(ctx, "git", "diff", "--staged", "--", pathToDiff)
 	} else {
-		cmd = exec.Command("git", "diff", "--", pathToDiff)
+		cmd = exec.CommandContext(ctx, "git", "diff", "--", pathToDiff)
 	}
 
 	output, err := cmd.Output()
@@ -337,22 +386,13 @@ func handleGitDiff(ctx context.Context, args map[string]any) (map[string]any, er
 	}, nil
 }
 
+// handleComplete と handleAskQuestion は何もしない。
+// 内容は Agent が EventCompleted / EventQuestionAsked として通知する
 func handleComplete(ctx context.Context, args map[string]any) (map[string]any, error) {
-	fmt.Printf("🤖 Task completed!:\n%v\n", strings.TrimSpace(args["message"].(string)))
 	return nil, nil
 }
 
 func handleAskQuestion(ctx context.Context, args map[string]any) (map[string]any, error) {
-	fmt.Printf("🤖 Question:\n%v\n", strings.TrimSpace(args["question"].(string)))
-	fmt.Printf("🤖 Options:\n")
-	options, ok := args["options"].([]any)
-	if !ok {
-		// empty options is allowed
-		return nil, nil
-	}
-	for _, option := range options {
-		fmt.Printf("  %v\n", option.(string))
-	}
 	return nil, nil
 }
 
@@ -392,7 +432,7 @@ func handleGhIssueView(ctx context.Context, args map[string]any) (map[string]any
 		cmdArgs = append(cmdArgs, "--repo", repo)
 	}
 
-	cmd := exec.Command("gh", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "gh", cmdArgs...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return map[string]any{
@@ -441,7 +481,7 @@ func handleGhIssueCreate(ctx context.Context, args map[string]any) (map[string]a
 		cmdArgs = append(cmdArgs, "--repo", repo)
 	}
 
-	cmd := exec.Command("gh", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "gh", cmdArgs...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return map[string]any{
@@ -480,7 +520,7 @@ func handleCreateEnhancementIssue(ctx context.Context, args map[string]any) (map
 	// 改善提案なので、必ず enhancement ラベルを付与し、固定のリポジトリを指定する
 	cmdArgs = append(cmdArgs, "issue", "create", "--title", title, "--body", body, "--label", "enhancement", "--repo", fixedRepo)
 
-	cmd := exec.Command("gh", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "gh", cmdArgs...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return map[string]any{
@@ -518,7 +558,7 @@ func handleGhPrView(ctx context.Context, args map[string]any) (map[string]any, e
 		cmdArgs = append(cmdArgs, "--repo", repo)
 	}
 
-	cmd := exec.Command("gh", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "gh", cmdArgs...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return map[string]any{
@@ -0,0 +1,56 @@
+package makasero
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// GenerationConfig holds the sampling parameters sent with every request.
+// Unset fields use the provider's defaults. Providers ignore the parameters
+// they do not support (e.g. SafetySettings outside Gemini).
+type GenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	CandidateCount  int      `json:"candidateCount,omitempty"` // at most 1, since only the first candidate is used
+	// SafetySettings maps a harm category to the threshold from which content is
+	// blocked, e.g. {"dangerous_content": "block_only_high"} (Gemini only)
+	SafetySettings map[string]string `json:"safetySettings,omitempty"`
+}
+
+// Harm categories and block thresholds of GenerationConfig.SafetySettings.
+var (
+	SafetyCategories = []string{"harassment", "hate_speech", "sexually_explicit", "dangerous_content"}
+	SafetyThresholds = []string{"block_none", "block_only_high", "block_medium_and_above", "block_low_and_above"}
+)
+
+// WithGenerationConfig sets the sampling parameters. It overrides the
+// parameters saved in a resumed session and the generation section of the config.
+func WithGenerationConfig(c GenerationConfig) AgentOption {
+	return func(a *Agent) {
+		a.generation = &c
+	}
+}
+
+// Validate checks the candidate count and the safety settings, which the
+// provider would otherwise reject or ignore.
+func (c *GenerationConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.CandidateCount > 1 {
+		return fmt.Errorf("candidateCount must be at most 1, got %d: only the first candidate is used", c.CandidateCount)
+	}
+	for _, category := range slices.Sorted(maps.Keys(c.SafetySettings)) {
+		if !slices.Contains(SafetyCategories, category) {
+			return fmt.Errorf("unknown safety category %q (expected one of %v)", category, SafetyCategories)
+		}
+		if threshold := c.SafetySettings[category]; !slices.Contains(SafetyThresholds, threshold) {
+			return fmt.Errorf("unknown safety threshold %q for %s (expected one of %v)", threshold, category, SafetyThresholds)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package makasero
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProcessMessageSendsGenerationConfig(t *testing.T) {
+	temperature := float32(0.2)
+	generation := GenerationConfig{
+		Temperature:     &temperature,
+		MaxOutputTokens: 1024,
+		SafetySettings:  map[string]string{"dangerous_content": "block_only_high"},
+	}
+	agent, provider := newScriptedAgent(t, completeScript(), WithGenerationConfig(generation))
+
+	if _, err := agent.ProcessMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	config := provider.Requests()[0].Config
+	if config == nil || config.Temperature == nil || *config.Temperature != 0.2 || config.MaxOutputTokens != 1024 {
+		t.Fatalf("expected the generation config in the request, got %+v", config)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.Generation == nil || saved.Generation.MaxOutputTokens != 1024 || saved.Generation.SafetySettings["dangerous_content"] != "block_only_high" {
+		t.Fatalf("expected the generation config to be saved, got %+v", saved.Generation)
+	}
+
+	// 再開時は設定ファイルよりセッションに保存された値を使う
+	provider = NewScriptedProvider(completeScript())
+	config = &GenerationConfig{MaxOutputTokens: 10}
+	resumed, err := NewAgent(context.Background(), "", &MCPConfig{Generation: config},
+		WithProvider(provider), WithSessionDir(agent.sessionDir), WithSession(saved))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	defer resumed.Close()
+	if _, err := resumed.ProcessMessage(context.Background(), "again"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if got := provider.Requests()[0].Config; got == nil || got.MaxOutputTokens != 1024 {
+		t.Errorf("expected the session's generation config on resume, got %+v", got)
+	}
+}
+
+func TestGenerationConfigValidate(t *testing.T) {
+	valid := &GenerationConfig{SafetySettings: map[string]string{"harassment": "block_none"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+	if err := (&GenerationConfig{SafetySettings: map[string]string{"violence": "block_none"}}).Validate(); err == nil {
+		t.Error("expected an unknown category to be rejected")
+	}
+	if err := (&GenerationConfig{SafetySettings: map[string]string{"harassment": "block_all"}}).Validate(); err == nil {
+		t.Error("expected an unknown threshold to be rejected")
+	}
+	if err := (&GenerationConfig{CandidateCount: 2}).Validate(); err == nil {
+		t.Error("expected more than one candidate to be rejected")
+	}
+
+	_, err := NewAgent(context.Background(), "", &MCPConfig{Generation: &GenerationConfig{SafetySettings: map[string]string{"violence": "block_none"}}},
+		WithProvider(NewScriptedProvider(completeScript())), WithSessionDir(t.TempDir()))
+	if err == nil {
+		t.Error("expected NewAgent to reject an invalid generation config")
+	}
+}
+
+func TestOpenAIProviderSendsGenerationConfig(t *testing.T) {
+	server, requests := newOpenAITestServer(t, `{"choices": [{"message": {"role": "assistant", "content": "ok"}, "finish_reason": "stop"}]}`)
+	provider, err := NewOpenAIProvider(server.URL+"/v1", "secret", "local-model")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	topP := float32(0.5)
+	if _, err := provider.Generate(context.Background(), &GenerateRequest{
+		Messages: []*Message{NewUserMessage(Text("hello"))},
+		Config:   &GenerationConfig{TopP: &topP, MaxOutputTokens: 256, StopSequences: []string{"<END>"}},
+	}); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	req := requests()[0]
+	if req["top_p"] != 0.5 || req["max_tokens"] != float64(256) || req["stop"].([]any)[0] != "<END>" {
+		t.Errorf("unexpected sampling parameters: %v", req)
+	}
+	if _, ok := req["temperature"]; ok {
+		t.Errorf("expected no temperature when unset, got %v", req["temperature"])
+	}
+}
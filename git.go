@@ -0,0 +1,533 @@
+package makasero
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultGitLogCount is how many commits git_log returns when max_count is omitted.
+	DefaultGitLogCount = 20
+	// maxGitLogCount caps the max_count of git_log.
+	maxGitLogCount = 500
+	// worktreesDir is where git_worktree adds worktrees, relative to the workspace.
+	worktreesDir = ".worktrees"
+)
+
+// dirParameter is the "dir" parameter shared by the git functions.
+var dirParameter = &Schema{
+	Type:        TypeString,
+	Description: "git を実行するディレクトリ (ワークスペースからの相対パス、例: .worktrees/feature)。省略時はワークスペース",
+}
+
+// gitFunctions returns git_log, git_show, git_branch, git_checkout,
+// git_stash, git_worktree and git_blame. They run in the workspace, or in a
+// directory of it such as a worktree added by git_worktree.
+func gitFunctions(root string) map[string]FunctionDefinition {
+	return map[string]FunctionDefinition{
+		"git_log": typedFunction(&FunctionDeclaration{
+			Name:        "git_log",
+			Description: "git log を実行し、コミットの一覧 (ハッシュ・作者・日時・件名) を新しい順に返します",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"dir":       dirParameter,
+					"ref":       {Type: TypeString, Description: "起点のブランチやコミット (省略時は HEAD)。main..feature のような範囲も指定できます"},
+					"path":      {Type: TypeString, Description: "このパスを変更したコミットに絞り込む"},
+					"max_count": {Type: TypeInteger, Description: fmt.Sprintf("返すコミットの最大数 (省略時は %d)", DefaultGitLogCount)},
+					"since":     {Type: TypeString, Description: "この日時以降のコミットに絞り込む (例: 2 weeks ago, 2024-01-01)"},
+					"author":    {Type: TypeString, Description: "作者で絞り込む"},
+					"grep":      {Type: TypeString, Description: "コミットメッセージを正規表現で絞り込む"},
+				},
+			},
+		}, inRepository(root, gitLog), true),
+		"git_show": typedFunction(&FunctionDeclaration{
+			Name:        "git_show",
+			Description: "git show を実行し、コミットのメッセージと差分を表示します",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"dir":  dirParameter,
+					"ref":  {Type: TypeString, Description: "表示するコミット、タグまたはブランチ"},
+					"path": {Type: TypeString, Description: "差分をこのパスに絞り込む"},
+					"stat": {Type: TypeBoolean, Description: "差分の代わりに変更されたファイルの一覧 (--stat) を表示するかどうか"},
+				},
+				Required: []string{"ref"},
+			},
+		}, inRepository(root, gitShow), true),
+		"git_branch": typedFunction(&FunctionDeclaration{
+			Name:        "git_branch",
+			Description: "ブランチを一覧・作成・削除します",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"dir":         dirParameter,
+					"action":      {Type: TypeString, Enum: []string{"list", "create", "delete"}, Description: "操作 (省略時は list)"},
+					"name":        {Type: TypeString, Description: "作成・削除するブランチ名"},
+					"start_point": {Type: TypeString, Description: "作成するブランチの起点 (省略時は HEAD)"},
+					"force":       {Type: TypeBoolean, Description: "マージされていないブランチも削除するかどうか"},
+				},
+			},
+		}, inRepository(root, gitBranch), false),
+		"git_checkout": typedFunction(&FunctionDeclaration{
+			Name:        "git_checkout",
+			Description: "ブランチを切り替えます。create を指定すると新しいブランチを作成して切り替えます",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"dir":         dirParameter,
+					"branch":      {Type: TypeString, Description: "切り替えるブランチ"},
+					"create":      {Type: TypeBoolean, Description: "ブランチを作成するかどうか (git checkout -b)"},
+					"start_point": {Type: TypeString, Description: "作成するブランチの起点 (省略時は HEAD)"},
+				},
+				Required: []string{"branch"},
+			},
+		}, inRepository(root, gitCheckout), false),
+		"git_stash": typedFunction(&FunctionDeclaration{
+			Name:        "git_stash",
+			Description: "作業中の変更を退避 (stash) したり、退避した変更を戻したりします",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"dir":               dirParameter,
+					"action":            {Type: TypeString, Enum: []string{"push", "pop", "apply", "drop", "list", "show"}, Description: "操作"},
+					"message":           {Type: TypeString, Description: "push するときのメッセージ"},
+					"include_untracked": {Type: TypeBoolean, Description: "push するときに追跡されていないファイルも退避するかどうか"},
+					"index":             {Type: TypeInteger, Description: "pop / apply / drop / show する stash の番号 (省略時は 0)"},
+				},
+				Required: []string{"action"},
+			},
+		}, inRepository(root, gitStash), false),
+		"git_worktree": typedFunction(&FunctionDeclaration{
+			Name: "git_worktree",
+			Description: fmt.Sprintf("ワークスペースの %s/<name> に git worktree を追加・一覧・削除します。", worktreesDir) +
+				"追加した worktree では元のチェックアウトに触れずに作業でき、他の関数には dir や path に返されたパスを指定します",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"action":      {Type: TypeString, Enum: []string{"add", "list", "remove"}, Description: "操作"},
+					"name":        {Type: TypeString, Description: "追加・削除する worktree の名前"},
+					"branch":      {Type: TypeString, Description: "worktree でチェックアウトするブランチ。存在しなければ作成します (省略時は name)"},
+					"start_point": {Type: TypeString, Description: "作成するブランチの起点 (省略時は HEAD)"},
+					"force":       {Type: TypeBoolean, Description: "変更が残っている worktree も削除するかどうか"},
+				},
+				Required: []string{"action"},
+			},
+		}, inRepository(root, gitWorktree), false),
+		"git_blame": typedFunction(&FunctionDeclaration{
+			Name:        "git_blame",
+			Description: "git blame を実行し、各行を最後に変更したコミット・作者・日付を返します",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"dir":        dirParameter,
+					"path":       {Type: TypeString, Description: "対象のファイル"},
+					"start_line": {Type: TypeInteger, Description: "開始行 (1 始まり)"},
+					"end_line":   {Type: TypeInteger, Description: "終了行 (この行を含む)"},
+					"ref":        {Type: TypeString, Description: "この時点のファイルを対象にする (省略時は作業ツリー)"},
+				},
+				Required: []string{"path"},
+			},
+		}, inRepository(root, gitBlame), true),
+	}
+}
+
+// gitRepository runs git in a directory of the workspace.
+type gitRepository struct {
+	workspace string
+	dir       string
+}
+
+// inRepository resolves the "dir" argument before calling handler.
+func inRepository(root string, handler func(ctx context.Context, repo *gitRepository, args map[string]any) map[string]any) FunctionHandler {
+	return func(ctx context.Context, args map[string]any) (map[string]any, error) {
+		subdir, _ := args["dir"].(string)
+		dir, err := workspaceSubdir(root, "dir", subdir)
+		if err != nil {
+			return toolError("%v", err), nil
+		}
+		return handler(ctx, &gitRepository{workspace: root, dir: dir}, args), nil
+	}
+}
+
+// run runs git and returns its stdout. The error includes what git printed to stderr.
+func (g *gitRepository) run(ctx context.Context, args ...string) (string, error) {
+	stdout, _, err := g.output(ctx, args...)
+	return stdout, err
+}
+
+// output runs git and returns what it printed to stdout and stderr.
+func (g *gitRepository) output(ctx context.Context, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("git %s failed: %v\n%s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+// result runs git and returns what it printed in the usual shape, truncated
+// like the output of run_shell. Commands such as git checkout report to stderr.
+func (g *gitRepository) result(ctx context.Context, args ...string) map[string]any {
+	stdout, stderr, err := g.output(ctx, args...)
+	if err != nil {
+		return toolError("%v", err)
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   capOutput(strings.TrimSpace(stdout + stderr)),
+	}
+}
+
+func capOutput(s string) string {
+	b := newHeadTailBuffer(DefaultShellMaxOutput)
+	b.Write([]byte(s))
+	return b.String()
+}
+
+// checkRefs rejects revisions and names that git would take as options.
+func checkRefs(args map[string]any, names ...string) error {
+	for _, name := range names {
+		if v, _ := args[name].(string); strings.HasPrefix(v, "-") {
+			return fmt.Errorf("%s must not start with '-': %s", name, v)
+		}
+	}
+	return nil
+}
+
+func gitLog(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	if err := checkRefs(args, "ref"); err != nil {
+		return toolError("%v", err)
+	}
+	count := intArg(args, "max_count", DefaultGitLogCount)
+	if count <= 0 {
+		count = DefaultGitLogCount
+	}
+	cmdArgs := []string{"log", "--no-color", "--format=%H%x1f%an%x1f%aI%x1f%s", "-n", strconv.Itoa(min(count, maxGitLogCount))}
+	for _, opt := range []string{"since", "author", "grep"} {
+		if v, _ := args[opt].(string); v != "" {
+			cmdArgs = append(cmdArgs, "--"+opt+"="+v)
+		}
+	}
+	if ref, _ := args["ref"].(string); ref != "" {
+		cmdArgs = append(cmdArgs, ref)
+	}
+	cmdArgs = append(cmdArgs, "--")
+	if p, _ := args["path"].(string); p != "" {
+		cmdArgs = append(cmdArgs, p)
+	}
+
+	output, err := g.run(ctx, cmdArgs...)
+	if err != nil {
+		return toolError("%v", err)
+	}
+	var commits []any
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		commits = append(commits, map[string]any{
+			"hash":    fields[0],
+			"author":  fields[1],
+			"date":    fields[2],
+			"subject": fields[3],
+		})
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", fields[0][:min(len(fields[0]), 10)], fields[2], fields[1], fields[3]))
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   strings.Join(lines, "\n"),
+		"commits":  commits,
+	}
+}
+
+func gitShow(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	if err := checkRefs(args, "ref"); err != nil {
+		return toolError("%v", err)
+	}
+	cmdArgs := []string{"show", "--no-color"}
+	if stat, _ := args["stat"].(bool); stat {
+		cmdArgs = append(cmdArgs, "--stat")
+	}
+	cmdArgs = append(cmdArgs, args["ref"].(string), "--")
+	if p, _ := args["path"].(string); p != "" {
+		cmdArgs = append(cmdArgs, p)
+	}
+	return g.result(ctx, cmdArgs...)
+}
+
+func gitBranch(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	if err := checkRefs(args, "name", "start_point"); err != nil {
+		return toolError("%v", err)
+	}
+	name, _ := args["name"].(string)
+	action, _ := args["action"].(string)
+	if action != "" && action != "list" && name == "" {
+		return toolError("name is required to %s a branch", action)
+	}
+
+	switch action {
+	case "create":
+		cmdArgs := []string{"branch", name}
+		if start, _ := args["start_point"].(string); start != "" {
+			cmdArgs = append(cmdArgs, start)
+		}
+		return g.result(ctx, cmdArgs...)
+	case "delete":
+		flag := "-d"
+		if force, _ := args["force"].(bool); force {
+			flag = "-D"
+		}
+		return g.result(ctx, "branch", flag, name)
+	}
+
+	output, err := g.run(ctx, "branch", "--no-color", "--format=%(HEAD)%09%(refname:short)%09%(objectname:short)%09%(upstream:short)")
+	if err != nil {
+		return toolError("%v", err)
+	}
+	var branches []any
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		branch := map[string]any{"name": fields[1], "commit": fields[2], "current": fields[0] == "*"}
+		line := fmt.Sprintf("%s %s %s", fields[0], fields[1], fields[2])
+		if fields[3] != "" {
+			branch["upstream"] = fields[3]
+			line += " [" + fields[3] + "]"
+		}
+		branches = append(branches, branch)
+		lines = append(lines, line)
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   strings.Join(lines, "\n"),
+		"branches": branches,
+	}
+}
+
+func gitCheckout(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	if err := checkRefs(args, "branch", "start_point"); err != nil {
+		return toolError("%v", err)
+	}
+	cmdArgs := []string{"checkout"}
+	if create, _ := args["create"].(bool); create {
+		cmdArgs = append(cmdArgs, "-b")
+	}
+	cmdArgs = append(cmdArgs, args["branch"].(string))
+	if start, _ := args["start_point"].(string); start != "" {
+		cmdArgs = append(cmdArgs, start)
+	}
+	// "--" がないと、ブランチでない名前がファイルとみなされて変更が破棄される
+	cmdArgs = append(cmdArgs, "--")
+	return g.result(ctx, cmdArgs...)
+}
+
+func gitStash(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	action := args["action"].(string)
+	stash := fmt.Sprintf("stash@{%d}", intArg(args, "index", 0))
+
+	switch action {
+	case "push":
+		cmdArgs := []string{"stash", "push"}
+		if untracked, _ := args["include_untracked"].(bool); untracked {
+			cmdArgs = append(cmdArgs, "--include-untracked")
+		}
+		if message, _ := args["message"].(string); message != "" {
+			cmdArgs = append(cmdArgs, "--message", message)
+		}
+		return g.result(ctx, cmdArgs...)
+	case "list":
+		return g.result(ctx, "stash", "list")
+	case "show":
+		return g.result(ctx, "stash", "show", "--no-color", "--patch", stash)
+	}
+	return g.result(ctx, "stash", action, stash)
+}
+
+func gitWorktree(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	if err := checkRefs(args, "branch", "start_point"); err != nil {
+		return toolError("%v", err)
+	}
+	action := args["action"].(string)
+	if action == "list" {
+		return g.result(ctx, "worktree", "list")
+	}
+
+	name, _ := args["name"].(string)
+	if name == "" || strings.HasPrefix(name, "-") || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return toolError("name must be a single path element, got %q", name)
+	}
+	rel := path.Join(worktreesDir, name)
+	dir := filepath.Join(g.workspace, filepath.FromSlash(rel))
+
+	if action == "remove" {
+		cmdArgs := []string{"worktree", "remove"}
+		if force, _ := args["force"].(bool); force {
+			cmdArgs = append(cmdArgs, "--force")
+		}
+		if _, err := g.run(ctx, append(cmdArgs, dir)...); err != nil {
+			return toolError("%v", err)
+		}
+		return map[string]any{"is_error": false, "output": "removed the worktree " + rel, "path": rel}
+	}
+
+	branch, _ := args["branch"].(string)
+	if branch == "" {
+		branch = name
+	}
+	cmdArgs := []string{"worktree", "add"}
+	if _, err := g.run(ctx, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err == nil {
+		cmdArgs = append(cmdArgs, dir, branch)
+	} else {
+		cmdArgs = append(cmdArgs, "-b", branch, dir)
+		if start, _ := args["start_point"].(string); start != "" {
+			cmdArgs = append(cmdArgs, start)
+		}
+	}
+	if err := g.excludeWorktrees(ctx); err != nil {
+		return toolError("%v", err)
+	}
+	if _, err := g.run(ctx, cmdArgs...); err != nil {
+		return toolError("%v", err)
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   fmt.Sprintf("added the worktree %s on the branch %s. Pass dir %q to the git functions and prefix the paths of the file functions with %s/", rel, branch, rel, rel),
+		"path":     rel,
+		"branch":   branch,
+	}
+}
+
+// excludeWorktrees adds the worktrees directory to .git/info/exclude, so
+// that the worktrees do not show up as untracked files of the checkout.
+func (g *gitRepository) excludeWorktrees(ctx context.Context) error {
+	top, err := g.run(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	common, err := g.run(ctx, "rev-parse", "--path-format=absolute", "--git-common-dir")
+	if err != nil {
+		return err
+	}
+	workspace, err := filepath.EvalSymlinks(g.workspace)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(strings.TrimSpace(top), filepath.Join(workspace, worktreesDir))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		// ワークスペースがリポジトリの外にある場合は何もしない
+		return nil
+	}
+
+	pattern := "/" + filepath.ToSlash(rel) + "/"
+	exclude := filepath.Join(strings.TrimSpace(common), "info", "exclude")
+	data, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(exclude, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		pattern = "\n" + pattern
+	}
+	if _, err := f.WriteString(pattern + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func gitBlame(ctx context.Context, g *gitRepository, args map[string]any) map[string]any {
+	if err := checkRefs(args, "ref"); err != nil {
+		return toolError("%v", err)
+	}
+	cmdArgs := []string{"blame", "--line-porcelain"}
+	start, end := intArg(args, "start_line", 0), intArg(args, "end_line", 0)
+	switch {
+	case start > 0 && end > 0:
+		cmdArgs = append(cmdArgs, "-L", fmt.Sprintf("%d,%d", start, end))
+	case start > 0:
+		cmdArgs = append(cmdArgs, "-L", fmt.Sprintf("%d,", start))
+	case end > 0:
+		cmdArgs = append(cmdArgs, "-L", fmt.Sprintf("1,%d", end))
+	}
+	if ref, _ := args["ref"].(string); ref != "" {
+		cmdArgs = append(cmdArgs, ref)
+	}
+	cmdArgs = append(cmdArgs, "--", args["path"].(string))
+
+	output, err := g.run(ctx, cmdArgs...)
+	if err != nil {
+		return toolError("%v", err)
+	}
+
+	var blamed []any
+	var lines []string
+	var entry map[string]any
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case entry == nil:
+			// <commit> <元の行> <行> [<行数>]
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			n, _ := strconv.Atoi(fields[2])
+			entry = map[string]any{"commit": fields[0][:min(len(fields[0]), 10)], "line": n}
+		case strings.HasPrefix(line, "\t"):
+			entry["text"] = line[1:]
+			blamed = append(blamed, entry)
+			if len(blamed) <= maxReadLines {
+				lines = append(lines, fmt.Sprintf("%s (%s %s %d) %s", entry["commit"], entry["author"], entry["date"], entry["line"], entry["text"]))
+			}
+			entry = nil
+		default:
+			key, value, _ := strings.Cut(line, " ")
+			switch key {
+			case "author", "summary":
+				entry[key] = value
+			case "author-time":
+				if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+					entry["date"] = time.Unix(sec, 0).UTC().Format(time.DateOnly)
+				}
+			}
+		}
+	}
+	truncated := len(blamed) > maxReadLines
+	if truncated {
+		blamed = blamed[:maxReadLines]
+		lines = append(lines, fmt.Sprintf("(%d 行を超えたため省略しました。start_line と end_line で範囲を指定してください)", maxReadLines))
+	}
+	return map[string]any{
+		"is_error":  false,
+		"output":    strings.Join(lines, "\n"),
+		"lines":     blamed,
+		"truncated": truncated,
+	}
+}
@@ -0,0 +1,163 @@
+package makasero
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRepository creates a git repository with two commits on main.
+func newTestRepository(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "Alice")
+	t.Setenv("GIT_AUTHOR_EMAIL", "alice@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Alice")
+	t.Setenv("GIT_COMMITTER_EMAIL", "alice@example.com")
+
+	root := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+	git("init", "--quiet", "--initial-branch=main")
+	writeTestFile(t, root, "a.txt", "one\n")
+	git("add", "a.txt")
+	git("commit", "--quiet", "-m", "Add a.txt")
+	writeTestFile(t, root, "a.txt", "one\ntwo\n")
+	git("commit", "--quiet", "-am", "Add the second line")
+	return root
+}
+
+func TestGitLogAndShow(t *testing.T) {
+	root := newTestRepository(t)
+
+	result := callFunction(t, gitFunctions(root), "git_log", map[string]any{"max_count": 1.0})
+	commits := result["commits"].([]any)
+	if len(commits) != 1 {
+		t.Fatalf("expected 1 commit, got %v", commits)
+	}
+	latest := commits[0].(map[string]any)
+	if latest["subject"] != "Add the second line" || latest["author"] != "Alice" {
+		t.Errorf("unexpected commit: %v", latest)
+	}
+
+	result = callFunction(t, gitFunctions(root), "git_show", map[string]any{"ref": latest["hash"], "path": "a.txt"})
+	if !strings.Contains(result["output"].(string), "+two") {
+		t.Errorf("expected the diff of the commit, got %s", result["output"])
+	}
+}
+
+func TestGitFunctionsValidateArguments(t *testing.T) {
+	root := newTestRepository(t)
+
+	for name, args := range map[string]map[string]any{
+		"git_log":      {"max_count": "ten"},
+		"git_show":     {},
+		"git_stash":    {"action": "clear"},
+		"git_checkout": {"branch": "--orphan"},
+	} {
+		result, _ := gitFunctions(root)[name].Handler(context.Background(), args)
+		if result["is_error"] != true {
+			t.Errorf("%s: expected %v to be rejected, got %v", name, args, result)
+		}
+	}
+}
+
+func TestGitBranchCheckoutAndStash(t *testing.T) {
+	root := newTestRepository(t)
+
+	callFunction(t, gitFunctions(root), "git_checkout", map[string]any{"branch": "feature", "create": true})
+	result := callFunction(t, gitFunctions(root), "git_branch", map[string]any{})
+	var current string
+	for _, b := range result["branches"].([]any) {
+		if branch := b.(map[string]any); branch["current"] == true {
+			current = branch["name"].(string)
+		}
+	}
+	if current != "feature" {
+		t.Errorf("expected feature to be checked out, got %q", current)
+	}
+
+	writeTestFile(t, root, "a.txt", "changed\n")
+	callFunction(t, gitFunctions(root), "git_stash", map[string]any{"action": "push", "message": "wip"})
+	if got := readTestFile(t, root, "a.txt"); got != "one\ntwo\n" {
+		t.Errorf("expected the change to be stashed, a.txt is %q", got)
+	}
+	result = callFunction(t, gitFunctions(root), "git_stash", map[string]any{"action": "list"})
+	if !strings.Contains(result["output"].(string), "wip") {
+		t.Errorf("expected the stash in the list, got %q", result["output"])
+	}
+	callFunction(t, gitFunctions(root), "git_stash", map[string]any{"action": "pop"})
+	if got := readTestFile(t, root, "a.txt"); got != "changed\n" {
+		t.Errorf("expected the change to be restored, a.txt is %q", got)
+	}
+
+	callFunction(t, gitFunctions(root), "git_checkout", map[string]any{"branch": "main"})
+	callFunction(t, gitFunctions(root), "git_branch", map[string]any{"action": "delete", "name": "feature"})
+}
+
+func TestGitCheckoutDoesNotRestoreFiles(t *testing.T) {
+	root := newTestRepository(t)
+
+	writeTestFile(t, root, "a.txt", "changed\n")
+	result, _ := gitFunctions(root)["git_checkout"].Handler(context.Background(), map[string]any{"branch": "a.txt"})
+	if result["is_error"] != true {
+		t.Errorf("expected a file name to be rejected as a branch, got %v", result)
+	}
+	if got := readTestFile(t, root, "a.txt"); got != "changed\n" {
+		t.Errorf("expected the change to be kept, a.txt is %q", got)
+	}
+}
+
+func TestGitWorktree(t *testing.T) {
+	root := newTestRepository(t)
+
+	result := callFunction(t, gitFunctions(root), "git_worktree", map[string]any{"action": "add", "name": "fix"})
+	if result["path"] != ".worktrees/fix" || result["branch"] != "fix" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+
+	// worktree で作業しても元のチェックアウトには影響しない
+	writeTestFile(t, root, ".worktrees/fix/a.txt", "fixed\n")
+	callFunction(t, gitFunctions(root), "git_stash", map[string]any{"dir": ".worktrees/fix", "action": "push"})
+	status, err := exec.Command("git", "-C", root, "status", "--porcelain").Output()
+	if err != nil || len(status) != 0 {
+		t.Errorf("expected the checkout to stay clean, got %q (%v)", status, err)
+	}
+
+	result = callFunction(t, gitFunctions(root), "git_worktree", map[string]any{"action": "list"})
+	if !strings.Contains(result["output"].(string), filepath.Join(".worktrees", "fix")) {
+		t.Errorf("expected the worktree in the list, got %q", result["output"])
+	}
+	callFunction(t, gitFunctions(root), "git_worktree", map[string]any{"action": "remove", "name": "fix"})
+
+	if result, _ := gitFunctions(root)["git_worktree"].Handler(context.Background(), map[string]any{"action": "add", "name": "../x"}); result["is_error"] != true {
+		t.Errorf("expected a name with a slash to be rejected, got %v", result)
+	}
+}
+
+func TestGitBlame(t *testing.T) {
+	root := newTestRepository(t)
+
+	result := callFunction(t, gitFunctions(root), "git_blame", map[string]any{"path": "a.txt", "start_line": 2.0})
+	lines := result["lines"].([]any)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %v", lines)
+	}
+	line := lines[0].(map[string]any)
+	if line["line"] != 2 || line["text"] != "two" || line["author"] != "Alice" || line["summary"] != "Add the second line" {
+		t.Errorf("unexpected line: %v", line)
+	}
+}
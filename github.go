@@ -0,0 +1,325 @@
+package makasero
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// githubClient is the part of GitHub the pull request functions use.
+// ghCLI implements it with the gh command.
+type githubClient interface {
+	CreatePullRequest(ctx context.Context, pr *newPullRequest) (string, error)
+	CommentOnIssue(ctx context.Context, repo string, number int, body string) (string, error)
+	ReviewPullRequest(ctx context.Context, repo string, number int, review *pullRequestReview) (string, error)
+	PullRequestChecks(ctx context.Context, repo string, number int) ([]checkRun, error)
+}
+
+type newPullRequest struct {
+	Repo      string
+	Title     string
+	Body      string
+	Base      string
+	Head      string
+	Draft     bool
+	Labels    []string
+	Reviewers []string
+}
+
+// pullRequestReview is the body of the GitHub API that creates a review.
+type pullRequestReview struct {
+	Event    string          `json:"event"` // APPROVE, REQUEST_CHANGES or COMMENT
+	Body     string          `json:"body,omitempty"`
+	Comments []reviewComment `json:"comments,omitempty"`
+}
+
+type reviewComment struct {
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	StartLine int    `json:"start_line,omitempty"` // first line of a multi-line comment
+	Side      string `json:"side,omitempty"`       // RIGHT for the new code, LEFT for deleted lines
+	Body      string `json:"body"`
+}
+
+type checkRun struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Bucket   string `json:"bucket"` // pass, fail, pending, skipping or cancel
+	Workflow string `json:"workflow"`
+	Link     string `json:"link"`
+}
+
+// ghCLI runs gh in dir, so that the repository defaults to the one of the workspace.
+type ghCLI struct {
+	dir string
+}
+
+// run runs gh and returns its stdout. The stdout is also returned with the
+// error, since some commands such as gh pr checks report with the exit code.
+func (c *ghCLI) run(ctx context.Context, stdin []byte, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "gh", args...)
+	cmd.Dir = c.dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("gh %s %s failed: %v\n%s", args[0], args[1], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func withRepo(args []string, repo string) []string {
+	if repo != "" {
+		args = append(args, "--repo", repo)
+	}
+	return args
+}
+
+func (c *ghCLI) CreatePullRequest(ctx context.Context, pr *newPullRequest) (string, error) {
+	args := []string{"pr", "create", "--title", pr.Title, "--body", pr.Body}
+	if pr.Base != "" {
+		args = append(args, "--base", pr.Base)
+	}
+	if pr.Head != "" {
+		args = append(args, "--head", pr.Head)
+	}
+	if pr.Draft {
+		args = append(args, "--draft")
+	}
+	for _, label := range pr.Labels {
+		args = append(args, "--label", label)
+	}
+	for _, reviewer := range pr.Reviewers {
+		args = append(args, "--reviewer", reviewer)
+	}
+	output, err := c.run(ctx, nil, withRepo(args, pr.Repo)...)
+	return strings.TrimSpace(output), err
+}
+
+func (c *ghCLI) CommentOnIssue(ctx context.Context, repo string, number int, body string) (string, error) {
+	output, err := c.run(ctx, nil, withRepo([]string{"issue", "comment", strconv.Itoa(number), "--body", body}, repo)...)
+	return strings.TrimSpace(output), err
+}
+
+func (c *ghCLI) ReviewPullRequest(ctx context.Context, repo string, number int, review *pullRequestReview) (string, error) {
+	if len(review.Comments) == 0 {
+		flag := map[string]string{"APPROVE": "--approve", "REQUEST_CHANGES": "--request-changes", "COMMENT": "--comment"}[review.Event]
+		args := []string{"pr", "review", strconv.Itoa(number), flag}
+		if review.Body != "" {
+			args = append(args, "--body", review.Body)
+		}
+		_, err := c.run(ctx, nil, withRepo(args, repo)...)
+		return fmt.Sprintf("reviewed pull request #%d (%s)", number, review.Event), err
+	}
+
+	// 行へのコメントは gh pr review では付けられないので API を使う。{owner}/{repo} は gh が補う
+	if repo == "" {
+		repo = "{owner}/{repo}"
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return "", err
+	}
+	output, err := c.run(ctx, body, "api", "--method", "POST", fmt.Sprintf("repos/%s/pulls/%d/reviews", repo, number), "--input", "-")
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.Unmarshal([]byte(output), &created); err != nil {
+		return "", fmt.Errorf("failed to parse the created review: %v", err)
+	}
+	return created.HTMLURL, nil
+}
+
+func (c *ghCLI) PullRequestChecks(ctx context.Context, repo string, number int) ([]checkRun, error) {
+	output, err := c.run(ctx, nil, withRepo([]string{"pr", "checks", strconv.Itoa(number), "--json", "name,state,bucket,workflow,link"}, repo)...)
+	var checks []checkRun
+	// 失敗や実行中のチェックがあると gh は 0 以外で終了するが、結果は出力される
+	if jsonErr := json.Unmarshal([]byte(output), &checks); jsonErr != nil {
+		if err == nil {
+			err = fmt.Errorf("failed to parse the checks: %v", jsonErr)
+		}
+		return nil, err
+	}
+	return checks, nil
+}
+
+var repoParameter = &Schema{
+	Type:        TypeString,
+	Description: "リポジトリ名 (例: owner/repo)。指定がない場合は現在のリポジトリとみなされます。",
+}
+
+// githubFunctions returns gh_pr_create, gh_issue_comment, gh_pr_review and gh_pr_checks.
+func githubFunctions(client githubClient) map[string]FunctionDefinition {
+	return map[string]FunctionDefinition{
+		"gh_pr_create": typedFunction(&FunctionDeclaration{
+			Name:        "gh_pr_create",
+			Description: "GitHub Pull Request を作成し、その URL を返します。ブランチは事前に push しておく必要があります。",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"title":     {Type: TypeString, Description: "Pull Request のタイトル"},
+					"body":      {Type: TypeString, Description: "Pull Request の本文"},
+					"base":      {Type: TypeString, Description: "マージ先のブランチ (省略時はデフォルトブランチ)"},
+					"head":      {Type: TypeString, Description: "変更を含むブランチ (省略時は現在のブランチ)"},
+					"draft":     {Type: TypeBoolean, Description: "ドラフトとして作成するかどうか"},
+					"labels":    {Type: TypeArray, Description: "付与するラベル", Items: &Schema{Type: TypeString}},
+					"reviewers": {Type: TypeArray, Description: "レビューを依頼するユーザーまたはチーム", Items: &Schema{Type: TypeString}},
+					"repo":      repoParameter,
+				},
+				Required: []string{"title", "body"},
+			},
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			url, err := client.CreatePullRequest(ctx, &newPullRequest{
+				Repo:      stringArg(args, "repo"),
+				Title:     stringArg(args, "title"),
+				Body:      stringArg(args, "body"),
+				Base:      stringArg(args, "base"),
+				Head:      stringArg(args, "head"),
+				Draft:     args["draft"] == true,
+				Labels:    stringList(args["labels"]),
+				Reviewers: stringList(args["reviewers"]),
+			})
+			if err != nil {
+				return toolError("%v", err), nil
+			}
+			return map[string]any{"is_error": false, "output": url, "url": url}, nil
+		}, false),
+		"gh_issue_comment": typedFunction(&FunctionDeclaration{
+			Name:        "gh_issue_comment",
+			Description: "GitHub の issue または Pull Request にコメントし、コメントの URL を返します。",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"number": {Type: TypeInteger, Description: "issue または Pull Request の番号"},
+					"body":   {Type: TypeString, Description: "コメントの本文"},
+					"repo":   repoParameter,
+				},
+				Required: []string{"number", "body"},
+			},
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			url, err := client.CommentOnIssue(ctx, stringArg(args, "repo"), intArg(args, "number", 0), stringArg(args, "body"))
+			if err != nil {
+				return toolError("%v", err), nil
+			}
+			return map[string]any{"is_error": false, "output": url, "url": url}, nil
+		}, false),
+		"gh_pr_review": typedFunction(&FunctionDeclaration{
+			Name:        "gh_pr_review",
+			Description: "GitHub Pull Request をレビューします。承認・変更の要求・コメントのいずれかと、ファイルの行へのコメントを付けられます。",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"pr_number": {Type: TypeInteger, Description: "レビューする Pull Request の番号"},
+					"event":     {Type: TypeString, Enum: []string{"approve", "request_changes", "comment"}, Description: "レビューの種類"},
+					"body":      {Type: TypeString, Description: "レビュー全体のコメント。request_changes と comment では必須です"},
+					"comments": {
+						Type:        TypeArray,
+						Description: "ファイルの行へのコメント",
+						Items: &Schema{
+							Type: TypeObject,
+							Properties: map[string]*Schema{
+								"path":       {Type: TypeString, Description: "ファイルのパス"},
+								"line":       {Type: TypeInteger, Description: "コメントする行 (差分の新しい側の行番号)"},
+								"start_line": {Type: TypeInteger, Description: "複数行にコメントする場合の開始行"},
+								"side":       {Type: TypeString, Enum: []string{"RIGHT", "LEFT"}, Description: "RIGHT (追加・変更後の行、省略時) または LEFT (削除された行)"},
+								"body":       {Type: TypeString, Description: "コメントの本文"},
+							},
+							Required: []string{"path", "line", "body"},
+						},
+					},
+					"repo": repoParameter,
+				},
+				Required: []string{"pr_number", "event"},
+			},
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			review := &pullRequestReview{
+				Event: strings.ToUpper(stringArg(args, "event")),
+				Body:  stringArg(args, "body"),
+			}
+			if review.Event != "APPROVE" && review.Body == "" {
+				return toolError("body is required to %s", stringArg(args, "event")), nil
+			}
+			comments, _ := args["comments"].([]any)
+			for _, c := range comments {
+				comment := c.(map[string]any)
+				review.Comments = append(review.Comments, reviewComment{
+					Path:      stringArg(comment, "path"),
+					Line:      intArg(comment, "line", 0),
+					StartLine: intArg(comment, "start_line", 0),
+					Side:      stringArg(comment, "side"),
+					Body:      stringArg(comment, "body"),
+				})
+			}
+			output, err := client.ReviewPullRequest(ctx, stringArg(args, "repo"), intArg(args, "pr_number", 0), review)
+			if err != nil {
+				return toolError("%v", err), nil
+			}
+			return map[string]any{"is_error": false, "output": output}, nil
+		}, false),
+		"gh_pr_checks": typedFunction(&FunctionDeclaration{
+			Name:        "gh_pr_checks",
+			Description: "GitHub Pull Request の CI チェックの状態 (成功・失敗・実行中) を返します。",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"pr_number": {Type: TypeInteger, Description: "Pull Request の番号"},
+					"repo":      repoParameter,
+				},
+				Required: []string{"pr_number"},
+			},
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			checks, err := client.PullRequestChecks(ctx, stringArg(args, "repo"), intArg(args, "pr_number", 0))
+			if err != nil {
+				return toolError("%v", err), nil
+			}
+			return checksResult(checks), nil
+		}, true),
+	}
+}
+
+// checksResult summarizes the checks by their bucket, e.g. "2 pass, 1 fail".
+func checksResult(checks []checkRun) map[string]any {
+	counts := map[string]int{}
+	var lines, summary []string
+	var list []any
+	for _, check := range checks {
+		counts[check.Bucket]++
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%s", check.Bucket, check.Name, check.Link))
+		list = append(list, map[string]any{
+			"name":     check.Name,
+			"state":    check.State,
+			"bucket":   check.Bucket,
+			"workflow": check.Workflow,
+			"link":     check.Link,
+		})
+	}
+	for _, bucket := range []string{"pass", "fail", "pending", "skipping", "cancel"} {
+		if counts[bucket] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[bucket], bucket))
+		}
+	}
+	if len(checks) == 0 {
+		summary = append(summary, "no checks")
+	}
+	return map[string]any{
+		"is_error": false,
+		"output":   strings.Join(summary, ", ") + "\n" + strings.Join(lines, "\n"),
+		"checks":   list,
+		"passed":   len(checks) > 0 && counts["pass"]+counts["skipping"] == len(checks),
+	}
+}
+
+func stringArg(args map[string]any, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
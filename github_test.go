@@ -0,0 +1,143 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const fakeGh = `#!/bin/sh
+printf '%s\n' "$@" > "$FAKE_GH_DIR/args"
+cat > "$FAKE_GH_DIR/stdin"
+case "$1 $2" in
+"pr create") echo https://github.com/owner/repo/pull/7 ;;
+"issue comment") echo https://github.com/owner/repo/issues/3#issuecomment-1 ;;
+"pr review") ;;
+"api --method") echo '{"html_url": "https://github.com/owner/repo/pull/7#pullrequestreview-9"}' ;;
+"pr checks")
+  echo '[{"name":"build","state":"SUCCESS","bucket":"pass","workflow":"CI","link":"https://ci/1"},
+         {"name":"lint","state":"FAILURE","bucket":"fail","workflow":"CI","link":"https://ci/2"}]'
+  exit 1 ;;
+*) echo "unexpected command: $*" >&2; exit 2 ;;
+esac
+`
+
+// installFakeGh puts a gh that records its arguments and stdin on PATH.
+// It returns a function that reads the arguments of the last call.
+func installFakeGh(t *testing.T) (args func() []string, stdin func() string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake gh is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "gh"), []byte(fakeGh), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_GH_DIR", dir)
+
+	return func() []string {
+			return strings.Split(strings.TrimSuffix(readTestFile(t, dir, "args"), "\n"), "\n")
+		}, func() string {
+			return readTestFile(t, dir, "stdin")
+		}
+}
+
+func callGitHubFunction(t *testing.T, name string, args map[string]any) map[string]any {
+	t.Helper()
+	result, err := githubFunctions(&ghCLI{dir: t.TempDir()})[name].Handler(context.Background(), args)
+	if err != nil {
+		t.Fatalf("%s failed: %v", name, err)
+	}
+	return result
+}
+
+func TestGhPrCreate(t *testing.T) {
+	args, _ := installFakeGh(t)
+
+	result := callGitHubFunction(t, "gh_pr_create", map[string]any{
+		"title":  "Fix the bug",
+		"body":   "Fixes #3",
+		"base":   "main",
+		"draft":  true,
+		"labels": []any{"bug"},
+	})
+	if result["is_error"] != false || result["url"] != "https://github.com/owner/repo/pull/7" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	want := "pr create --title Fix the bug --body Fixes #3 --base main --draft --label bug"
+	if got := strings.Join(args(), " "); got != want {
+		t.Errorf("got gh %s, want gh %s", got, want)
+	}
+}
+
+func TestGhIssueComment(t *testing.T) {
+	args, _ := installFakeGh(t)
+
+	result := callGitHubFunction(t, "gh_issue_comment", map[string]any{"number": 3.0, "body": "Done", "repo": "owner/repo"})
+	if result["is_error"] != false || !strings.Contains(result["url"].(string), "issuecomment-1") {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if got := strings.Join(args(), " "); got != "issue comment 3 --body Done --repo owner/repo" {
+		t.Errorf("unexpected arguments: gh %s", got)
+	}
+
+	result = callGitHubFunction(t, "gh_issue_comment", map[string]any{"number": "three", "body": "Done"})
+	if result["is_error"] != true {
+		t.Errorf("expected a number of the wrong type to be rejected, got %v", result)
+	}
+}
+
+func TestGhPrReview(t *testing.T) {
+	args, stdin := installFakeGh(t)
+
+	result := callGitHubFunction(t, "gh_pr_review", map[string]any{"pr_number": 7.0, "event": "approve"})
+	if result["is_error"] != false {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if got := strings.Join(args(), " "); got != "pr review 7 --approve" {
+		t.Errorf("unexpected arguments: gh %s", got)
+	}
+
+	result = callGitHubFunction(t, "gh_pr_review", map[string]any{"pr_number": 7.0, "event": "request_changes"})
+	if result["is_error"] != true {
+		t.Errorf("expected request_changes without a body to be rejected, got %v", result)
+	}
+
+	result = callGitHubFunction(t, "gh_pr_review", map[string]any{
+		"pr_number": 7.0,
+		"event":     "request_changes",
+		"body":      "Please fix",
+		"comments":  []any{map[string]any{"path": "main.go", "line": 12.0, "body": "nil check"}},
+	})
+	if result["is_error"] != false || !strings.Contains(result["output"].(string), "pullrequestreview-9") {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if got := strings.Join(args(), " "); got != "api --method POST repos/{owner}/{repo}/pulls/7/reviews --input -" {
+		t.Errorf("unexpected arguments: gh %s", got)
+	}
+	var review pullRequestReview
+	if err := json.Unmarshal([]byte(stdin()), &review); err != nil {
+		t.Fatalf("failed to parse the review: %v", err)
+	}
+	if review.Event != "REQUEST_CHANGES" || len(review.Comments) != 1 || review.Comments[0].Line != 12 || review.Comments[0].Path != "main.go" {
+		t.Errorf("unexpected review: %+v", review)
+	}
+}
+
+func TestGhPrChecks(t *testing.T) {
+	installFakeGh(t)
+
+	// gh pr checks は失敗したチェックがあると 0 以外で終了する
+	result := callGitHubFunction(t, "gh_pr_checks", map[string]any{"pr_number": 7.0})
+	if result["is_error"] != false || result["passed"] != false || len(result["checks"].([]any)) != 2 {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if !strings.HasPrefix(result["output"].(string), "1 pass, 1 fail\n") {
+		t.Errorf("unexpected output: %q", result["output"])
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"os"
 	"strings"
 
-	"github.com/google/generative-ai-go/genai"
 	"github.com/mark3labs/mcp-go/client"
 	"github.com/mark3labs/mcp-go/mcp"
 )
@@ -69,17 +68,17 @@ func (c *MCPClient) GenerateFunctionDefinitions(ctx context.Context, serverIdent
 	for _, tool := range tools.Tools {
 		toolName := tool.Name
 
-		declaration := &genai.FunctionDeclaration{
+		declaration := &FunctionDeclaration{
 			Name:        toolName,
 			Description: tool.Description,
-			Parameters: &genai.Schema{
-				Type:       genai.TypeObject,
+			Parameters: &Schema{
+				Type:       TypeObject,
 				Properties: c.convertMCPParameters(tool.InputSchema),
 			},
 		}
 
 		handler := func(ctx context.Context, args map[string]any) (map[string]any, error) {
-			result, err := c.callMCPTool(toolName, args)
+			result, err := c.callMCPTool(ctx, toolName, args)
 			if err != nil {
 				return nil, fmt.Errorf("error calling tool '%s' on server '%s': %w", toolName, serverIdentifier, err)
 			}
@@ -121,19 +120,19 @@ func (c *MCPClient) OnNotification(handler func(notification mcp.JSONRPCNotifica
 	c.client.OnNotification(handler)
 }
 
-func (c *MCPClient) callMCPTool(toolName string, args map[string]any) (interface{}, error) {
+func (c *MCPClient) callMCPTool(ctx context.Context, toolName string, args map[string]any) (interface{}, error) {
 	req := mcp.CallToolRequest{}
 	req.Params.Name = toolName
 	req.Params.Arguments = args
-	result, err := c.client.CallTool(context.Background(), req)
+	result, err := c.client.CallTool(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to call MCP tool '%s': %w", toolName, err)
 	}
 	return result, nil
 }
 
-func (c *MCPClient) convertMCPParameters(schema mcp.ToolInputSchema) map[string]*genai.Schema {
-	converted := make(map[string]*genai.Schema)
+func (c *MCPClient) convertMCPParameters(schema mcp.ToolInputSchema) map[string]*Schema {
+	converted := make(map[string]*Schema)
 	if schema.Properties == nil {
 		return converted
 	}
@@ -154,7 +153,7 @@ func (c *MCPClient) convertMCPParameters(schema mcp.ToolInputSchema) map[string]
 			description = desc
 		}
 
-		schema := &genai.Schema{
+		schema := &Schema{
 			Type:        c.convertSchemaType(typeVal),
 			Description: description,
 		}
@@ -164,7 +163,7 @@ func (c *MCPClient) convertMCPParameters(schema mcp.ToolInputSchema) map[string]
 				itemType, hasType := items["type"].(string)
 				itemDesc, hasDesc := items["description"].(string)
 				if hasType {
-					schema.Items = &genai.Schema{
+					schema.Items = &Schema{
 						Type: c.convertSchemaType(itemType),
 					}
 					if hasDesc {
@@ -176,13 +175,13 @@ func (c *MCPClient) convertMCPParameters(schema mcp.ToolInputSchema) map[string]
 
 		if typeVal == "object" {
 			if properties, ok := prop["properties"].(map[string]interface{}); ok {
-				schema.Properties = make(map[string]*genai.Schema)
+				schema.Properties = make(map[string]*Schema)
 				for subName, subProp := range properties {
 					if subPropMap, ok := subProp.(map[string]interface{}); ok {
 						subType, hasType := subPropMap["type"].(string)
 						subDesc, hasDesc := subPropMap["description"].(string)
 						if hasType {
-							schema.Properties[subName] = &genai.Schema{
+							schema.Properties[subName] = &Schema{
 								Type: c.convertSchemaType(subType),
 							}
 							if hasDesc {
@@ -208,22 +207,22 @@ func (c *MCPClient) convertMCPParameters(schema mcp.ToolInputSchema) map[string]
 	return converted
 }
 
-func (c *MCPClient) convertSchemaType(schemaType string) genai.Type {
+func (c *MCPClient) convertSchemaType(schemaType string) Type {
 	switch schemaType {
 	case "string":
-		return genai.TypeString
+		return TypeString
 	case "number":
-		return genai.TypeNumber
+		return TypeNumber
 	case "integer":
-		return genai.TypeInteger
+		return TypeInteger
 	case "boolean":
-		return genai.TypeBoolean
+		return TypeBoolean
 	case "array":
-		return genai.TypeArray
+		return TypeArray
 	case "object":
-		return genai.TypeObject
+		return TypeObject
 	default:
-		return genai.TypeString // Default to string
+		return TypeString // Default to string
 	}
 }
 
@@ -8,17 +8,53 @@ import (
 )
 
 type MCPConfig struct {
-	SystemPrompt string                      `json:"systemPrompt,omitempty"`
-	Purpose      string                      `json:"purpose,omitempty"`
-	MCPServers   map[string]MCPServerConfig  `json:"mcpServers"`
+	SystemPrompt     string                     `json:"systemPrompt,omitempty"`
+	Purpose          string                     `json:"purpose,omitempty"`
+	Provider         *ProviderConfig            `json:"provider,omitempty"`
+	Budget           *Budget                    `json:"budget,omitempty"`           // limits of each run
+	Retry            *RetryPolicy               `json:"retry,omitempty"`            // retries of failed requests to the model
+	Compaction       *Compaction                `json:"compaction,omitempty"`       // summarization of long histories
+	Prices           map[string]ModelPrice      `json:"prices,omitempty"`           // by model name, to report the cost of sessions
+	Generation       *GenerationConfig          `json:"generation,omitempty"`       // sampling parameters such as temperature
+	ToolTimeout      Duration                   `json:"toolTimeout,omitempty"`      // limit of each function call, e.g. "2m"
+	MaxParallelTools int                        `json:"maxParallelTools,omitempty"` // concurrent function calls running at once (DefaultMaxParallelTools if 0)
+	Workspace        string                     `json:"workspace,omitempty"`        // directory of the file functions (the current directory if empty)
+	Shell            *ShellPolicy               `json:"shell,omitempty"`            // commands run_shell may run (run_shell is not available if nil)
+	MCPServers       map[string]MCPServerConfig `json:"mcpServers"`
+}
+
+// ProviderConfig selects the LLM provider. Empty fields fall back to
+// provider-specific environment variables (e.g. OPENAI_BASE_URL, OPENAI_API_KEY, OPENAI_MODEL).
+type ProviderConfig struct {
+	Type    string `json:"type,omitempty"` // "gemini" (default), "openai", "anthropic" or "scripted"
+	BaseURL string `json:"baseURL,omitempty"`
+	Model   string `json:"model,omitempty"`
+	APIKey  string `json:"apiKey,omitempty"` // environment variables such as ${OPENAI_API_KEY} are expanded
+	Script  string `json:"script,omitempty"` // script file for the "scripted" provider
+	// FallbackModels are tried in order when the model is unavailable, e.g. rate limited or overloaded
+	FallbackModels []string `json:"fallbackModels,omitempty"`
+}
+
+// ProviderType returns the configured provider type, defaulting to Gemini.
+func (c *ProviderConfig) ProviderType() string {
+	if c == nil || c.Type == "" {
+		return ProviderGemini
+	}
+	return c.Type
 }
 
 type MCPServerConfig struct {
-	Command string            `json:"command"`
-	Args    []string          `json:"args"`
-	Env     map[string]string `json:"env"`
+	Command    string            `json:"command"`
+	Args       []string          `json:"args"`
+	Env        map[string]string `json:"env"`
+	Timeout    Duration          `json:"timeout,omitempty"`    // overrides toolTimeout for the tools of this server
+	Concurrent bool              `json:"concurrent,omitempty"` // the tools have no side effects and may run in parallel
 }
 
+// DefaultMaxParallelTools is the number of concurrency-safe function calls run
+// at the same time when maxParallelTools is not configured.
+const DefaultMaxParallelTools = 4
+
 func LoadMCPConfig(path string) (*MCPConfig, error) {
 	if path == "" {
 		var err error
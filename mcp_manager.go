@@ -7,7 +7,6 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/google/generative-ai-go/genai"
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/pankona/makasero/mlog"
 )
@@ -36,6 +35,7 @@ func (m *MCPClientManager) InitializeFromConfig(ctx context.Context, config *MCP
 
 		initResult, err := client.Initialize(ctx)
 		if err != nil {
+			client.Close(ctx)
 			return fmt.Errorf("failed to initialize MCP client for %s: %v", serverName, err)
 		}
 
@@ -153,7 +153,7 @@ func (m *MCPClientManager) CallMCPTool(ctx context.Context, fullName string, arg
 		return nil, fmt.Errorf("MCP server not found: %s", serverName)
 	}
 
-	result, err := client.callMCPTool(toolName, args)
+	result, err := client.callMCPTool(ctx, toolName, args)
 	if err != nil {
 		return nil, err
 	}
@@ -186,13 +186,13 @@ func (m *MCPClientManager) CallMCPTool(ctx context.Context, fullName string, arg
 	return nil, fmt.Errorf("unexpected result type from callMCPTool: %T", result)
 }
 
-func (m *MCPClientManager) GetFunctionDeclarations() ([]*genai.FunctionDeclaration, error) {
+func (m *MCPClientManager) GetFunctionDeclarations() ([]*FunctionDeclaration, error) {
 	functions, err := m.GenerateAllFunctionDefinitions(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate function definitions: %v", err)
 	}
 
-	declarations := make([]*genai.FunctionDeclaration, 0, len(functions))
+	declarations := make([]*FunctionDeclaration, 0, len(functions))
 	for _, fn := range functions {
 		declarations = append(declarations, fn.Declaration)
 	}
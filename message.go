@@ -0,0 +1,53 @@
+package makasero
+
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Message is a provider-neutral conversation turn.
+type Message struct {
+	Role  string
+	Parts []Part
+}
+
+// Part is a piece of a Message. It is one of Text, FunctionCall or FunctionResponse.
+type Part interface {
+	isPart()
+}
+
+type Text string
+
+// FunctionCall is a tool invocation requested by the model.
+// ID is set by providers that correlate calls and responses (e.g. OpenAI, Anthropic).
+type FunctionCall struct {
+	ID   string
+	Name string
+	Args map[string]any
+}
+
+// FunctionResponse is the result of a FunctionCall sent back to the model.
+type FunctionResponse struct {
+	ID       string
+	Name     string
+	Response map[string]any
+}
+
+func (Text) isPart()             {}
+func (FunctionCall) isPart()     {}
+func (FunctionResponse) isPart() {}
+
+func NewUserMessage(parts ...Part) *Message {
+	return &Message{Role: RoleUser, Parts: parts}
+}
+
+// FunctionCalls returns the function calls contained in the message.
+func (m *Message) FunctionCalls() []FunctionCall {
+	var calls []FunctionCall
+	for _, part := range m.Parts {
+		if fc, ok := part.(FunctionCall); ok {
+			calls = append(calls, fc)
+		}
+	}
+	return calls
+}
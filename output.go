@@ -0,0 +1,176 @@
+package makasero
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+)
+
+// WithOutputSchema asks the agent for a structured result. The parameters of
+// the 'complete' function are replaced by schema, and the arguments of the
+// call that finishes the run are validated against it and returned by Output.
+// The schema is saved in the session and used again when it is resumed.
+func WithOutputSchema(schema *Schema) AgentOption {
+	return func(a *Agent) {
+		a.outputSchema = schema
+	}
+}
+
+// LoadOutputSchema reads a JSON Schema from path. Only the keywords supported
+// by Schema (type, description, enum, items, properties and required) are used.
+func LoadOutputSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output schema: %v", err)
+	}
+
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("failed to parse output schema: %v", err)
+	}
+	if err := ValidateOutputSchema(&schema); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// ValidateOutputSchema checks that schema can be used as the parameters of 'complete'.
+func ValidateOutputSchema(schema *Schema) error {
+	if schema.Type != TypeObject {
+		return fmt.Errorf("the output schema must be of type object, got %q", schema.Type)
+	}
+	return checkSchemaTypes(schema, "result")
+}
+
+// checkSchemaTypes checks s. path names it in the errors, e.g. "result.items[]".
+func checkSchemaTypes(s *Schema, path string) error {
+	switch s.Type {
+	case "", TypeString, TypeNumber, TypeInteger, TypeBoolean, TypeObject:
+	case TypeArray:
+		if s.Items == nil {
+			return fmt.Errorf("%s: array without items", path)
+		}
+		return checkSchemaTypes(s.Items, path+"[]")
+	default:
+		return fmt.Errorf("%s: unsupported type %q", path, s.Type)
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Properties)) {
+		if err := checkSchemaTypes(s.Properties[name], path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func completeFunction(schema *Schema) FunctionDefinition {
+	return FunctionDefinition{
+		Declaration: &FunctionDeclaration{
+			Name:        "complete",
+			Description: "タスク完了を報告し、結果を指定された形式で返します",
+			Parameters:  schema,
+		},
+		Handler: handleComplete,
+	}
+}
+
+// Output returns the result of the last run, validated against the output
+// schema, or nil when no schema is set or the run did not complete.
+func (a *Agent) Output() map[string]any {
+	return a.session.Output
+}
+
+// setOutput validates the arguments of 'complete' and stores them as the result of the run.
+func (a *Agent) setOutput(args map[string]any) error {
+	if a.outputSchema == nil {
+		return nil
+	}
+	if err := a.outputSchema.Validate(args); err != nil {
+		return err
+	}
+	a.session.Output = args
+	return nil
+}
+
+// Validate checks that value, decoded from JSON, conforms to the schema.
+// Properties that are not declared are allowed.
+func (s *Schema) Validate(value any) error {
+	return s.validate(value, "result")
+}
+
+// validate checks value. path names it in the errors, e.g. "result.items[0]".
+func (s *Schema) validate(value any, path string) error {
+	if len(s.Enum) > 0 {
+		if str, ok := value.(string); !ok || !slices.Contains(s.Enum, str) {
+			return fmt.Errorf("%s: must be one of %v, got %v", path, s.Enum, value)
+		}
+	}
+
+	switch s.Type {
+	case TypeString:
+		if _, ok := value.(string); !ok {
+			return typeError(path, s.Type, value)
+		}
+	case TypeNumber:
+		if _, ok := toFloat(value); !ok {
+			return typeError(path, s.Type, value)
+		}
+	case TypeInteger:
+		if f, ok := toFloat(value); !ok || f != math.Trunc(f) {
+			return typeError(path, s.Type, value)
+		}
+	case TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return typeError(path, s.Type, value)
+		}
+	case TypeArray:
+		items, ok := value.([]any)
+		if !ok {
+			return typeError(path, s.Type, value)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case TypeObject:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return typeError(path, s.Type, value)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(s.Properties)) {
+			if v, ok := obj[name]; ok {
+				if err := s.Properties[name].validate(v, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func typeError(path string, want Type, value any) error {
+	return fmt.Errorf("%s: expected %s, got %T", path, want, value)
+}
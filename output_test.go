@@ -0,0 +1,105 @@
+package makasero
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var reviewSchema = &Schema{
+	Type: TypeObject,
+	Properties: map[string]*Schema{
+		"verdict":  {Type: TypeString, Enum: []string{"approve", "request_changes"}},
+		"comments": {Type: TypeArray, Items: &Schema{Type: TypeString}},
+		"score":    {Type: TypeInteger},
+	},
+	Required: []string{"verdict", "score"},
+}
+
+func TestProcessMessageReturnsStructuredOutput(t *testing.T) {
+	isError := true
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"verdict": "lgtm", "score": 5}}}},
+		{
+			ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "complete", IsError: &isError, Contains: "must be one of"}},
+			FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"verdict": "approve", "score": 5, "comments": []any{"nice"}}}},
+		},
+	}}
+	var completed Event
+	agent, provider := newScriptedAgent(t, script, WithOutputSchema(reviewSchema),
+		WithEventHandler(func(e Event) {
+			if e.Type == EventCompleted {
+				completed = e
+			}
+		}))
+
+	if _, err := agent.ProcessMessage(context.Background(), "review the change"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	for _, decl := range provider.Requests()[0].Tools {
+		if decl.Name == "complete" && decl.Parameters != reviewSchema {
+			t.Errorf("expected 'complete' to be declared with the output schema, got %+v", decl.Parameters)
+		}
+	}
+	if output := agent.Output(); output["verdict"] != "approve" {
+		t.Fatalf("expected the validated result, got %v", output)
+	}
+	if completed.Output["verdict"] != "approve" {
+		t.Errorf("expected the result in the completed event, got %+v", completed)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.OutputSchema == nil || saved.Output["verdict"] != "approve" {
+		t.Errorf("expected the schema and the result to be saved, got %+v / %v", saved.OutputSchema, saved.Output)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		value any
+		valid bool
+	}{
+		{map[string]any{"verdict": "approve", "score": float64(3)}, true},
+		{map[string]any{"verdict": "approve", "score": 3.5}, false},
+		{map[string]any{"verdict": "approve"}, false},
+		{map[string]any{"verdict": "approve", "score": 3, "comments": []any{1}}, false},
+		{map[string]any{"verdict": "approve", "score": 3, "extra": true}, true},
+		{"approve", false},
+	}
+	for _, tt := range tests {
+		if err := reviewSchema.Validate(tt.value); (err == nil) != tt.valid {
+			t.Errorf("Validate(%v) = %v; expected valid: %v", tt.value, err, tt.valid)
+		}
+	}
+}
+
+func TestLoadOutputSchema(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "schema.json")
+	if err := os.WriteFile(path, []byte(`{
+  "type": "object",
+  "properties": {"title": {"type": "string"}, "labels": {"type": "array", "items": {"type": "string"}}},
+  "required": ["title"]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LoadOutputSchema(path)
+	if err != nil {
+		t.Fatalf("LoadOutputSchema failed: %v", err)
+	}
+	if schema.Properties["labels"].Items.Type != TypeString || schema.Required[0] != "title" {
+		t.Errorf("unexpected schema: %+v", schema)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"type": "array", "items": {"type": "string"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOutputSchema(path); err == nil {
+		t.Error("expected a non-object schema to be rejected")
+	}
+}
@@ -0,0 +1,179 @@
+package makasero
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	ProviderGemini    = "gemini"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderScripted  = "scripted"
+)
+
+const defaultGeminiModelName = "gemini-2.0-flash-lite"
+
+// Provider abstracts the LLM backend the Agent talks to.
+// Implementations are stateless: the whole conversation is passed on every call.
+type Provider interface {
+	// Name identifies the provider, e.g. "gemini".
+	Name() string
+	// Generate sends the conversation and returns the model's next turn.
+	Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error)
+	Close() error
+}
+
+// StreamingProvider is implemented by providers that can stream the model's output.
+type StreamingProvider interface {
+	Provider
+	// GenerateStream is like Generate but calls onText with text chunks as they arrive.
+	GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error)
+}
+
+type GenerateRequest struct {
+	SystemInstruction string
+	Tools             []*FunctionDeclaration
+	// Messages is the whole conversation. The last element is the turn being sent.
+	Messages []*Message
+	// Config is nil when the provider's defaults are used.
+	Config *GenerationConfig
+}
+
+type GenerateResponse struct {
+	// Message is nil when the model returned no content.
+	Message *Message
+	// Usage is nil when the provider did not report token usage.
+	Usage *Usage
+	// Model is the model that generated the response when it may differ from
+	// the provider's ModelName (see FallbackProvider).
+	Model string
+}
+
+// Usage is the number of tokens consumed by one request.
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	CachedTokens int `json:"cached_tokens,omitempty"` // part of InputTokens read from the provider's cache
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ModelNamer is implemented by providers that know the name of the model they talk to.
+type ModelNamer interface {
+	ModelName() string
+}
+
+// modelNameOf returns the model used by p, or "" when it is unknown.
+func modelNameOf(p Provider) string {
+	if namer, ok := p.(ModelNamer); ok {
+		return namer.ModelName()
+	}
+	return ""
+}
+
+// generateStream streams through p when it supports streaming. Otherwise it
+// falls back to Generate and reports each text part as a single chunk.
+func generateStream(ctx context.Context, p Provider, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	if sp, ok := p.(StreamingProvider); ok {
+		return sp.GenerateStream(ctx, req, onText)
+	}
+
+	resp, err := p.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Message != nil {
+		for _, part := range resp.Message.Parts {
+			if text, ok := part.(Text); ok {
+				onText(string(text))
+			}
+		}
+	}
+	return resp, nil
+}
+
+// APIError is returned by HTTP-based providers for non-2xx responses.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s API returned status %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// NewProviderFromConfig creates the provider selected by cfg. A nil cfg selects Gemini.
+// geminiAPIKey and modelName take precedence over the config and environment
+// variables when they are not empty. When cfg lists fallback models, the
+// provider falls back to them in order (see FallbackProvider).
+func NewProviderFromConfig(ctx context.Context, cfg *ProviderConfig, geminiAPIKey, modelName string) (Provider, error) {
+	if cfg == nil {
+		cfg = &ProviderConfig{}
+	}
+
+	primary, err := newProvider(ctx, cfg, geminiAPIKey, modelName)
+	if err != nil || len(cfg.FallbackModels) == 0 {
+		return primary, err
+	}
+
+	var fallbacks []Provider
+	for _, model := range cfg.FallbackModels {
+		fallback, err := newProvider(ctx, cfg, geminiAPIKey, model)
+		if err != nil {
+			primary.Close()
+			for _, p := range fallbacks {
+				p.Close()
+			}
+			return nil, fmt.Errorf("failed to initialize fallback model %s: %v", model, err)
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+	return NewFallbackProvider(primary, fallbacks...), nil
+}
+
+func newProvider(ctx context.Context, cfg *ProviderConfig, geminiAPIKey, modelName string) (Provider, error) {
+	switch cfg.ProviderType() {
+	case ProviderGemini:
+		apiKey := firstNonEmpty(geminiAPIKey, os.ExpandEnv(cfg.APIKey), os.Getenv("GEMINI_API_KEY"))
+		if apiKey == "" {
+			return nil, fmt.Errorf("GEMINI_API_KEY environment variable is not set")
+		}
+		return NewGeminiProvider(ctx, apiKey, firstNonEmpty(modelName, cfg.Model, defaultGeminiModelName))
+	case ProviderOpenAI:
+		return NewOpenAIProvider(
+			firstNonEmpty(cfg.BaseURL, os.Getenv("OPENAI_BASE_URL")),
+			firstNonEmpty(os.ExpandEnv(cfg.APIKey), os.Getenv("OPENAI_API_KEY")),
+			firstNonEmpty(modelName, cfg.Model, os.Getenv("OPENAI_MODEL")),
+		)
+	case ProviderAnthropic:
+		return NewAnthropicProvider(
+			firstNonEmpty(cfg.BaseURL, os.Getenv("ANTHROPIC_BASE_URL")),
+			firstNonEmpty(os.ExpandEnv(cfg.APIKey), os.Getenv("ANTHROPIC_API_KEY")),
+			firstNonEmpty(modelName, cfg.Model, os.Getenv("ANTHROPIC_MODEL")),
+		)
+	case ProviderScripted:
+		if cfg.Script == "" {
+			return nil, fmt.Errorf("script is required for the scripted provider")
+		}
+		script, err := LoadScript(cfg.Script)
+		if err != nil {
+			return nil, err
+		}
+		return NewScriptedProvider(script), nil
+	default:
+		return nil, fmt.Errorf("unknown provider type: %s", cfg.Type)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,436 @@
+package makasero
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pankona/makasero/mlog"
+)
+
+const (
+	defaultAnthropicBaseURL   = "https://api.anthropic.com"
+	anthropicAPIVersion       = "2023-06-01"
+	defaultAnthropicMaxTokens = 4096
+)
+
+// AnthropicProvider drives Claude models through the Anthropic Messages API.
+type AnthropicProvider struct {
+	baseURL    string
+	apiKey     string
+	modelName  string
+	httpClient *http.Client
+}
+
+func NewAnthropicProvider(baseURL, apiKey, modelName string) (*AnthropicProvider, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY environment variable is not set")
+	}
+	if modelName == "" {
+		return nil, fmt.Errorf("model name is required for the anthropic provider")
+	}
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+
+	return &AnthropicProvider{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		modelName:  modelName,
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+func (p *AnthropicProvider) Name() string {
+	return ProviderAnthropic
+}
+
+func (p *AnthropicProvider) ModelName() string {
+	return p.modelName
+}
+
+func (p *AnthropicProvider) Close() error {
+	return nil
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+	Stream    bool               `json:"stream,omitempty"`
+	// sampling parameters (see GenerationConfig)
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"top_p,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block of type "text", "tool_use" or "tool_result".
+type anthropicBlock struct {
+	Type string `json:"type"`
+
+	Text string `json:"text,omitempty"`
+
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	InputSchema *Schema `json:"input_schema"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// toUsage counts cache reads and writes as input, which input_tokens excludes.
+func (u anthropicUsage) toUsage() *Usage {
+	input := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+	return &Usage{
+		InputTokens:  input,
+		CachedTokens: u.CacheReadInputTokens,
+		OutputTokens: u.OutputTokens,
+		TotalTokens:  input + u.OutputTokens,
+	}
+}
+
+func (p *AnthropicProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	httpResp, err := p.post(ctx, p.newRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	mlog.Debugf(ctx, "🔍 Debug received anthropic response:\n%s", string(respBody))
+
+	var messageResp anthropicResponse
+	if err := json.Unmarshal(respBody, &messageResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	return &GenerateResponse{
+		Message: fromAnthropicBlocks(ctx, messageResp.Content),
+		Usage:   messageResp.Usage.toUsage(),
+	}, nil
+}
+
+type anthropicStreamEvent struct {
+	Type         string         `json:"type"`
+	Index        int            `json:"index"`
+	ContentBlock anthropicBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+	// Message is set on message_start, Usage on message_delta.
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+func (p *AnthropicProvider) GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	messageReq := p.newRequest(req)
+	messageReq.Stream = true
+
+	httpResp, err := p.post(ctx, messageReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var blocks []anthropicBlock
+	var inputs []strings.Builder
+	var usage anthropicUsage
+
+	err = readServerSentEvents(httpResp.Body, func(_, data string) error {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("failed to parse stream event: %v", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage = event.Message.Usage
+		case "message_delta":
+			usage.OutputTokens = event.Usage.OutputTokens
+		case "content_block_start":
+			for len(blocks) <= event.Index {
+				blocks = append(blocks, anthropicBlock{})
+				inputs = append(inputs, strings.Builder{})
+			}
+			blocks[event.Index] = event.ContentBlock
+			if event.ContentBlock.Text != "" {
+				onText(event.ContentBlock.Text)
+			}
+		case "content_block_delta":
+			if event.Index >= len(blocks) {
+				return fmt.Errorf("delta for unknown content block %d", event.Index)
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				blocks[event.Index].Text += event.Delta.Text
+				onText(event.Delta.Text)
+			case "input_json_delta":
+				inputs[event.Index].WriteString(event.Delta.PartialJSON)
+			}
+		case "error":
+			if event.Error != nil {
+				return &APIError{Provider: ProviderAnthropic, StatusCode: anthropicErrorStatus(event.Error.Type), Body: data}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range blocks {
+		if blocks[i].Type == "tool_use" && inputs[i].Len() > 0 {
+			blocks[i].Input = json.RawMessage(inputs[i].String())
+		}
+	}
+
+	mlog.Debugf(ctx, "🔍 Debug received anthropic stream:\n%s", string(mustMarshalIndent(blocks)))
+
+	return &GenerateResponse{
+		Message: fromAnthropicBlocks(ctx, blocks),
+		Usage:   usage.toUsage(),
+	}, nil
+}
+
+// post sends a Messages API request and returns the response when the status
+// is 2xx. The caller must close the body.
+func (p *AnthropicProvider) post(ctx context.Context, messageReq *anthropicRequest) (*http.Response, error) {
+	body, err := json.Marshal(messageReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.apiKey)
+	httpReq.Header.Set("anthropic-version", anthropicAPIVersion)
+
+	httpResp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode/100 != 2 {
+		defer httpResp.Body.Close()
+		respBody, _ := io.ReadAll(httpResp.Body)
+		return nil, &APIError{
+			Provider:   ProviderAnthropic,
+			StatusCode: httpResp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After")),
+		}
+	}
+
+	return httpResp, nil
+}
+
+// anthropicErrorStatus maps the type of an error event in a stream to the
+// HTTP status the API uses for the same error.
+func anthropicErrorStatus(errorType string) int {
+	switch errorType {
+	case "overloaded_error":
+		return statusOverloaded
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "api_error":
+		return http.StatusInternalServerError
+	default:
+		return 0
+	}
+}
+
+func (p *AnthropicProvider) newRequest(req *GenerateRequest) *anthropicRequest {
+	messageReq := &anthropicRequest{
+		Model:     p.modelName,
+		MaxTokens: defaultAnthropicMaxTokens,
+		System:    req.SystemInstruction,
+		Messages:  toAnthropicMessages(req.Messages),
+	}
+
+	for _, decl := range req.Tools {
+		params := decl.Parameters
+		if params == nil {
+			params = &Schema{Type: TypeObject, Properties: map[string]*Schema{}}
+		}
+		messageReq.Tools = append(messageReq.Tools, anthropicTool{
+			Name:        decl.Name,
+			Description: decl.Description,
+			InputSchema: params,
+		})
+	}
+
+	// the Messages API always returns a single candidate
+	if c := req.Config; c != nil {
+		messageReq.Temperature = c.Temperature
+		messageReq.TopP = c.TopP
+		messageReq.TopK = c.TopK
+		messageReq.StopSequences = c.StopSequences
+		if c.MaxOutputTokens > 0 {
+			messageReq.MaxTokens = c.MaxOutputTokens
+		}
+	}
+
+	return messageReq
+}
+
+// toAnthropicMessages converts the history into Messages API turns.
+// Consecutive turns of the same role are merged, and every tool_use block is
+// answered by a tool_result at the start of the following user turn, with a
+// synthetic result for calls that have none (e.g. 'complete').
+func toAnthropicMessages(messages []*Message) []anthropicMessage {
+	var converted []anthropicMessage
+	var pending []FunctionCall
+
+	appendBlocks := func(role string, blocks ...anthropicBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(converted); n > 0 && converted[n-1].Role == role {
+			converted[n-1].Content = append(converted[n-1].Content, blocks...)
+			return
+		}
+		converted = append(converted, anthropicMessage{Role: role, Content: blocks})
+	}
+	flushPending := func() {
+		for _, call := range pending {
+			appendBlocks("user", anthropicBlock{
+				Type:      "tool_result",
+				ToolUseID: call.ID,
+				Content:   `{"output":"no result was recorded for this call"}`,
+			})
+		}
+		pending = nil
+	}
+
+	for i, msg := range messages {
+		if msg.Role == RoleModel {
+			flushPending()
+
+			var blocks []anthropicBlock
+			for j, part := range msg.Parts {
+				switch p := part.(type) {
+				case Text:
+					if p != "" {
+						blocks = append(blocks, anthropicBlock{Type: "text", Text: string(p)})
+					}
+				case FunctionCall:
+					if p.ID == "" {
+						p.ID = fmt.Sprintf("toolu_%d_%d", i, j)
+					}
+					pending = append(pending, p)
+					blocks = append(blocks, anthropicBlock{
+						Type:  "tool_use",
+						ID:    p.ID,
+						Name:  p.Name,
+						Input: mustMarshalObject(p.Args),
+					})
+				}
+			}
+			appendBlocks("assistant", blocks...)
+			continue
+		}
+
+		var results, texts []anthropicBlock
+		for _, part := range msg.Parts {
+			switch p := part.(type) {
+			case Text:
+				texts = append(texts, anthropicBlock{Type: "text", Text: string(p)})
+			case FunctionResponse:
+				id := p.ID
+				for k, call := range pending {
+					if (id != "" && call.ID == id) || (id == "" && call.Name == p.Name) {
+						id = call.ID
+						pending = append(pending[:k], pending[k+1:]...)
+						break
+					}
+				}
+				isError, _ := p.Response["is_error"].(bool)
+				results = append(results, anthropicBlock{
+					Type:      "tool_result",
+					ToolUseID: id,
+					Content:   string(mustMarshalObject(p.Response)),
+					IsError:   isError,
+				})
+			}
+		}
+		appendBlocks("user", results...)
+		if len(texts) > 0 {
+			flushPending()
+			appendBlocks("user", texts...)
+		}
+	}
+
+	return converted
+}
+
+func fromAnthropicBlocks(ctx context.Context, blocks []anthropicBlock) *Message {
+	msg := &Message{Role: RoleModel}
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			msg.Parts = append(msg.Parts, Text(block.Text))
+		case "tool_use":
+			var args map[string]any
+			if len(block.Input) > 0 {
+				if err := json.Unmarshal(block.Input, &args); err != nil {
+					mlog.Warnf(ctx, "Failed to parse input of %s: %v", block.Name, err)
+				}
+			}
+			msg.Parts = append(msg.Parts, FunctionCall{
+				ID:   block.ID,
+				Name: block.Name,
+				Args: args,
+			})
+		default:
+			mlog.Warnf(ctx, "Unknown content block type: %s", block.Type)
+		}
+	}
+	return msg
+}
@@ -0,0 +1,178 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnthropicProviderGenerate(t *testing.T) {
+	var got anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("x-api-key") != "secret" || r.Header.Get("anthropic-version") == "" {
+			http.Error(w, "missing headers", http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{
+  "content": [
+    {"type": "text", "text": "checking"},
+    {"type": "tool_use", "id": "toolu_01", "name": "git_status", "input": {"path_to_status": "."}}
+  ],
+  "stop_reason": "tool_use"
+}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewAnthropicProvider(server.URL, "secret", "claude-test")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	resp, err := provider.Generate(context.Background(), &GenerateRequest{
+		SystemInstruction: "be helpful",
+		Tools:             []*FunctionDeclaration{builtinFunctions["git_status"].Declaration},
+		Messages: []*Message{
+			NewUserMessage(Text("first")),
+			{Role: RoleModel, Parts: []Part{FunctionCall{ID: "toolu_00", Name: "git_diff", Args: map[string]any{"path_to_diff": "."}}}},
+			NewUserMessage(FunctionResponse{ID: "toolu_00", Name: "git_diff", Response: map[string]any{"is_error": true, "output": "failed"}}),
+			NewUserMessage(Text("continue")),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	want := &Message{
+		Role: RoleModel,
+		Parts: []Part{
+			Text("checking"),
+			FunctionCall{ID: "toolu_01", Name: "git_status", Args: map[string]any{"path_to_status": "."}},
+		},
+	}
+	if string(mustMarshalIndent(resp.Message)) != string(mustMarshalIndent(want)) {
+		t.Errorf("unexpected message:\n%s", mustMarshalIndent(resp.Message))
+	}
+
+	if got.System != "be helpful" || got.Model != "claude-test" || got.MaxTokens == 0 {
+		t.Errorf("unexpected request header fields: %+v", got)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Name != "git_status" || got.Tools[0].InputSchema.Type != TypeObject {
+		t.Errorf("unexpected tools: %+v", got.Tools)
+	}
+
+	// the function response and the follow-up text are merged into one user turn
+	if len(got.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d: %+v", len(got.Messages), got.Messages)
+	}
+	last := got.Messages[2]
+	if last.Role != "user" || len(last.Content) != 2 {
+		t.Fatalf("unexpected last message: %+v", last)
+	}
+	if result := last.Content[0]; result.Type != "tool_result" || result.ToolUseID != "toolu_00" || !result.IsError {
+		t.Errorf("unexpected tool_result: %+v", result)
+	}
+	if text := last.Content[1]; text.Type != "text" || text.Text != "continue" {
+		t.Errorf("unexpected text block: %+v", text)
+	}
+}
+
+func TestNewAgentResumesWithSessionProvider(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "secret")
+	t.Setenv("ANTHROPIC_MODEL", "claude-test")
+
+	session := &Session{ID: "anthropic-session", Provider: ProviderAnthropic, ProviderConfig: &ProviderConfig{Type: ProviderAnthropic}}
+	agent, err := NewAgent(context.Background(), "gemini-key", &MCPConfig{}, WithSession(session), WithSessionDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	defer agent.Close()
+
+	if name := agent.provider.Name(); name != ProviderAnthropic {
+		t.Errorf("expected provider %s, got %s", ProviderAnthropic, name)
+	}
+}
+
+func TestAnthropicProviderGenerateStream(t *testing.T) {
+	var got anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`event: message_start
+data: {"type":"message_start","message":{"content":[],"usage":{"input_tokens":20,"output_tokens":1,"cache_read_input_tokens":100}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ing"}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_01","name":"git_status","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"path_to_status\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":" \".\"}"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`))
+	}))
+	defer server.Close()
+
+	provider, err := NewAnthropicProvider(server.URL, "secret", "claude-test")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	var chunks []string
+	resp, err := provider.GenerateStream(context.Background(), &GenerateRequest{
+		Messages: []*Message{NewUserMessage(Text("status please"))},
+	}, func(chunk string) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil {
+		t.Fatalf("GenerateStream failed: %v", err)
+	}
+
+	if !got.Stream {
+		t.Errorf("expected stream=true in the request")
+	}
+	if len(chunks) != 2 || chunks[0] != "check" || chunks[1] != "ing" {
+		t.Errorf("unexpected chunks: %q", chunks)
+	}
+	if len(resp.Message.Parts) != 2 {
+		t.Fatalf("expected text and function call, got %+v", resp.Message.Parts)
+	}
+	if text, ok := resp.Message.Parts[0].(Text); !ok || text != "checking" {
+		t.Errorf("unexpected text part: %#v", resp.Message.Parts[0])
+	}
+	call, ok := resp.Message.Parts[1].(FunctionCall)
+	if !ok || call.ID != "toolu_01" || call.Args["path_to_status"] != "." {
+		t.Errorf("unexpected function call: %#v", resp.Message.Parts[1])
+	}
+	if resp.Usage == nil || resp.Usage.InputTokens != 120 || resp.Usage.CachedTokens != 100 || resp.Usage.OutputTokens != 9 || resp.Usage.TotalTokens != 129 {
+		t.Errorf("unexpected usage: %+v", resp.Usage)
+	}
+}
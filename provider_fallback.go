@@ -0,0 +1,93 @@
+package makasero
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/pankona/makasero/mlog"
+)
+
+// FallbackProvider sends each request to the first of its providers and falls
+// back to the next one when the model is unavailable (see shouldFallback).
+// The model that served the request is set in GenerateResponse.Model.
+//
+// A streamed request does not fall back once the model has sent text, since
+// the answer of the next model would follow the partial one. The error is
+// returned instead, and the agent retries the request (see EventRetry).
+type FallbackProvider struct {
+	providers []Provider
+}
+
+// NewFallbackProvider creates a FallbackProvider. The first provider is the
+// primary one; the others are tried in order.
+func NewFallbackProvider(primary Provider, fallbacks ...Provider) *FallbackProvider {
+	return &FallbackProvider{providers: append([]Provider{primary}, fallbacks...)}
+}
+
+func (p *FallbackProvider) Name() string {
+	return p.providers[0].Name()
+}
+
+func (p *FallbackProvider) ModelName() string {
+	return modelNameOf(p.providers[0])
+}
+
+func (p *FallbackProvider) Close() error {
+	var errs []error
+	for _, provider := range p.providers {
+		errs = append(errs, provider.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (p *FallbackProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	return p.generate(ctx, nil, func(provider Provider) (*GenerateResponse, error) {
+		return provider.Generate(ctx, req)
+	})
+}
+
+func (p *FallbackProvider) GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	streamed := false
+	return p.generate(ctx, &streamed, func(provider Provider) (*GenerateResponse, error) {
+		return generateStream(ctx, provider, req, func(chunk string) {
+			streamed = true
+			onText(chunk)
+		})
+	})
+}
+
+// generate sends the request with send until a provider succeeds. When
+// streamed is set, it tells whether text of the failed request was sent.
+func (p *FallbackProvider) generate(ctx context.Context, streamed *bool, send func(Provider) (*GenerateResponse, error)) (*GenerateResponse, error) {
+	var err error
+	for i, provider := range p.providers {
+		if i > 0 {
+			mlog.Warnf(ctx, "Model %s failed, falling back to %s: %v", modelNameOf(p.providers[i-1]), modelNameOf(provider), err)
+		}
+
+		var resp *GenerateResponse
+		resp, err = send(provider)
+		if err == nil {
+			if resp.Model == "" {
+				resp.Model = modelNameOf(provider)
+			}
+			return resp, nil
+		}
+		if !shouldFallback(err) || ctx.Err() != nil || (streamed != nil && *streamed) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// shouldFallback reports whether another model may succeed where err occurred:
+// the model is overloaded, rate limited or does not exist.
+func shouldFallback(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	transient, _ := isTransient(err)
+	return transient
+}
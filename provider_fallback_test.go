@@ -0,0 +1,116 @@
+package makasero
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFallbackProviderFallsBackWhenUnavailable(t *testing.T) {
+	overloaded := &APIError{Provider: ProviderScripted, StatusCode: statusOverloaded}
+	primary := &namedProvider{Provider: &flakyProvider{Provider: NewScriptedProvider(completeScript()), failures: 1, err: overloaded}, model: "primary"}
+	fallback := &namedProvider{Provider: NewScriptedProvider(completeScript()), model: "fallback"}
+	provider := NewFallbackProvider(primary, fallback)
+
+	resp, err := provider.Generate(context.Background(), &GenerateRequest{Messages: []*Message{NewUserMessage(Text("hello"))}})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if resp.Model != "fallback" {
+		t.Errorf("expected the fallback model to serve the request, got %q", resp.Model)
+	}
+	if provider.ModelName() != "primary" {
+		t.Errorf("expected the primary model name, got %q", provider.ModelName())
+	}
+}
+
+func TestFallbackProviderKeepsOtherErrors(t *testing.T) {
+	badRequest := &APIError{Provider: ProviderScripted, StatusCode: http.StatusBadRequest}
+	primary := &flakyProvider{Provider: NewScriptedProvider(completeScript()), failures: 1, err: badRequest}
+	fallback := NewScriptedProvider(completeScript())
+
+	_, err := NewFallbackProvider(primary, fallback).Generate(context.Background(), &GenerateRequest{Messages: []*Message{NewUserMessage(Text("hello"))}})
+	if err != badRequest {
+		t.Fatalf("expected the error of the primary model, got %v", err)
+	}
+	if fallback.Remaining() != 1 {
+		t.Error("expected the fallback model not to be used")
+	}
+}
+
+func TestProcessMessageRecordsFallbackModel(t *testing.T) {
+	rateLimited := &APIError{Provider: ProviderScripted, StatusCode: http.StatusTooManyRequests}
+	fallback := &namedProvider{Provider: NewScriptedProvider(completeScript()), model: "fallback"}
+	agent, _ := newScriptedAgent(t, &Script{}, WithProviderWrapper(func(p Provider) Provider {
+		primary := &namedProvider{Provider: &flakyProvider{Provider: p, failures: 1, err: rateLimited}, model: "primary"}
+		return NewFallbackProvider(primary, fallback)
+	}))
+
+	if _, err := agent.ProcessMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	session := agent.GetSession()
+	if session.Model != "primary" {
+		t.Errorf("expected the session to be pinned to the primary model, got %q", session.Model)
+	}
+	if len(session.Usage) != 1 || session.Usage[0].Model != "fallback" {
+		t.Errorf("expected the turn to be served by the fallback model, got %+v", session.Usage)
+	}
+}
+
+func TestNewAgentResumesWithSavedProviderConfig(t *testing.T) {
+	scriptPath := filepath.Join("testdata", "scripts", "git_status_complete.json")
+	sessionDir := t.TempDir()
+	agent, err := NewAgent(context.Background(), "", &MCPConfig{Provider: &ProviderConfig{Type: ProviderScripted, Script: scriptPath, APIKey: "secret"}}, WithSessionDir(sessionDir))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	session := agent.GetSession()
+	agent.Close()
+	if saved := session.ProviderConfig; saved == nil || saved.Script != scriptPath || saved.APIKey != "" {
+		t.Fatalf("expected the provider settings without the API key to be saved, got %+v", saved)
+	}
+
+	// 設定ファイルのプロバイダが変わっても、保存した設定で再開する
+	resumed, err := NewAgent(context.Background(), "", &MCPConfig{Provider: &ProviderConfig{Type: ProviderOpenAI}}, WithSession(session), WithSessionDir(sessionDir))
+	if err != nil {
+		t.Fatalf("failed to resume the session: %v", err)
+	}
+	resumed.Close()
+
+	session.ProviderConfig = nil
+	if _, err := NewAgent(context.Background(), "", &MCPConfig{Provider: &ProviderConfig{Type: ProviderOpenAI}}, WithSession(session), WithSessionDir(sessionDir)); err == nil || !strings.Contains(err.Error(), "configure the scripted provider") {
+		t.Errorf("expected resuming without the saved settings to be refused, got %v", err)
+	}
+}
+
+// partialStreamProvider streams some text and then fails.
+type partialStreamProvider struct {
+	Provider
+	err error
+}
+
+func (p *partialStreamProvider) GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	onText("partial")
+	return nil, p.err
+}
+
+func TestFallbackProviderDoesNotFallBackAfterStreaming(t *testing.T) {
+	overloaded := &APIError{Provider: ProviderScripted, StatusCode: statusOverloaded}
+	fallback := NewScriptedProvider(completeScript())
+	provider := NewFallbackProvider(&partialStreamProvider{Provider: NewScriptedProvider(completeScript()), err: overloaded}, fallback)
+
+	var streamed []string
+	_, err := provider.GenerateStream(context.Background(), &GenerateRequest{Messages: []*Message{NewUserMessage(Text("hello"))}}, func(chunk string) {
+		streamed = append(streamed, chunk)
+	})
+	if err != overloaded {
+		t.Fatalf("expected the error of the primary model to be returned for a retry, got %v", err)
+	}
+	if fallback.Remaining() != 1 || len(streamed) != 1 {
+		t.Errorf("expected the fallback model not to stream after the partial text, got %v", streamed)
+	}
+}
@@ -0,0 +1,332 @@
+package makasero
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/pankona/makasero/mlog"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+)
+
+// GeminiProvider talks to Google Gemini through the generative-ai-go client.
+type GeminiProvider struct {
+	client    *genai.Client
+	modelName string
+}
+
+func NewGeminiProvider(ctx context.Context, apiKey, modelName string) (*GeminiProvider, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("API key is required")
+	}
+
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize client: %v", err)
+	}
+
+	return &GeminiProvider{
+		client:    client,
+		modelName: modelName,
+	}, nil
+}
+
+func (p *GeminiProvider) Name() string {
+	return ProviderGemini
+}
+
+func (p *GeminiProvider) ModelName() string {
+	return p.modelName
+}
+
+func (p *GeminiProvider) Close() error {
+	return p.client.Close()
+}
+
+func (p *GeminiProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("no messages to send")
+	}
+
+	chat := p.newModel(req).StartChat()
+	last := len(req.Messages) - 1
+	chat.History = toGeminiContents(req.Messages[:last])
+
+	resp, err := chat.SendMessage(ctx, toGeminiParts(req.Messages[last].Parts)...)
+	if err != nil {
+		return nil, fromGeminiError(err)
+	}
+
+	mlog.Debugf(ctx, "🔍 Debug received gemini response:\n%s", string(mustMarshalIndent(resp)))
+
+	return fromGeminiResponse(ctx, resp), nil
+}
+
+func (p *GeminiProvider) GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("no messages to send")
+	}
+
+	chat := p.newModel(req).StartChat()
+	last := len(req.Messages) - 1
+	chat.History = toGeminiContents(req.Messages[:last])
+
+	iter := chat.SendMessageStream(ctx, toGeminiParts(req.Messages[last].Parts)...)
+	// MergedResponse does not carry the usage, which comes with the last chunk
+	var usage *genai.UsageMetadata
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fromGeminiError(err)
+		}
+		if resp.UsageMetadata != nil {
+			usage = resp.UsageMetadata
+		}
+
+		for _, cand := range resp.Candidates {
+			if cand.Content == nil {
+				continue
+			}
+			for _, part := range cand.Content.Parts {
+				if text, ok := part.(genai.Text); ok {
+					onText(string(text))
+				}
+			}
+		}
+	}
+
+	merged := iter.MergedResponse()
+	if merged == nil {
+		return &GenerateResponse{}, nil
+	}
+	merged.UsageMetadata = usage
+
+	mlog.Debugf(ctx, "🔍 Debug received gemini response:\n%s", string(mustMarshalIndent(merged)))
+
+	return fromGeminiResponse(ctx, merged), nil
+}
+
+// fromGeminiError converts errors of the Gemini API into APIError so that the
+// agent can tell rate limits and outages from other failures.
+func fromGeminiError(err error) error {
+	apiErr, ok := apierror.FromError(err)
+	if !ok {
+		return err
+	}
+
+	status := apiErr.HTTPCode()
+	if status <= 0 {
+		switch apiErr.GRPCStatus().Code() {
+		case codes.ResourceExhausted:
+			status = http.StatusTooManyRequests
+		case codes.Unavailable:
+			status = http.StatusServiceUnavailable
+		case codes.DeadlineExceeded:
+			status = http.StatusGatewayTimeout
+		case codes.Internal:
+			status = http.StatusInternalServerError
+		default:
+			status = http.StatusBadRequest
+		}
+	}
+
+	var retryAfter time.Duration
+	if info := apiErr.Details().RetryInfo; info != nil && info.GetRetryDelay() != nil {
+		retryAfter = info.GetRetryDelay().AsDuration()
+	}
+
+	return &APIError{
+		Provider:   ProviderGemini,
+		StatusCode: status,
+		Body:       apiErr.Error(),
+		RetryAfter: retryAfter,
+	}
+}
+
+func (p *GeminiProvider) newModel(req *GenerateRequest) *genai.GenerativeModel {
+	model := p.client.GenerativeModel(p.modelName)
+
+	if req.SystemInstruction != "" {
+		model.SystemInstruction = &genai.Content{
+			Parts: []genai.Part{
+				genai.Text(req.SystemInstruction),
+			},
+		}
+	}
+
+	if len(req.Tools) > 0 {
+		decls := make([]*genai.FunctionDeclaration, 0, len(req.Tools))
+		for _, decl := range req.Tools {
+			decls = append(decls, &genai.FunctionDeclaration{
+				Name:        decl.Name,
+				Description: decl.Description,
+				Parameters:  toGeminiSchema(decl.Parameters),
+			})
+		}
+		model.Tools = []*genai.Tool{
+			{
+				FunctionDeclarations: decls,
+			},
+		}
+		model.ToolConfig = &genai.ToolConfig{
+			FunctionCallingConfig: &genai.FunctionCallingConfig{
+				Mode: genai.FunctionCallingAuto,
+			},
+		}
+	}
+
+	if c := req.Config; c != nil {
+		model.Temperature = c.Temperature
+		model.TopP = c.TopP
+		if c.TopK != nil {
+			model.SetTopK(int32(*c.TopK))
+		}
+		if c.MaxOutputTokens > 0 {
+			model.SetMaxOutputTokens(int32(c.MaxOutputTokens))
+		}
+		if c.CandidateCount > 0 {
+			model.SetCandidateCount(int32(c.CandidateCount))
+		}
+		model.StopSequences = c.StopSequences
+		for _, category := range slices.Sorted(maps.Keys(c.SafetySettings)) {
+			model.SafetySettings = append(model.SafetySettings, &genai.SafetySetting{
+				Category:  geminiHarmCategories[category],
+				Threshold: geminiHarmThresholds[c.SafetySettings[category]],
+			})
+		}
+	}
+
+	return model
+}
+
+var geminiHarmCategories = map[string]genai.HarmCategory{
+	"harassment":        genai.HarmCategoryHarassment,
+	"hate_speech":       genai.HarmCategoryHateSpeech,
+	"sexually_explicit": genai.HarmCategorySexuallyExplicit,
+	"dangerous_content": genai.HarmCategoryDangerousContent,
+}
+
+var geminiHarmThresholds = map[string]genai.HarmBlockThreshold{
+	"block_none":             genai.HarmBlockNone,
+	"block_only_high":        genai.HarmBlockOnlyHigh,
+	"block_medium_and_above": genai.HarmBlockMediumAndAbove,
+	"block_low_and_above":    genai.HarmBlockLowAndAbove,
+}
+
+func toGeminiContents(messages []*Message) []*genai.Content {
+	contents := make([]*genai.Content, 0, len(messages))
+	for _, msg := range messages {
+		contents = append(contents, &genai.Content{
+			Role:  msg.Role,
+			Parts: toGeminiParts(msg.Parts),
+		})
+	}
+	return contents
+}
+
+func toGeminiParts(parts []Part) []genai.Part {
+	converted := make([]genai.Part, 0, len(parts))
+	for _, part := range parts {
+		switch p := part.(type) {
+		case Text:
+			converted = append(converted, genai.Text(p))
+		case FunctionCall:
+			converted = append(converted, genai.FunctionCall{
+				Name: p.Name,
+				Args: p.Args,
+			})
+		case FunctionResponse:
+			converted = append(converted, genai.FunctionResponse{
+				Name:     p.Name,
+				Response: p.Response,
+			})
+		}
+	}
+	return converted
+}
+
+func fromGeminiResponse(ctx context.Context, resp *genai.GenerateContentResponse) *GenerateResponse {
+	var usage *Usage
+	if resp.UsageMetadata != nil {
+		usage = &Usage{
+			InputTokens:  int(resp.UsageMetadata.PromptTokenCount),
+			CachedTokens: int(resp.UsageMetadata.CachedContentTokenCount),
+			OutputTokens: int(resp.UsageMetadata.CandidatesTokenCount),
+			TotalTokens:  int(resp.UsageMetadata.TotalTokenCount),
+		}
+	}
+
+	for _, cand := range resp.Candidates {
+		if cand.Content == nil {
+			continue
+		}
+
+		msg := &Message{Role: RoleModel}
+		for _, part := range cand.Content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				msg.Parts = append(msg.Parts, Text(p))
+			case genai.FunctionCall:
+				msg.Parts = append(msg.Parts, FunctionCall{
+					Name: p.Name,
+					Args: p.Args,
+				})
+			default:
+				mlog.Warnf(ctx, "Unknown response type: %T", part)
+			}
+		}
+		return &GenerateResponse{Message: msg, Usage: usage}
+	}
+
+	return &GenerateResponse{Usage: usage}
+}
+
+func toGeminiSchema(s *Schema) *genai.Schema {
+	if s == nil {
+		return nil
+	}
+
+	converted := &genai.Schema{
+		Type:        toGeminiType(s.Type),
+		Description: s.Description,
+		Enum:        s.Enum,
+		Items:       toGeminiSchema(s.Items),
+		Required:    s.Required,
+	}
+	if s.Properties != nil {
+		converted.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for name, prop := range s.Properties {
+			converted.Properties[name] = toGeminiSchema(prop)
+		}
+	}
+	return converted
+}
+
+func toGeminiType(t Type) genai.Type {
+	switch t {
+	case TypeString:
+		return genai.TypeString
+	case TypeNumber:
+		return genai.TypeNumber
+	case TypeInteger:
+		return genai.TypeInteger
+	case TypeBoolean:
+		return genai.TypeBoolean
+	case TypeArray:
+		return genai.TypeArray
+	case TypeObject:
+		return genai.TypeObject
+	default:
+		return genai.TypeUnspecified
+	}
+}
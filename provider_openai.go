@@ -0,0 +1,445 @@
+package makasero
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pankona/makasero/mlog"
+)
+
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// OpenAIProvider talks to any server implementing the OpenAI Chat Completions
+// tool-calling protocol, such as OpenAI itself, llama.cpp, vLLM or Ollama.
+type OpenAIProvider struct {
+	baseURL    string
+	apiKey     string
+	modelName  string
+	httpClient *http.Client
+}
+
+// NewOpenAIProvider creates a provider for baseURL, which includes the API
+// version prefix (e.g. "http://localhost:8080/v1"). apiKey may be empty for
+// local servers that do not require authentication.
+func NewOpenAIProvider(baseURL, apiKey, modelName string) (*OpenAIProvider, error) {
+	if modelName == "" {
+		return nil, fmt.Errorf("model name is required for the openai provider")
+	}
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+
+	return &OpenAIProvider{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		modelName:  modelName,
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+func (p *OpenAIProvider) Name() string {
+	return ProviderOpenAI
+}
+
+func (p *OpenAIProvider) ModelName() string {
+	return p.modelName
+}
+
+func (p *OpenAIProvider) Close() error {
+	return nil
+}
+
+type openAIChatRequest struct {
+	Model      string          `json:"model"`
+	Messages   []openAIMessage `json:"messages"`
+	Tools      []openAITool    `json:"tools,omitempty"`
+	ToolChoice string          `json:"tool_choice,omitempty"`
+	Stream     bool            `json:"stream,omitempty"`
+	// sampling parameters (see GenerationConfig)
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	N           int      `json:"n,omitempty"`
+	// StreamOptions asks for a final chunk with the token usage when streaming.
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details,omitempty"`
+}
+
+func (u *openAIUsage) toUsage() *Usage {
+	if u == nil {
+		return nil
+	}
+	usage := &Usage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+	if u.PromptTokensDetails != nil {
+		usage.CachedTokens = u.PromptTokensDetails.CachedTokens
+	}
+	return usage
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    *string          `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIToolFunction `json:"function"`
+}
+
+type openAIToolFunction struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Parameters  *Schema `json:"parameters"`
+}
+
+type openAIToolCall struct {
+	ID       string             `json:"id"`
+	Type     string             `json:"type"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+func (p *OpenAIProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	httpResp, err := p.post(ctx, p.newChatRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	mlog.Debugf(ctx, "🔍 Debug received openai response:\n%s", string(respBody))
+
+	var chatResp openAIChatResponse
+	if err := json.Unmarshal(respBody, &chatResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return &GenerateResponse{Usage: chatResp.Usage.toUsage()}, nil
+	}
+
+	return &GenerateResponse{
+		Message: fromOpenAIMessage(ctx, chatResp.Choices[0].Message),
+		Usage:   chatResp.Usage.toUsage(),
+	}, nil
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   *string `json:"content"`
+			ToolCalls []struct {
+				Index    int                `json:"index"`
+				ID       string             `json:"id"`
+				Function openAIFunctionCall `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+func (p *OpenAIProvider) GenerateStream(ctx context.Context, req *GenerateRequest, onText func(chunk string)) (*GenerateResponse, error) {
+	chatReq := p.newChatRequest(req)
+	chatReq.Stream = true
+	chatReq.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+
+	httpResp, err := p.post(ctx, chatReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var content strings.Builder
+	var toolCalls []openAIToolCall
+	var usage *Usage
+	received := false
+
+	err = readServerSentEvents(httpResp.Body, func(_, data string) error {
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("failed to parse stream chunk: %v", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.toUsage()
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+		received = true
+
+		delta := chunk.Choices[0].Delta
+		if delta.Content != nil && *delta.Content != "" {
+			content.WriteString(*delta.Content)
+			onText(*delta.Content)
+		}
+		for _, tc := range delta.ToolCalls {
+			for len(toolCalls) <= tc.Index {
+				toolCalls = append(toolCalls, openAIToolCall{Type: "function"})
+			}
+			if tc.ID != "" {
+				toolCalls[tc.Index].ID = tc.ID
+			}
+			toolCalls[tc.Index].Function.Name += tc.Function.Name
+			toolCalls[tc.Index].Function.Arguments += tc.Function.Arguments
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !received {
+		return &GenerateResponse{Usage: usage}, nil
+	}
+
+	return &GenerateResponse{
+		Message: fromOpenAIMessage(ctx, openAIMessage{
+			Role:      "assistant",
+			Content:   stringPtr(content.String()),
+			ToolCalls: toolCalls,
+		}),
+		Usage: usage,
+	}, nil
+}
+
+// post sends a chat completion request and returns the response when the
+// status is 2xx. The caller must close the body.
+func (p *OpenAIProvider) post(ctx context.Context, chatReq *openAIChatRequest) (*http.Response, error) {
+	body, err := json.Marshal(chatReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	httpResp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode/100 != 2 {
+		defer httpResp.Body.Close()
+		respBody, _ := io.ReadAll(httpResp.Body)
+		return nil, &APIError{
+			Provider:   ProviderOpenAI,
+			StatusCode: httpResp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After")),
+		}
+	}
+
+	return httpResp, nil
+}
+
+func (p *OpenAIProvider) newChatRequest(req *GenerateRequest) *openAIChatRequest {
+	chatReq := &openAIChatRequest{
+		Model:    p.modelName,
+		Messages: toOpenAIMessages(req.SystemInstruction, req.Messages),
+	}
+
+	for _, decl := range req.Tools {
+		params := decl.Parameters
+		if params == nil {
+			params = &Schema{Type: TypeObject, Properties: map[string]*Schema{}}
+		}
+		chatReq.Tools = append(chatReq.Tools, openAITool{
+			Type: "function",
+			Function: openAIToolFunction{
+				Name:        decl.Name,
+				Description: decl.Description,
+				Parameters:  params,
+			},
+		})
+	}
+	if len(chatReq.Tools) > 0 {
+		chatReq.ToolChoice = "auto"
+	}
+
+	// top_k is not part of the Chat Completions API
+	if c := req.Config; c != nil {
+		chatReq.Temperature = c.Temperature
+		chatReq.TopP = c.TopP
+		chatReq.MaxTokens = c.MaxOutputTokens
+		chatReq.Stop = c.StopSequences
+		chatReq.N = c.CandidateCount
+	}
+
+	return chatReq
+}
+
+// toOpenAIMessages converts the history into Chat Completions messages.
+// Every assistant tool call must be answered by a "tool" message before the
+// next non-tool message, so calls without a recorded response (e.g. 'complete'
+// or histories created by providers without call IDs) get a synthetic one.
+func toOpenAIMessages(systemInstruction string, messages []*Message) []openAIMessage {
+	var converted []openAIMessage
+	if systemInstruction != "" {
+		converted = append(converted, openAIMessage{Role: "system", Content: &systemInstruction})
+	}
+
+	var pending []FunctionCall
+	flushPending := func() {
+		for _, call := range pending {
+			converted = append(converted, openAIMessage{
+				Role:       "tool",
+				Content:    stringPtr(`{"output":"no result was recorded for this call"}`),
+				ToolCallID: call.ID,
+			})
+		}
+		pending = nil
+	}
+
+	for i, msg := range messages {
+		var texts []string
+
+		if msg.Role == RoleModel {
+			flushPending()
+
+			assistant := openAIMessage{Role: "assistant"}
+			for j, part := range msg.Parts {
+				switch p := part.(type) {
+				case Text:
+					texts = append(texts, string(p))
+				case FunctionCall:
+					if p.ID == "" {
+						p.ID = fmt.Sprintf("call_%d_%d", i, j)
+					}
+					pending = append(pending, p)
+					assistant.ToolCalls = append(assistant.ToolCalls, openAIToolCall{
+						ID:   p.ID,
+						Type: "function",
+						Function: openAIFunctionCall{
+							Name:      p.Name,
+							Arguments: string(mustMarshalObject(p.Args)),
+						},
+					})
+				}
+			}
+			if len(texts) > 0 {
+				assistant.Content = stringPtr(strings.Join(texts, "\n"))
+			}
+			converted = append(converted, assistant)
+			continue
+		}
+
+		for _, part := range msg.Parts {
+			switch p := part.(type) {
+			case Text:
+				texts = append(texts, string(p))
+			case FunctionResponse:
+				id := p.ID
+				for k, call := range pending {
+					if (id != "" && call.ID == id) || (id == "" && call.Name == p.Name) {
+						id = call.ID
+						pending = append(pending[:k], pending[k+1:]...)
+						break
+					}
+				}
+				converted = append(converted, openAIMessage{
+					Role:       "tool",
+					Content:    stringPtr(string(mustMarshalObject(p.Response))),
+					ToolCallID: id,
+				})
+			}
+		}
+		if len(texts) > 0 {
+			flushPending()
+			converted = append(converted, openAIMessage{
+				Role:    "user",
+				Content: stringPtr(strings.Join(texts, "\n")),
+			})
+		}
+	}
+
+	return converted
+}
+
+func fromOpenAIMessage(ctx context.Context, m openAIMessage) *Message {
+	msg := &Message{Role: RoleModel}
+	if m.Content != nil && *m.Content != "" {
+		msg.Parts = append(msg.Parts, Text(*m.Content))
+	}
+
+	for _, call := range m.ToolCalls {
+		var args map[string]any
+		if call.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				mlog.Warnf(ctx, "Failed to parse arguments of %s: %v", call.Function.Name, err)
+			}
+		}
+		msg.Parts = append(msg.Parts, FunctionCall{
+			ID:   call.ID,
+			Name: call.Function.Name,
+			Args: args,
+		})
+	}
+
+	return msg
+}
+
+// mustMarshalObject marshals m, encoding nil as an empty object.
+func mustMarshalObject(m map[string]any) []byte {
+	if m == nil {
+		return []byte("{}")
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal JSON: %v", err))
+	}
+	return buf
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
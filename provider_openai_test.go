@@ -0,0 +1,230 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newOpenAITestServer starts a Chat Completions stand-in that replies with
+// responses in order and records the decoded requests.
+func newOpenAITestServer(t *testing.T, responses ...string) (*httptest.Server, func() []map[string]any) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(requests) >= len(responses) {
+			http.Error(w, "no more responses", http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[len(requests)-1]))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestOpenAIProviderGenerate(t *testing.T) {
+	server, requests := newOpenAITestServer(t, `{
+  "choices": [{
+    "message": {
+      "role": "assistant",
+      "content": "let me check",
+      "tool_calls": [{"id": "call_abc", "type": "function", "function": {"name": "git_status", "arguments": "{\"path_to_status\":\".\"}"}}]
+    },
+    "finish_reason": "tool_calls"
+  }]
+}`)
+
+	provider, err := NewOpenAIProvider(server.URL+"/v1", "secret", "local-model")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	resp, err := provider.Generate(context.Background(), &GenerateRequest{
+		SystemInstruction: "be helpful",
+		Tools:             []*FunctionDeclaration{builtinFunctions["git_status"].Declaration},
+		Messages: []*Message{
+			NewUserMessage(Text("first")),
+			{Role: RoleModel, Parts: []Part{FunctionCall{Name: "git_diff", Args: map[string]any{"path_to_diff": "."}}}},
+			NewUserMessage(FunctionResponse{Name: "git_diff", Response: map[string]any{"output": "diff"}}),
+			{Role: RoleModel, Parts: []Part{FunctionCall{Name: "complete", Args: map[string]any{"message": "done"}}}},
+			NewUserMessage(Text("second")),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	want := &Message{
+		Role: RoleModel,
+		Parts: []Part{
+			Text("let me check"),
+			FunctionCall{ID: "call_abc", Name: "git_status", Args: map[string]any{"path_to_status": "."}},
+		},
+	}
+	if got := mustMarshalIndent(resp.Message); string(got) != string(mustMarshalIndent(want)) {
+		t.Errorf("unexpected message:\n%s", got)
+	}
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	req := reqs[0]
+	if req["model"] != "local-model" {
+		t.Errorf("unexpected model: %v", req["model"])
+	}
+
+	tools := req["tools"].([]any)
+	fn := tools[0].(map[string]any)["function"].(map[string]any)
+	if fn["name"] != "git_status" || fn["parameters"].(map[string]any)["type"] != "object" {
+		t.Errorf("unexpected tool: %v", fn)
+	}
+
+	var roles []string
+	for _, m := range req["messages"].([]any) {
+		roles = append(roles, m.(map[string]any)["role"].(string))
+	}
+	// the dangling 'complete' call gets a synthetic tool message
+	wantRoles := []string{"system", "user", "assistant", "tool", "assistant", "tool", "user"}
+	if string(mustMarshalIndent(roles)) != string(mustMarshalIndent(wantRoles)) {
+		t.Errorf("unexpected roles: %v", roles)
+	}
+
+	messages := req["messages"].([]any)
+	callID := messages[2].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)["id"]
+	if got := messages[3].(map[string]any)["tool_call_id"]; got != callID {
+		t.Errorf("tool response id %v does not match call id %v", got, callID)
+	}
+}
+
+func TestOpenAIProviderAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"overloaded"}`, http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	provider, err := NewOpenAIProvider(server.URL, "", "local-model")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	_, err = provider.Generate(context.Background(), &GenerateRequest{Messages: []*Message{NewUserMessage(Text("hi"))}})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected APIError with status 503, got %v", err)
+	}
+}
+
+func TestAgentWithOpenAIProvider(t *testing.T) {
+	server, requests := newOpenAITestServer(t,
+		`{"choices":[{"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"unknown_tool","arguments":"{}"}}]}}]}`,
+		`{"choices":[{"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_2","type":"function","function":{"name":"complete","arguments":"{\"message\":\"done\"}"}}]}}]}`,
+	)
+
+	config := &MCPConfig{
+		Provider: &ProviderConfig{Type: ProviderOpenAI, BaseURL: server.URL + "/v1", Model: "local-model"},
+	}
+	agent, err := NewAgent(context.Background(), "", config, WithSessionDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	defer agent.Close()
+
+	if _, err := agent.ProcessMessage(context.Background(), "do something"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(reqs))
+	}
+	messages := reqs[1]["messages"].([]any)
+	toolMsg := messages[len(messages)-1].(map[string]any)
+	if toolMsg["role"] != "tool" || toolMsg["tool_call_id"] != "call_1" {
+		t.Errorf("unexpected tool message: %v", toolMsg)
+	}
+
+	if !agent.SessionExists(agent.GetSession().ID) {
+		t.Errorf("session was not saved")
+	}
+}
+
+func TestOpenAIProviderGenerateStream(t *testing.T) {
+	server, requests := newOpenAITestServer(t, `data: {"choices":[{"delta":{"role":"assistant","content":"let "}}]}
+
+data: {"choices":[{"delta":{"content":"me check"}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_abc","type":"function","function":{"name":"git_status","arguments":"{\"path_"}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"to_status\":\".\"}"}}]}}]}
+
+data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}
+
+data: {"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":5,"total_tokens":17}}
+
+data: [DONE]
+
+`)
+
+	provider, err := NewOpenAIProvider(server.URL+"/v1", "secret", "local-model")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	var chunks []string
+	resp, err := provider.GenerateStream(context.Background(), &GenerateRequest{
+		Messages: []*Message{NewUserMessage(Text("status please"))},
+	}, func(chunk string) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil {
+		t.Fatalf("GenerateStream failed: %v", err)
+	}
+
+	if stream, _ := requests()[0]["stream"].(bool); !stream {
+		t.Errorf("expected stream=true in the request, got %v", requests()[0]["stream"])
+	}
+	if len(chunks) != 2 || chunks[0] != "let " || chunks[1] != "me check" {
+		t.Errorf("unexpected chunks: %q", chunks)
+	}
+
+	if len(resp.Message.Parts) != 2 {
+		t.Fatalf("expected text and function call, got %+v", resp.Message.Parts)
+	}
+	if text, ok := resp.Message.Parts[0].(Text); !ok || text != "let me check" {
+		t.Errorf("unexpected text part: %#v", resp.Message.Parts[0])
+	}
+	call, ok := resp.Message.Parts[1].(FunctionCall)
+	if !ok || call.ID != "call_abc" || call.Name != "git_status" || call.Args["path_to_status"] != "." {
+		t.Errorf("unexpected function call: %#v", resp.Message.Parts[1])
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 17 {
+		t.Errorf("unexpected usage: %+v", resp.Usage)
+	}
+}
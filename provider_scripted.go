@@ -0,0 +1,175 @@
+package makasero
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Script is a list of canned model turns for ScriptedProvider.
+//
+//	{
+//	  "turns": [
+//	    {"function_calls": [{"name": "git_status", "args": {"path_to_status": "."}}]},
+//	    {
+//	      "expect_function_responses": [{"name": "git_status", "is_error": false}],
+//	      "function_calls": [{"name": "complete", "args": {"message": "done"}}]
+//	    }
+//	  ]
+//	}
+type Script struct {
+	Turns []ScriptTurn `json:"turns"`
+}
+
+// ScriptTurn is one model turn. The expectations are checked against the last
+// message of the request before the turn is returned.
+type ScriptTurn struct {
+	ExpectText              string                      `json:"expect_text,omitempty"` // substring of the user text
+	ExpectFunctionResponses []ScriptResponseExpectation `json:"expect_function_responses,omitempty"`
+
+	Text          string               `json:"text,omitempty"`
+	FunctionCalls []ScriptFunctionCall `json:"function_calls,omitempty"`
+	Usage         *Usage               `json:"usage,omitempty"` // reported token usage
+}
+
+type ScriptFunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// ScriptResponseExpectation asserts on a function response sent back to the model.
+type ScriptResponseExpectation struct {
+	Name     string `json:"name"`
+	IsError  *bool  `json:"is_error,omitempty"`
+	Contains string `json:"contains,omitempty"` // substring of the JSON-encoded response
+}
+
+// ScriptedProvider replays a Script deterministically without network access.
+// It is meant for offline end-to-end tests of the agent loop.
+type ScriptedProvider struct {
+	mu       sync.Mutex
+	script   *Script
+	next     int
+	requests []*GenerateRequest
+}
+
+func NewScriptedProvider(script *Script) *ScriptedProvider {
+	return &ScriptedProvider{script: script}
+}
+
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script file: %v", err)
+	}
+
+	var script Script
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("failed to parse script file: %v", err)
+	}
+	return &script, nil
+}
+
+func (p *ScriptedProvider) Name() string {
+	return ProviderScripted
+}
+
+func (p *ScriptedProvider) Close() error {
+	return nil
+}
+
+func (p *ScriptedProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.requests = append(p.requests, req)
+
+	if p.next >= len(p.script.Turns) {
+		return nil, fmt.Errorf("script exhausted: no turn left for request %d", p.next+1)
+	}
+	turnIndex := p.next
+	turn := p.script.Turns[turnIndex]
+	p.next++
+
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("script turn %d: no messages in request", turnIndex+1)
+	}
+	if err := turn.check(req.Messages[len(req.Messages)-1]); err != nil {
+		return nil, fmt.Errorf("script turn %d: %v", turnIndex+1, err)
+	}
+
+	msg := &Message{Role: RoleModel}
+	if turn.Text != "" {
+		msg.Parts = append(msg.Parts, Text(turn.Text))
+	}
+	for i, call := range turn.FunctionCalls {
+		msg.Parts = append(msg.Parts, FunctionCall{
+			ID:   fmt.Sprintf("call_%d_%d", turnIndex, i),
+			Name: call.Name,
+			Args: call.Args,
+		})
+	}
+	return &GenerateResponse{Message: msg, Usage: turn.Usage}, nil
+}
+
+// Remaining returns the number of turns not consumed yet.
+func (p *ScriptedProvider) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.script.Turns) - p.next
+}
+
+// Requests returns the requests received so far.
+func (p *ScriptedProvider) Requests() []*GenerateRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*GenerateRequest(nil), p.requests...)
+}
+
+func (t *ScriptTurn) check(last *Message) error {
+	if t.ExpectText != "" {
+		var texts []string
+		for _, part := range last.Parts {
+			if text, ok := part.(Text); ok {
+				texts = append(texts, string(text))
+			}
+		}
+		if !strings.Contains(strings.Join(texts, "\n"), t.ExpectText) {
+			return fmt.Errorf("expected user text containing %q, got %q", t.ExpectText, strings.Join(texts, "\n"))
+		}
+	}
+
+	var responses []FunctionResponse
+	for _, part := range last.Parts {
+		if resp, ok := part.(FunctionResponse); ok {
+			responses = append(responses, resp)
+		}
+	}
+	if len(t.ExpectFunctionResponses) > 0 && len(responses) != len(t.ExpectFunctionResponses) {
+		return fmt.Errorf("expected %d function responses, got %d", len(t.ExpectFunctionResponses), len(responses))
+	}
+
+	for i, expect := range t.ExpectFunctionResponses {
+		resp := responses[i]
+		if resp.Name != expect.Name {
+			return fmt.Errorf("function response %d: expected %s, got %s", i, expect.Name, resp.Name)
+		}
+		if expect.IsError != nil {
+			isError, _ := resp.Response["is_error"].(bool)
+			if isError != *expect.IsError {
+				return fmt.Errorf("function response %d (%s): expected is_error=%v, got %v: %v", i, resp.Name, *expect.IsError, isError, resp.Response)
+			}
+		}
+		if expect.Contains != "" {
+			encoded := string(mustMarshalObject(resp.Response))
+			if !strings.Contains(encoded, expect.Contains) {
+				return fmt.Errorf("function response %d (%s): expected to contain %q, got %s", i, resp.Name, expect.Contains, encoded)
+			}
+		}
+	}
+
+	return nil
+}
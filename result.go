@@ -0,0 +1,66 @@
+package makasero
+
+// Outcome tells how a run of the agent ended.
+type Outcome string
+
+const (
+	OutcomeCompleted      Outcome = "completed"       // the model called 'complete'
+	OutcomeQuestion       Outcome = "question"        // the model called 'ask_question' and waits for an answer
+	OutcomeStopped        Outcome = "stopped"         // the model returned nothing, without completing
+	OutcomeBudgetExceeded Outcome = "budget_exceeded" // a limit of the budget was reached
+	OutcomeInterrupted    Outcome = "interrupted"     // the context was canceled
+	OutcomeFailed         Outcome = "failed"          // any other error
+)
+
+// Result is the outcome of ProcessMessage and Resume. It is returned along
+// with the error when the run fails.
+type Result struct {
+	Outcome Outcome `json:"outcome"`
+	// Message is the message of 'complete' (OutcomeCompleted).
+	Message string `json:"message,omitempty"`
+	// Output is the structured result of 'complete' (see WithOutputSchema).
+	Output map[string]any `json:"output,omitempty"`
+	// Question and Options are the arguments of 'ask_question' (OutcomeQuestion).
+	// The answer is given with Agent.Answer.
+	Question string   `json:"question,omitempty"`
+	Options  []string `json:"options,omitempty"`
+	// Usage totals the requests of this run.
+	Usage SessionUsage `json:"usage"`
+	// History is the messages added to the session by this run. A user turn
+	// that was not sent by the previous run is included.
+	History []*Message `json:"-"`
+}
+
+// newRunResult records where the run starts in the session, so that finish
+// can collect what it added.
+func (a *Agent) newRunResult() (*Result, func()) {
+	result := &Result{}
+	history, usage := len(a.session.History), len(a.session.Usage)
+	if history > 0 && a.session.History[history-1].Role == RoleUser {
+		// 前回送られなかったユーザーのターンにはこの実行のメッセージがまとめられる
+		history--
+	}
+	return result, func() {
+		result.History = append([]*Message(nil), a.session.History[history:]...)
+		var total Session
+		for _, turn := range a.session.Usage[usage:] {
+			total.addUsage(turn)
+		}
+		if total.TotalUsage != nil {
+			result.Usage = *total.TotalUsage
+		}
+	}
+}
+
+// outcomeOf maps the status of a finished run to its outcome.
+func outcomeOf(status string) Outcome {
+	switch status {
+	case SessionStatusBudgetExceeded:
+		return OutcomeBudgetExceeded
+	case SessionStatusInterrupted:
+		return OutcomeInterrupted
+	case SessionStatusFailed:
+		return OutcomeFailed
+	}
+	return OutcomeStopped
+}
@@ -0,0 +1,121 @@
+package makasero
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestProcessMessageReturnsCompletedResult(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{
+			FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}},
+			Usage:         &Usage{InputTokens: 100, OutputTokens: 10, TotalTokens: 110},
+		},
+		{
+			FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "clean"}}},
+			Usage:         &Usage{InputTokens: 200, OutputTokens: 20, TotalTokens: 220},
+		},
+	}}
+	agent, _ := newScriptedAgent(t, script)
+
+	result, err := agent.ProcessMessage(context.Background(), "status")
+	if err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if result.Outcome != OutcomeCompleted || result.Message != "clean" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if result.Usage.Requests != 2 || result.Usage.InputTokens != 300 || result.Usage.OutputTokens != 30 {
+		t.Errorf("unexpected usage: %+v", result.Usage)
+	}
+	// user, model (git_status), user (result), model (complete)
+	if len(result.History) != 4 || result.History[0].Role != RoleUser {
+		t.Errorf("expected the 4 messages of the run, got %d", len(result.History))
+	}
+}
+
+func TestProcessMessageReturnsQuestion(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "ask_question", Args: map[string]any{
+			"question": "which branch?",
+			"options":  []any{"main", "develop"},
+		}}}},
+		{
+			ExpectText:    "develop",
+			FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+		},
+	}}
+	agent, provider := newScriptedAgent(t, script)
+
+	result, err := agent.ProcessMessage(context.Background(), "merge it")
+	if err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if result.Outcome != OutcomeQuestion || result.Question != "which branch?" || len(result.Options) != 2 {
+		t.Fatalf("expected the pending question, got %+v", result)
+	}
+	if n := provider.Remaining(); n != 1 {
+		t.Fatalf("expected the run to stop at the question, %d turns left", n)
+	}
+
+	result, err = agent.ProcessMessage(context.Background(), "develop")
+	if err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if result.Outcome != OutcomeCompleted || len(result.History) != 2 {
+		t.Errorf("expected the answer to complete the task, got %+v", result)
+	}
+}
+
+func TestProcessMessageReturnsResultWithError(t *testing.T) {
+	unauthorized := &APIError{Provider: ProviderOpenAI, StatusCode: http.StatusUnauthorized}
+	agent, _ := newScriptedAgent(t, completeScript(),
+		WithProviderWrapper(func(p Provider) Provider { return &flakyProvider{Provider: p, failures: 1, err: unauthorized} }))
+
+	result, err := agent.ProcessMessage(context.Background(), "hello")
+	if err == nil {
+		t.Fatal("expected the error to be returned")
+	}
+	if result == nil || result.Outcome != OutcomeFailed {
+		t.Errorf("expected a failed result, got %+v", result)
+	}
+}
+
+func TestAnswerSendsTheAnswerAsTheCallResult(t *testing.T) {
+	isError := false
+	script := &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "ask_question", Args: map[string]any{
+			"question": "which branch?",
+			"options":  []any{"main", "develop"},
+		}}}},
+		{
+			ExpectFunctionResponses: []ScriptResponseExpectation{{Name: "ask_question", IsError: &isError, Contains: "develop"}},
+			FunctionCalls:           []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+		},
+	}}
+	agent, _ := newScriptedAgent(t, script)
+
+	if _, err := agent.Answer(context.Background(), "develop"); err == nil {
+		t.Fatal("expected an error without a pending question")
+	}
+	if _, err := agent.ProcessMessage(context.Background(), "merge it"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if saved.Status != SessionStatusAwaitingAnswer || saved.PendingQuestion == nil || saved.PendingQuestion.Question != "which branch?" {
+		t.Fatalf("expected the session to wait for the answer, got %s %+v", saved.Status, saved.PendingQuestion)
+	}
+
+	result, err := agent.Answer(context.Background(), "develop")
+	if err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	if result.Outcome != OutcomeCompleted || agent.GetSession().PendingQuestion != nil {
+		t.Errorf("expected the answer to complete the task, got %+v", result)
+	}
+}
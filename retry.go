@@ -0,0 +1,177 @@
+package makasero
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pankona/makasero/mlog"
+)
+
+// RetryPolicy controls how requests to the model are retried after transient
+// errors such as rate limits, overloaded servers and network failures.
+type RetryPolicy struct {
+	MaxAttempts  int      `json:"maxAttempts,omitempty"`  // requests including the first one; 1 disables retries
+	InitialDelay Duration `json:"initialDelay,omitempty"` // wait before the first retry, doubled on each retry
+	MaxDelay     Duration `json:"maxDelay,omitempty"`     // upper limit of the doubled wait and of the Retry-After of the server
+}
+
+// DefaultRetryPolicy is used for the fields of a RetryPolicy that are not set.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  4,
+	InitialDelay: Duration(time.Second),
+	MaxDelay:     Duration(30 * time.Second),
+}
+
+// WithRetryPolicy sets how requests to the model are retried. It overrides
+// the retry section of the config.
+func WithRetryPolicy(p RetryPolicy) AgentOption {
+	return func(a *Agent) {
+		a.retry = &p
+	}
+}
+
+func (p *RetryPolicy) withDefaults() RetryPolicy {
+	policy := DefaultRetryPolicy
+	if p == nil {
+		return policy
+	}
+	if p.MaxAttempts > 0 {
+		policy.MaxAttempts = p.MaxAttempts
+	}
+	if p.InitialDelay > 0 {
+		policy.InitialDelay = p.InitialDelay
+	}
+	if p.MaxDelay > 0 {
+		policy.MaxDelay = p.MaxDelay
+	}
+	return policy
+}
+
+// delay returns the wait before the n-th retry. The wait suggested by the
+// server takes precedence, up to MaxDelay; otherwise the backoff is randomized
+// between half and all of the doubled delay so that clients do not retry in
+// lockstep.
+func (p RetryPolicy) delay(n int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, time.Duration(p.MaxDelay))
+	}
+	d := time.Duration(p.MaxDelay)
+	if n-1 < 32 {
+		d = min(time.Duration(p.InitialDelay)<<(n-1), d)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// TransientError marks an error that may go away when the request is retried.
+type TransientError struct {
+	Err        error
+	RetryAfter time.Duration // wait suggested by the server, if any
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// isTransient reports whether a request that failed with err is worth
+// retrying, and how long the server asked to wait.
+func isTransient(err error) (bool, time.Duration) {
+	var transientErr *TransientError
+	if errors.As(err, &transientErr) {
+		return true, transientErr.RetryAfter
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+			statusOverloaded:
+			return true, apiErr.RetryAfter
+		}
+		return false, 0
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true, 0
+	}
+	return false, 0
+}
+
+// statusOverloaded is returned by Anthropic when the API is overloaded.
+const statusOverloaded = 529
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// generateWithRetry sends req to the provider and retries transient errors
+// according to the retry policy. Each retry is reported as EventRetry.
+func (a *Agent) generateWithRetry(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	policy := a.retry.withDefaults()
+	for attempt := 1; ; attempt++ {
+		var resp *GenerateResponse
+		var err error
+		if len(a.eventHandlers) > 0 {
+			resp, err = generateStream(ctx, a.provider, req, func(chunk string) {
+				a.emit(Event{Type: EventTextDelta, Text: chunk})
+			})
+		} else {
+			resp, err = a.provider.Generate(ctx, req)
+		}
+		if err == nil {
+			return resp, nil
+		}
+
+		transient, retryAfter := isTransient(err)
+		if !transient || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := policy.delay(attempt, retryAfter)
+		mlog.Warnf(ctx, "Request to the model failed (attempt %d/%d), retrying in %s: %v", attempt, policy.MaxAttempts, delay, err)
+		a.emit(Event{Type: EventRetry, Attempt: attempt + 1, Delay: Duration(delay), Error: err.Error()})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		// 待っている間に予算の時間を使い切っていないか確認する
+		if err := a.run.checkDuration(); err != nil {
+			return nil, err
+		}
+	}
+}
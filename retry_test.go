@@ -0,0 +1,130 @@
+package makasero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// flakyProvider fails the first requests with err before delegating to the inner provider.
+type flakyProvider struct {
+	Provider
+	failures int
+	err      error
+}
+
+func (p *flakyProvider) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	if p.failures > 0 {
+		p.failures--
+		return nil, p.err
+	}
+	return p.Provider.Generate(ctx, req)
+}
+
+func completeScript() *Script {
+	return &Script{Turns: []ScriptTurn{
+		{FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}}},
+	}}
+}
+
+func TestProcessMessageRetriesTransientErrors(t *testing.T) {
+	rateLimited := &APIError{Provider: ProviderOpenAI, StatusCode: http.StatusTooManyRequests, RetryAfter: time.Millisecond}
+	var retries []Event
+	agent, _ := newScriptedAgent(t, completeScript(),
+		WithProviderWrapper(func(p Provider) Provider { return &flakyProvider{Provider: p, failures: 2, err: rateLimited} }),
+		WithEventHandler(func(e Event) {
+			if e.Type == EventRetry {
+				retries = append(retries, e)
+			}
+		}))
+
+	if _, err := agent.ProcessMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+	if len(retries) != 2 {
+		t.Fatalf("expected 2 retry events, got %+v", retries)
+	}
+	if retries[1].Attempt != 3 || retries[1].Delay != Duration(time.Millisecond) {
+		t.Errorf("expected the third attempt after the Retry-After delay, got %+v", retries[1])
+	}
+}
+
+func TestProcessMessageGivesUpAfterMaxAttempts(t *testing.T) {
+	unavailable := &APIError{Provider: ProviderOpenAI, StatusCode: http.StatusServiceUnavailable}
+	agent, _ := newScriptedAgent(t, completeScript(),
+		WithProviderWrapper(func(p Provider) Provider { return &flakyProvider{Provider: p, failures: 3, err: unavailable} }),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialDelay: Duration(time.Millisecond)}))
+
+	_, err := agent.ProcessMessage(context.Background(), "hello")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last APIError, got %v", err)
+	}
+}
+
+func TestProcessMessageDoesNotRetryPermanentErrors(t *testing.T) {
+	unauthorized := &APIError{Provider: ProviderOpenAI, StatusCode: http.StatusUnauthorized}
+	var retried bool
+	agent, _ := newScriptedAgent(t, completeScript(),
+		WithProviderWrapper(func(p Provider) Provider { return &flakyProvider{Provider: p, failures: 1, err: unauthorized} }),
+		WithEventHandler(func(e Event) { retried = retried || e.Type == EventRetry }))
+
+	if _, err := agent.ProcessMessage(context.Background(), "hello"); err == nil {
+		t.Fatal("expected the error to be returned")
+	}
+	if retried {
+		t.Error("expected no retry for a 401")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err        error
+		transient  bool
+		retryAfter time.Duration
+	}{
+		{&APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}, true, time.Second},
+		{&APIError{StatusCode: statusOverloaded}, true, 0},
+		{&APIError{StatusCode: http.StatusBadRequest}, false, 0},
+		{fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), true, 0},
+		{&TransientError{Err: errors.New("recorded"), RetryAfter: time.Minute}, true, time.Minute},
+		{errors.New("invalid request"), false, 0},
+	}
+	for _, tt := range tests {
+		transient, retryAfter := isTransient(tt.err)
+		if transient != tt.transient || retryAfter != tt.retryAfter {
+			t.Errorf("isTransient(%v) = %v, %s; expected %v, %s", tt.err, transient, retryAfter, tt.transient, tt.retryAfter)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := (&RetryPolicy{InitialDelay: Duration(time.Second), MaxDelay: Duration(5 * time.Second)}).withDefaults()
+	for n, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 100: 5 * time.Second} {
+		if d := policy.delay(n, 0); d < max/2 || d > max {
+			t.Errorf("retry %d: expected a delay between %s and %s, got %s", n, max/2, max, d)
+		}
+	}
+	if d := policy.delay(1, 3*time.Second); d != 3*time.Second {
+		t.Errorf("expected the server's delay to be used, got %s", d)
+	}
+	if d := policy.delay(1, time.Hour); d != 5*time.Second {
+		t.Errorf("expected the server's delay to be capped at MaxDelay, got %s", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("expected 3s, got %s", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected about an hour, got %s", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("expected 0 for an invalid value, got %s", d)
+	}
+}
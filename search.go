@@ -0,0 +1,461 @@
+package makasero
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultMaxMatches is how many matches grep_workspace and find_files
+	// return when the model does not say.
+	DefaultMaxMatches = 200
+	// maxSearchMatches caps the max_matches and max_results the model asks for.
+	maxSearchMatches = 2000
+	// maxContextLines caps the context_lines of grep_workspace.
+	maxContextLines = 10
+	// maxGrepFileSize is the size of the largest file grep_workspace reads.
+	maxGrepFileSize = 4 << 20
+)
+
+// searchFunctions returns grep_workspace and find_files. Like the file
+// functions they only see the workspace, and skip the files ignored by git.
+func searchFunctions(root string) map[string]FunctionDefinition {
+	return map[string]FunctionDefinition{
+		"grep_workspace": {
+			Declaration: &FunctionDeclaration{
+				Name: "grep_workspace",
+				Description: "ワークスペース内のファイルを正規表現 (Go の RE2 構文) で検索し、一致した行をファイル・行番号とともに返します。" +
+					".gitignore で除外されたファイルとバイナリファイルは検索しません。",
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"pattern": {
+							Type:        TypeString,
+							Description: "検索する正規表現",
+						},
+						"path": {
+							Type:        TypeString,
+							Description: "検索するディレクトリまたはファイル (省略時はワークスペースのルート)",
+						},
+						"include": {
+							Type:        TypeArray,
+							Description: "検索するファイルのグロブ (例: *.go, cmd/**/*.go)。/ を含まないパターンはファイル名と照合します",
+							Items:       &Schema{Type: TypeString},
+						},
+						"exclude": {
+							Type:        TypeArray,
+							Description: "検索しないファイルやディレクトリのグロブ (例: *_test.go, vendor)",
+							Items:       &Schema{Type: TypeString},
+						},
+						"context_lines": {
+							Type:        TypeInteger,
+							Description: fmt.Sprintf("一致した行の前後に含める行数 (最大 %d)", maxContextLines),
+						},
+						"case_insensitive": {
+							Type:        TypeBoolean,
+							Description: "大文字と小文字を区別しないかどうか",
+						},
+						"max_matches": {
+							Type:        TypeInteger,
+							Description: fmt.Sprintf("返す一致の最大数 (省略時は %d)", DefaultMaxMatches),
+						},
+					},
+					Required: []string{"pattern"},
+				},
+			},
+			Handler:    inWorkspace(root, grepWorkspace),
+			Concurrent: true,
+		},
+		"find_files": {
+			Declaration: &FunctionDeclaration{
+				Name:        "find_files",
+				Description: "ワークスペース内のファイルをグロブで探し、パスの一覧を返します。.gitignore で除外されたファイルは含みません。",
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"pattern": {
+							Type:        TypeString,
+							Description: "ファイルのグロブ (例: *.go, **/testdata/*.json)。/ を含まないパターンはファイル名と照合します",
+						},
+						"path": {
+							Type:        TypeString,
+							Description: "探すディレクトリ (省略時はワークスペースのルート)",
+						},
+						"exclude": {
+							Type:        TypeArray,
+							Description: "除外するファイルやディレクトリのグロブ",
+							Items:       &Schema{Type: TypeString},
+						},
+						"max_results": {
+							Type:        TypeInteger,
+							Description: fmt.Sprintf("返すパスの最大数 (省略時は %d)", DefaultMaxMatches),
+						},
+					},
+					Required: []string{"pattern"},
+				},
+			},
+			Handler:    inWorkspace(root, findFiles),
+			Concurrent: true,
+		},
+	}
+}
+
+func grepWorkspace(ctx context.Context, r *os.Root, args map[string]any) map[string]any {
+	expr, _ := args["pattern"].(string)
+	if expr == "" {
+		return toolError("pattern is required")
+	}
+	if ci, _ := args["case_insensitive"].(bool); ci {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return toolError("invalid pattern: %v", err)
+	}
+	include, exclude := stringList(args["include"]), stringList(args["exclude"])
+	contextLines := min(max(intArg(args, "context_lines", 0), 0), maxContextLines)
+	limit := maxMatchesArg(args, "max_matches")
+
+	var matches []any
+	var lines []string
+	files, truncated := 0, false
+	err = walkWorkspace(ctx, r, args, exclude, func(p string, d fs.DirEntry) error {
+		if len(include) > 0 && !matchAnyGlob(include, p) {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxGrepFileSize {
+			return nil
+		}
+		data, err := fs.ReadFile(r.FS(), p)
+		if err != nil || isBinary(data) {
+			return nil
+		}
+		files++
+
+		fileLines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		var hits []int
+		for i, line := range fileLines {
+			loc := re.FindStringIndex(line)
+			if loc == nil {
+				continue
+			}
+			if len(matches) == limit {
+				truncated = true
+				break
+			}
+			hits = append(hits, i)
+			match := map[string]any{
+				"path":   p,
+				"line":   i + 1,
+				"column": loc[0] + 1,
+				"text":   line,
+			}
+			if contextLines > 0 {
+				match["before"] = fileLines[max(i-contextLines, 0):i]
+				match["after"] = fileLines[i+1 : min(i+contextLines+1, len(fileLines))]
+			}
+			matches = append(matches, match)
+		}
+		if len(hits) > 0 {
+			if contextLines > 0 && len(lines) > 0 {
+				lines = append(lines, "--")
+			}
+			lines = append(lines, grepLines(p, fileLines, hits, contextLines)...)
+		}
+		if truncated {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return toolError("failed to search: %v", err)
+	}
+
+	output := strings.Join(lines, "\n")
+	if len(matches) == 0 {
+		output = "no matches"
+	}
+	if truncated {
+		output += fmt.Sprintf("\n(%d 件を超えたため省略しました)", limit)
+	}
+	return map[string]any{
+		"is_error":       false,
+		"output":         output,
+		"matches":        matches,
+		"files_searched": files,
+		"truncated":      truncated,
+	}
+}
+
+// grepLines formats the matching lines of a file as grep -n does. Matching
+// lines are separated by ':', context lines by '-' and the groups by "--".
+func grepLines(p string, fileLines []string, hits []int, contextLines int) []string {
+	var out []string
+	last := -1 // 出力済みの最後の行
+	for k, i := range hits {
+		from, to := max(i-contextLines, last+1), min(i+contextLines+1, len(fileLines))
+		if k+1 < len(hits) {
+			// 後ろの文脈は次の一致の行より前まで
+			to = min(to, hits[k+1])
+		}
+		if contextLines > 0 && last >= 0 && from > last+1 {
+			out = append(out, "--")
+		}
+		for j := from; j < to; j++ {
+			sep := "-"
+			if j == i {
+				sep = ":"
+			}
+			out = append(out, fmt.Sprintf("%s%s%d%s%s", p, sep, j+1, sep, fileLines[j]))
+		}
+		last = to - 1
+	}
+	return out
+}
+
+func findFiles(ctx context.Context, r *os.Root, args map[string]any) map[string]any {
+	pattern, _ := args["pattern"].(string)
+	if pattern == "" {
+		return toolError("pattern is required")
+	}
+	if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+		return toolError("invalid pattern %q: %v", pattern, err)
+	}
+	exclude := stringList(args["exclude"])
+	limit := maxMatchesArg(args, "max_results")
+
+	var files []any
+	var lines []string
+	truncated := false
+	err := walkWorkspace(ctx, r, args, exclude, func(p string, d fs.DirEntry) error {
+		if !matchAnyGlob([]string{pattern}, p) {
+			return nil
+		}
+		if len(files) == limit {
+			truncated = true
+			return fs.SkipAll
+		}
+		files = append(files, p)
+		lines = append(lines, p)
+		return nil
+	})
+	if err != nil {
+		return toolError("failed to search: %v", err)
+	}
+
+	output := strings.Join(lines, "\n")
+	if len(files) == 0 {
+		output = "no files found"
+	}
+	if truncated {
+		output += fmt.Sprintf("\n(%d 件を超えたため省略しました)", limit)
+	}
+	return map[string]any{
+		"is_error":  false,
+		"output":    output,
+		"files":     files,
+		"truncated": truncated,
+	}
+}
+
+// walkWorkspace calls fn for the regular files under args["path"], skipping
+// .git, the files ignored by .gitignore and those matching exclude.
+func walkWorkspace(ctx context.Context, r *os.Root, args map[string]any, exclude []string, fn func(p string, d fs.DirEntry) error) error {
+	dir, _ := args["path"].(string)
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := workspacePath(r, dir)
+	if err != nil {
+		return err
+	}
+
+	fsys := r.FS()
+	ignore := &gitignore{}
+	// git_worktree の worktree などリポジトリ固有の除外設定
+	ignore.loadFile(fsys, ".git/info/exclude", ".")
+	if dir != "." {
+		// 検索を始めるディレクトリより上の .gitignore も適用する
+		parent := "."
+		ignore.load(fsys, parent)
+		for _, elem := range strings.Split(path.Dir(dir), "/") {
+			if elem != "." {
+				parent = path.Join(parent, elem)
+				ignore.load(fsys, parent)
+			}
+		}
+	}
+
+	return fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != dir && (d.Name() == ".git" || ignore.ignored(p, true) || matchAnyGlob(exclude, p)) {
+				return fs.SkipDir
+			}
+			ignore.load(fsys, p)
+			return nil
+		}
+		if !d.Type().IsRegular() || ignore.ignored(p, false) || matchAnyGlob(exclude, p) {
+			return nil
+		}
+		return fn(p, d)
+	})
+}
+
+// gitignore holds the rules of the .gitignore files loaded so far. Rules of
+// deeper directories come later, so that the last matching rule decides.
+type gitignore struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	base     string // directory of the .gitignore
+	pattern  string
+	negate   bool // "!pattern" re-includes what an earlier rule ignored
+	dirOnly  bool // "pattern/" only matches directories
+	anchored bool // a pattern with a slash is relative to base
+}
+
+func (g *gitignore) load(fsys fs.FS, dir string) {
+	g.loadFile(fsys, path.Join(dir, ".gitignore"), dir)
+}
+
+// loadFile adds the rules of name, which apply to the files under dir.
+func (g *gitignore) loadFile(fsys fs.FS, name, dir string) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if rule.pattern != "" {
+			g.rules = append(g.rules, rule)
+		}
+	}
+}
+
+// ignored reports whether p (relative to the workspace) is ignored.
+func (g *gitignore) ignored(p string, isDir bool) bool {
+	ignored := false
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel := p
+		if rule.base != "." {
+			if !strings.HasPrefix(p, rule.base+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(p, rule.base+"/")
+		}
+		var ok bool
+		if rule.anchored {
+			ok = matchGlob(rule.pattern, rel)
+		} else {
+			ok = matchGlob(rule.pattern, path.Base(rel))
+		}
+		if ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchAnyGlob reports whether p matches one of the patterns. A pattern
+// without a slash is matched against the base name of p, and one with a
+// slash against the whole path, where "**" matches any number of directories.
+func matchAnyGlob(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "./")
+		if strings.Contains(pattern, "/") {
+			if matchGlob(pattern, p) {
+				return true
+			}
+		} else if matchGlob(pattern, path.Base(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash-separated path with path.Match for each element.
+// A "**" element matches zero or more elements.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func stringList(v any) []string {
+	values, _ := v.([]any)
+	var list []string
+	for _, value := range values {
+		if s, ok := value.(string); ok && s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func intArg(args map[string]any, name string, def int) int {
+	if v, ok := args[name].(float64); ok {
+		return int(v)
+	}
+	return def
+}
+
+func maxMatchesArg(args map[string]any, name string) int {
+	n := intArg(args, name, DefaultMaxMatches)
+	if n <= 0 {
+		n = DefaultMaxMatches
+	}
+	return min(n, maxSearchMatches)
+}
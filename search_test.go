@@ -0,0 +1,99 @@
+package makasero
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newSearchWorkspace(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestFile(t, root, ".gitignore", "*.log\n/build/\n!keep.log\n")
+	writeTestFile(t, root, "main.go", "package main\n\n// TODO: one\nfunc main() {}\n")
+	writeTestFile(t, root, "pkg/a.go", "package pkg\n\n// TODO: two\n")
+	writeTestFile(t, root, "pkg/a_test.go", "package pkg\n\n// TODO: test\n")
+	writeTestFile(t, root, "pkg/.gitignore", "generated.go\n")
+	writeTestFile(t, root, "pkg/generated.go", "// TODO: generated\n")
+	writeTestFile(t, root, "debug.log", "TODO: log\n")
+	writeTestFile(t, root, "keep.log", "TODO: kept\n")
+	writeTestFile(t, root, "build/out.go", "// TODO: build\n")
+	writeTestFile(t, root, ".git/HEAD", "TODO: git\n")
+	return root
+}
+
+func TestGrepWorkspaceRespectsGitignore(t *testing.T) {
+	root := newSearchWorkspace(t)
+
+	result := callFunction(t, searchFunctions(root), "grep_workspace", map[string]any{"pattern": "TODO"})
+	var paths []string
+	for _, m := range result["matches"].([]any) {
+		paths = append(paths, m.(map[string]any)["path"].(string))
+	}
+	if want := []string{"keep.log", "main.go", "pkg/a.go", "pkg/a_test.go"}; !slices.Equal(paths, want) {
+		t.Errorf("got %q, want %q", paths, want)
+	}
+
+	result = callFunction(t, searchFunctions(root), "grep_workspace", map[string]any{
+		"pattern":          "todo: (one|two|test)",
+		"path":             ".",
+		"include":          []any{"*.go"},
+		"exclude":          []any{"*_test.go"},
+		"case_insensitive": true,
+		"context_lines":    1.0,
+	})
+	want := "main.go-2-\nmain.go:3:// TODO: one\nmain.go-4-func main() {}\n--\npkg/a.go-2-\npkg/a.go:3:// TODO: two"
+	if result["output"] != want {
+		t.Errorf("unexpected output:\n%s", result["output"])
+	}
+	first := result["matches"].([]any)[0].(map[string]any)
+	if first["line"] != 3 || first["column"] != 4 || !slices.Equal(first["after"].([]string), []string{"func main() {}"}) {
+		t.Errorf("unexpected match: %v", first)
+	}
+}
+
+func TestGrepWorkspaceCapsMatches(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.txt", strings.Repeat("x\n", 10))
+
+	result := callFunction(t, searchFunctions(root), "grep_workspace", map[string]any{"pattern": "x", "max_matches": 3.0})
+	if len(result["matches"].([]any)) != 3 || result["truncated"] != true {
+		t.Errorf("expected 3 matches, got %v", result)
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	root := newSearchWorkspace(t)
+
+	result := callFunction(t, searchFunctions(root), "find_files", map[string]any{"pattern": "*.go", "exclude": []any{"*_test.go"}})
+	if result["output"] != "main.go\npkg/a.go" {
+		t.Errorf("unexpected output: %q", result["output"])
+	}
+
+	result = callFunction(t, searchFunctions(root), "find_files", map[string]any{"pattern": "pkg/**/*_test.go"})
+	if result["output"] != "pkg/a_test.go" {
+		t.Errorf("unexpected output: %q", result["output"])
+	}
+
+	result = callFunction(t, searchFunctions(root), "find_files", map[string]any{"pattern": "*.go", "path": "pkg"})
+	if result["output"] != "pkg/a.go\npkg/a_test.go" {
+		t.Errorf("expected pkg/.gitignore to apply, got %q", result["output"])
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**/*.go", "a.go", true},
+		{"**/*.go", "a/b/c.go", true},
+		{"cmd/**/main.go", "cmd/makasero/main.go", true},
+		{"cmd/**", "cmd/a/b", true},
+		{"cmd/*.go", "cmd/a/b.go", false},
+	} {
+		if got := matchGlob(c.pattern, c.name); got != c.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", c.pattern, c.name, got, c.want)
+		}
+	}
+}
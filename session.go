@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/generative-ai-go/genai"
 	"github.com/pankona/makasero/mlog"
 )
 
@@ -34,14 +33,45 @@ const (
 // sessionDir = ".makasero/sessions"
 )
 
+// Session.Status の値
+const (
+	SessionStatusRunning        = "running" // 実行中。プロセスが落ちた場合もこのまま残る
+	SessionStatusCompleted      = "completed"
+	SessionStatusAwaitingAnswer = "awaiting_answer" // モデルの質問 (PendingQuestion) への回答を待っている
+	SessionStatusBudgetExceeded = "budget_exceeded"
+	SessionStatusInterrupted    = "interrupted"
+	SessionStatusFailed         = "failed"
+)
+
 type Session struct {
 	ID                string                 `json:"id"`
 	CreatedAt         time.Time              `json:"created_at"`
 	UpdatedAt         time.Time              `json:"updated_at"`
-	History           []*genai.Content       `json:"-"` // JSON化しない
+	Provider          string                 `json:"provider,omitempty"`         // セッション作成時のプロバイダ。再開時にも同じものを使う
+	Model             string                 `json:"model,omitempty"`            // セッション作成時のモデル。再開時にも同じものを使う
+	ProviderConfig    *ProviderConfig        `json:"provider_config,omitempty"`  // セッション作成時のプロバイダの設定 (APIKey を除く)。設定ファイルのプロバイダが変わっても再開できるようにする
+	ForkedFrom        string                 `json:"forked_from,omitempty"`      // Agent.Fork で複製した元のセッションID
+	Generation        *GenerationConfig      `json:"generation,omitempty"`       // 実際に使った生成パラメータ。再開時にも同じものを使う
+	OutputSchema      *Schema                `json:"output_schema,omitempty"`    // 実行結果の形式。再開時にも同じものを使う
+	Status            string                 `json:"status,omitempty"`           // 最後の実行の結果 (SessionStatus*)
+	Output            map[string]any         `json:"output,omitempty"`           // 最後の実行の結果 (OutputSchema を指定した場合)
+	PendingQuestion   *PendingQuestion       `json:"pending_question,omitempty"` // 回答を待っている質問
+	History           []*Message             `json:"-"`                          // JSON化しない
+	Summary           string                 `json:"summary,omitempty"`          // 圧縮した古い履歴の要約。モデルには History の先頭の代わりに送る
+	SummarizedUntil   int                    `json:"summarized_until,omitempty"` // Summary で置き換えた History の先頭のメッセージ数
+	Usage             []TurnUsage            `json:"usage,omitempty"`            // モデルへのリクエストごとのトークン数と料金
+	TotalUsage        *SessionUsage          `json:"total_usage,omitempty"`      // Usage の合計
 	SerializedHistory []*SerializableContent `json:"history"`
 }
 
+// PendingQuestion is a question the model asked with ask_question. It is
+// answered with Agent.Answer, which sends the answer as the result of the call.
+type PendingQuestion struct {
+	CallID   string   `json:"call_id,omitempty"`
+	Question string   `json:"question"`
+	Options  []string `json:"options,omitempty"`
+}
+
 type SerializableContent struct {
 	Parts []SerializablePart `json:"parts"`
 	Role  string             `json:"role"`
@@ -52,35 +82,19 @@ type SerializablePart struct {
 	Content any    `json:"content"` // 実際のデータ
 }
 
-func (s *Session) MarshalJSON() ([]byte, error) {
-	s.SerializedHistory = make([]*SerializableContent, len(s.History))
-	for i, content := range s.History {
-		serialized := &SerializableContent{
-			Role:  content.Role,
-			Parts: make([]SerializablePart, len(content.Parts)),
-		}
-
-		for j, part := range content.Parts {
-			switch p := part.(type) {
-			case genai.Text:
-				serialized.Parts[j] = SerializablePart{
-					Type:    "text",
-					Content: string(p),
-				}
-			case genai.FunctionCall:
-				serialized.Parts[j] = SerializablePart{
-					Type:    "function_call",
-					Content: p,
-				}
-			case genai.FunctionResponse:
-				serialized.Parts[j] = SerializablePart{
-					Type:    "function_response",
-					Content: p,
-				}
-			}
-		}
-		s.SerializedHistory[i] = serialized
+// Resumable reports whether the last run stopped before finishing, so that
+// Agent.Resume can continue it.
+func (s *Session) Resumable() bool {
+	switch s.Status {
+	case SessionStatusRunning, SessionStatusBudgetExceeded, SessionStatusInterrupted, SessionStatusFailed:
+		return len(s.History) > 0
+	default:
+		return false
 	}
+}
+
+func (s *Session) MarshalJSON() ([]byte, error) {
+	s.SerializedHistory = serializeMessages(s.History)
 
 	type Alias Session
 	return json.Marshal(&struct{ *Alias }{Alias: (*Alias)(s)})
@@ -99,45 +113,95 @@ func (s *Session) UnmarshalJSON(data []byte) error {
 		s.SerializedHistory = []*SerializableContent{}
 	}
 
-	s.History = make([]*genai.Content, len(s.SerializedHistory))
-	for i, serialized := range s.SerializedHistory {
-		content := &genai.Content{
-			Role:  serialized.Role,
-			Parts: make([]genai.Part, len(serialized.Parts)),
-		}
+	s.History = deserializeMessages(s.SerializedHistory)
+	return nil
+}
 
-		for j, part := range serialized.Parts {
-			switch part.Type {
-			case "text":
-				content.Parts[j] = genai.Text(part.Content.(string))
-			case "function_call":
-				fc := part.Content.(map[string]interface{})
-				content.Parts[j] = genai.FunctionCall{
-					Name: fc["Name"].(string),
-					Args: fc["Args"].(map[string]interface{}),
-				}
-			case "function_response":
-				fr := part.Content.(map[string]interface{})
-				name := fr["Name"].(string)
-				var response map[string]interface{}
-
-				// Responseがnullの場合は空のマップを使用
-				if fr["Response"] != nil {
-					response = fr["Response"].(map[string]interface{})
-				} else {
-					response = make(map[string]interface{})
-				}
+func serializeMessages(messages []*Message) []*SerializableContent {
+	serializedMessages := make([]*SerializableContent, len(messages))
+	for i, content := range messages {
+		serializedMessages[i] = serializeMessage(content)
+	}
+	return serializedMessages
+}
 
-				content.Parts[j] = genai.FunctionResponse{
-					Name:     name,
-					Response: response,
-				}
+func serializeMessage(content *Message) *SerializableContent {
+	serialized := &SerializableContent{
+		Role:  content.Role,
+		Parts: make([]SerializablePart, len(content.Parts)),
+	}
+
+	for j, part := range content.Parts {
+		switch p := part.(type) {
+		case Text:
+			serialized.Parts[j] = SerializablePart{
+				Type:    "text",
+				Content: string(p),
+			}
+		case FunctionCall:
+			serialized.Parts[j] = SerializablePart{
+				Type:    "function_call",
+				Content: p,
+			}
+		case FunctionResponse:
+			serialized.Parts[j] = SerializablePart{
+				Type:    "function_response",
+				Content: p,
 			}
 		}
-		s.History[i] = content
 	}
+	return serialized
+}
 
-	return nil
+// deserializeMessages converts serialized contents decoded from JSON back into messages.
+func deserializeMessages(serializedMessages []*SerializableContent) []*Message {
+	messages := make([]*Message, len(serializedMessages))
+	for i, serialized := range serializedMessages {
+		messages[i] = deserializeMessage(serialized)
+	}
+	return messages
+}
+
+func deserializeMessage(serialized *SerializableContent) *Message {
+	content := &Message{
+		Role:  serialized.Role,
+		Parts: make([]Part, len(serialized.Parts)),
+	}
+
+	for j, part := range serialized.Parts {
+		switch part.Type {
+		case "text":
+			content.Parts[j] = Text(part.Content.(string))
+		case "function_call":
+			fc := part.Content.(map[string]interface{})
+			id, _ := fc["ID"].(string)
+			args, _ := fc["Args"].(map[string]interface{})
+			content.Parts[j] = FunctionCall{
+				ID:   id,
+				Name: fc["Name"].(string),
+				Args: args,
+			}
+		case "function_response":
+			fr := part.Content.(map[string]interface{})
+			id, _ := fr["ID"].(string)
+			name := fr["Name"].(string)
+			var response map[string]interface{}
+
+			// Responseがnullの場合は空のマップを使用
+			if fr["Response"] != nil {
+				response = fr["Response"].(map[string]interface{})
+			} else {
+				response = make(map[string]interface{})
+			}
+
+			content.Parts[j] = FunctionResponse{
+				ID:       id,
+				Name:     name,
+				Response: response,
+			}
+		}
+	}
+	return content
 }
 
 func SessionExists(id string) bool {
@@ -179,7 +243,33 @@ func SaveSessionToDir(sessionDir string, session *Session) error {
 	}
 
 	path := filepath.Join(sessionDir, session.ID+".json")
-	return os.WriteFile(path, mustMarshalIndent(session), 0644)
+	return writeFileAtomic(path, mustMarshalIndent(session), 0644)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path, so
+// that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // rename 後は何もしない
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func ListSessions() ([]*Session, error) {
@@ -226,14 +316,26 @@ func PrintSessionsList() error {
 	for _, session := range sessions {
 		fmt.Printf("Session ID: %s\n", session.ID)
 		fmt.Printf("Created: %s\n", session.CreatedAt.Format(time.RFC3339))
+		if session.Provider != "" {
+			fmt.Printf("Provider: %s\n", session.Provider)
+		}
+		if session.Model != "" {
+			fmt.Printf("Model: %s\n", session.Model)
+		}
+		if session.Status != "" {
+			fmt.Printf("Status: %s\n", session.Status)
+		}
 		fmt.Printf("Messages: %d\n", len(session.History))
+		if session.TotalUsage != nil {
+			fmt.Printf("Usage: %s\n", session.TotalUsage)
+		}
 
 		if len(session.History) > 0 {
 			for _, content := range session.History {
 				if content.Role == "user" {
 					fmt.Printf("初期プロンプト: ")
 					for _, part := range content.Parts {
-						if text, ok := part.(genai.Text); ok {
+						if text, ok := part.(Text); ok {
 							prompt := string(text)
 							if len(prompt) > 100 {
 								prompt = prompt[:97] + "..."
@@ -261,19 +363,49 @@ func PrintSessionHistory(id string) error {
 	fmt.Printf("セッションID: %s\n", session.ID)
 	fmt.Printf("作成日時: %s\n", session.CreatedAt.Format(time.RFC3339))
 	fmt.Printf("最終更新: %s\n", session.UpdatedAt.Format(time.RFC3339))
-	fmt.Printf("メッセージ数: %d\n\n", len(session.History))
+	if session.Provider != "" {
+		fmt.Printf("プロバイダ: %s\n", session.Provider)
+	}
+	if session.Model != "" {
+		fmt.Printf("モデル: %s\n", session.Model)
+	}
+	if session.Status != "" {
+		fmt.Printf("状態: %s\n", session.Status)
+	}
+	fmt.Printf("メッセージ数: %d\n", len(session.History))
+	if session.TotalUsage != nil {
+		fmt.Printf("使用量: %s\n", session.TotalUsage)
+		for i, turn := range session.Usage {
+			fmt.Printf("  %d. %s %s input %d (cached %d) / output %d", i+1, turn.Time.Format(time.RFC3339), turn.Model, turn.InputTokens, turn.CachedTokens, turn.OutputTokens)
+			if turn.Cost > 0 {
+				fmt.Printf(" $%.4f", turn.Cost)
+			}
+			fmt.Println()
+		}
+	}
+	fmt.Println()
+	if q := session.PendingQuestion; q != nil {
+		fmt.Printf("回答待ちの質問: %s\n", q.Question)
+		for i, option := range q.Options {
+			fmt.Printf("  %d. %s\n", i+1, option)
+		}
+		fmt.Println()
+	}
+	if session.Summary != "" {
+		fmt.Printf("--- 要約 (メッセージ 1-%d) ---\n%s\n\n", session.SummarizedUntil, session.Summary)
+	}
 
 	for i, content := range session.History {
 		fmt.Printf("--- メッセージ %d ---\n", i+1)
 		fmt.Printf("役割: %s\n", content.Role)
 		for _, part := range content.Parts {
 			switch p := part.(type) {
-			case genai.Text:
+			case Text:
 				fmt.Printf("%s\n", string(p))
-			case genai.FunctionCall:
+			case FunctionCall:
 				fmt.Printf("関数呼び出し: %s\n", p.Name)
 				fmt.Printf("引数: %+v\n", p.Args)
-			case genai.FunctionResponse:
+			case FunctionResponse:
 				fmt.Printf("関数レスポンス: %s\n", p.Name)
 				fmt.Printf("結果: %+v\n", p.Response)
 			}
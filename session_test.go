@@ -0,0 +1,90 @@
+package makasero
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSessionJSONRoundTrip(t *testing.T) {
+	session := &Session{
+		ID: "round-trip",
+		History: []*Message{
+			NewUserMessage(Text("hello")),
+			{
+				Role: RoleModel,
+				Parts: []Part{
+					Text("checking status"),
+					FunctionCall{ID: "call_1", Name: "git_status", Args: map[string]any{"path_to_status": "."}},
+				},
+			},
+			NewUserMessage(FunctionResponse{ID: "call_1", Name: "git_status", Response: map[string]any{"is_error": false, "output": ""}}),
+		},
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		t.Fatalf("failed to marshal session: %v", err)
+	}
+
+	var loaded Session
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("failed to unmarshal session: %v", err)
+	}
+
+	if !reflect.DeepEqual(session.History, loaded.History) {
+		t.Errorf("history mismatch:\nwant %#v\ngot  %#v", session.History, loaded.History)
+	}
+}
+
+func TestSessionUnmarshalLegacyFormat(t *testing.T) {
+	// Sessions saved before provider-neutral types had no call IDs.
+	data := []byte(`{
+  "id": "legacy",
+  "history": [
+    {"role": "model", "parts": [{"type": "function_call", "content": {"Name": "complete", "Args": {"message": "done"}}}]},
+    {"role": "user", "parts": [{"type": "function_response", "content": {"Name": "complete", "Response": null}}]}
+  ]
+}`)
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatalf("failed to unmarshal session: %v", err)
+	}
+
+	want := []*Message{
+		{Role: RoleModel, Parts: []Part{FunctionCall{Name: "complete", Args: map[string]any{"message": "done"}}}},
+		{Role: RoleUser, Parts: []Part{FunctionResponse{Name: "complete", Response: map[string]any{}}}},
+	}
+	if !reflect.DeepEqual(want, session.History) {
+		t.Errorf("history mismatch:\nwant %#v\ngot  %#v", want, session.History)
+	}
+}
+
+func TestSaveSessionToDirLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	session := &Session{ID: "atomic", History: []*Message{NewUserMessage(Text("hello"))}}
+
+	for i := 0; i < 2; i++ {
+		if err := SaveSessionToDir(dir, session); err != nil {
+			t.Fatalf("failed to save session: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "atomic.json" {
+		t.Errorf("expected only atomic.json, got %v", entries)
+	}
+
+	loaded, err := LoadSessionFromDir(dir, "atomic")
+	if err != nil {
+		t.Fatalf("failed to load session: %v", err)
+	}
+	if len(loaded.History) != 1 {
+		t.Errorf("expected 1 message, got %d", len(loaded.History))
+	}
+}
@@ -0,0 +1,271 @@
+package makasero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultShellTimeout limits each command of run_shell when the policy has no timeout.
+	DefaultShellTimeout = 5 * time.Minute
+	// DefaultShellMaxOutput is how many bytes of stdout and stderr each are kept
+	// when the policy does not say.
+	DefaultShellMaxOutput = 32 * 1024
+)
+
+// ShellPolicy enables the run_shell function and decides which commands it
+// may run. A pattern is a command line whose words are matched against the
+// arguments with path.Match; a last word "*" matches any remaining arguments,
+// e.g. "go test *" or "make". Commands are run without a shell.
+type ShellPolicy struct {
+	Allow          []string `json:"allow,omitempty"`          // commands that may run; required, nothing runs if empty
+	Deny           []string `json:"deny,omitempty"`           // commands that never run, even if allowed
+	WorkDir        string   `json:"workDir,omitempty"`        // default working directory, relative to the workspace
+	Timeout        Duration `json:"timeout,omitempty"`        // limit of each command (DefaultShellTimeout if 0)
+	MaxOutputBytes int      `json:"maxOutputBytes,omitempty"` // kept of stdout and stderr each (DefaultShellMaxOutput if 0)
+}
+
+// Validate checks that the policy allows some commands. Deny can not make an
+// allow-everything policy safe, since e.g. "sh -c" or "env" run any command.
+func (p *ShellPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Allow) == 0 {
+		return errors.New("allow is required: list the commands run_shell may run")
+	}
+	return nil
+}
+
+// Permits reports whether the policy allows argv, and if not, why.
+// Nothing is allowed when Allow is empty.
+func (p *ShellPolicy) Permits(argv []string) error {
+	for _, pattern := range p.Deny {
+		// パスで指定されたコマンドも名前で拒否する
+		if matchCommand(pattern, argv) || matchCommand(pattern, append([]string{filepath.Base(argv[0])}, argv[1:]...)) {
+			return fmt.Errorf("denied by %q", pattern)
+		}
+	}
+	for _, pattern := range p.Allow {
+		if matchCommand(pattern, argv) {
+			return nil
+		}
+	}
+	return errors.New("not in the allowed commands")
+}
+
+func matchCommand(pattern string, argv []string) bool {
+	words := strings.Fields(pattern)
+	for i, word := range words {
+		if word == "*" && i == len(words)-1 {
+			return true
+		}
+		if i >= len(argv) {
+			return false
+		}
+		if ok, _ := path.Match(word, argv[i]); !ok {
+			return false
+		}
+	}
+	return len(words) == len(argv)
+}
+
+func shellFunction(workspace string, policy *ShellPolicy) FunctionDefinition {
+	return FunctionDefinition{
+		Declaration: &FunctionDeclaration{
+			Name: "run_shell",
+			Description: "ワークスペース内でコマンドを実行し、標準出力・標準エラー出力・終了コードを返します。" +
+				"シェルを介さずに実行するため、パイプやリダイレクト、; や && は使えません。許可されたコマンドのみ実行できます。",
+			Parameters: &Schema{
+				Type: TypeObject,
+				Properties: map[string]*Schema{
+					"command": {
+						Type:        TypeString,
+						Description: "実行するコマンド (例: go test ./...)。引数はシェルと同様に引用符で囲めます",
+					},
+					"work_dir": {
+						Type:        TypeString,
+						Description: "作業ディレクトリ (ワークスペースからの相対パス)",
+					},
+					"timeout_seconds": {
+						Type:        TypeInteger,
+						Description: "タイムアウト (秒)。設定された上限より長くはできません",
+					},
+				},
+				Required: []string{"command"},
+			},
+		},
+		Handler: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			return runShell(ctx, workspace, policy, args), nil
+		},
+	}
+}
+
+func runShell(ctx context.Context, workspace string, policy *ShellPolicy, args map[string]any) map[string]any {
+	command, _ := args["command"].(string)
+	argv, err := splitCommand(command)
+	if err != nil {
+		return toolError("invalid command: %v", err)
+	}
+	if len(argv) == 0 {
+		return toolError("command is required")
+	}
+	if err := policy.Permits(argv); err != nil {
+		return toolError("%s is not permitted by the shell policy: %v", argv[0], err)
+	}
+
+	workDir, _ := args["work_dir"].(string)
+	if workDir == "" {
+		workDir = policy.WorkDir
+	}
+	dir, err := workspaceSubdir(workspace, "work_dir", workDir)
+	if err != nil {
+		return toolError("%v", err)
+	}
+
+	timeout := time.Duration(policy.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultShellTimeout
+	}
+	if v, ok := args["timeout_seconds"].(float64); ok && v > 0 {
+		timeout = min(timeout, time.Duration(v*float64(time.Second)))
+	}
+	limit := policy.MaxOutputBytes
+	if limit <= 0 {
+		limit = DefaultShellMaxOutput
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout, stderr := newHeadTailBuffer(limit), newHeadTailBuffer(limit)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// コマンドが起動したプロセスが出力を開いたままでも待ち続けない
+	cmd.WaitDelay = 2 * time.Second
+	setProcessGroup(cmd)
+
+	err = cmd.Run()
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	exitCode := cmd.ProcessState.ExitCode()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) && !timedOut {
+		return toolError("failed to run %s: %v", argv[0], err)
+	}
+
+	summary := fmt.Sprintf("exit code: %d", exitCode)
+	if timedOut {
+		summary = fmt.Sprintf("timed out after %s", timeout)
+	}
+	output := summary + "\n--- stdout ---\n" + stdout.String() + "\n--- stderr ---\n" + stderr.String()
+	return map[string]any{
+		"is_error":  timedOut || exitCode != 0,
+		"output":    output,
+		"stdout":    stdout.String(),
+		"stderr":    stderr.String(),
+		"exit_code": exitCode,
+		"timed_out": timedOut,
+		"truncated": stdout.Truncated() || stderr.Truncated(),
+	}
+}
+
+// splitCommand splits a command line into words as a POSIX shell does for
+// quotes and backslashes. Operators such as pipes and redirections are
+// rejected, since the command does not run in a shell.
+func splitCommand(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\$`+"`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case strings.IndexByte("|&;<>()$`", c) >= 0:
+			return nil, fmt.Errorf("shell operator %q is not supported, run one command at a time", c)
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// headTailBuffer keeps the beginning and the end of what is written to it,
+// up to limit bytes in total.
+type headTailBuffer struct {
+	limit   int
+	head    []byte
+	tail    []byte
+	written int
+}
+
+func newHeadTailBuffer(limit int) *headTailBuffer {
+	return &headTailBuffer{limit: limit}
+}
+
+func (b *headTailBuffer) Write(p []byte) (int, error) {
+	b.written += len(p)
+	rest := p
+	if n := min(b.limit/2-len(b.head), len(rest)); n > 0 {
+		b.head = append(b.head, rest[:n]...)
+		rest = rest[n:]
+	}
+	b.tail = append(b.tail, rest...)
+	if keep := b.limit - b.limit/2; len(b.tail) > 2*keep {
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-keep:]...)
+	}
+	return len(p), nil
+}
+
+func (b *headTailBuffer) Truncated() bool {
+	return b.written > b.limit
+}
+
+func (b *headTailBuffer) String() string {
+	if !b.Truncated() {
+		return string(b.head) + string(b.tail)
+	}
+	keep := b.limit - b.limit/2
+	tail := b.tail[len(b.tail)-keep:]
+	return fmt.Sprintf("%s\n... (%d bytes omitted) ...\n%s", b.head, b.written-len(b.head)-len(tail), tail)
+}
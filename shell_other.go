@@ -0,0 +1,9 @@
+//go:build !unix
+
+package makasero
+
+import "os/exec"
+
+// setProcessGroup does nothing on this platform. Only the command itself is
+// killed when it times out.
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,101 @@
+package makasero
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	words, err := splitCommand(`go test -run 'Test A' "./pkg/\"x\"" a\ b`)
+	if err != nil {
+		t.Fatalf("splitCommand failed: %v", err)
+	}
+	if want := []string{"go", "test", "-run", "Test A", `./pkg/"x"`, "a b"}; !slices.Equal(words, want) {
+		t.Errorf("got %q, want %q", words, want)
+	}
+
+	for _, command := range []string{"go test ./... && rm -rf /", "cat a | sh", "echo $(id)", "echo 'x"} {
+		if _, err := splitCommand(command); err == nil {
+			t.Errorf("expected %q to be rejected", command)
+		}
+	}
+}
+
+func TestShellPolicyPermits(t *testing.T) {
+	policy := &ShellPolicy{
+		Allow: []string{"go test *", "make", "rm *"},
+		Deny:  []string{"rm -rf *"},
+	}
+	for command, permitted := range map[string]bool{
+		"go test ./...":  true,
+		"go build ./...": false,
+		"make":           true,
+		"make install":   false,
+		"rm a.txt":       true,
+		"rm -rf /":       false,
+		"/bin/rm -rf /":  false,
+	} {
+		argv, _ := splitCommand(command)
+		if err := policy.Permits(argv); (err == nil) != permitted {
+			t.Errorf("%q: permitted = %v, want %v", command, err == nil, permitted)
+		}
+	}
+
+	// allow のないポリシーは何も許可せず、設定としても受け付けない
+	empty := &ShellPolicy{Deny: []string{"rm *"}}
+	if err := empty.Permits([]string{"ls"}); err == nil {
+		t.Error("expected a policy without allow to permit nothing")
+	}
+	if err := empty.Validate(); err == nil {
+		t.Error("expected a policy without allow to be invalid")
+	}
+}
+
+func TestRunShellCapturesOutput(t *testing.T) {
+	root := t.TempDir()
+	result := runShell(context.Background(), root, &ShellPolicy{Allow: []string{"sh -c *"}}, map[string]any{
+		"command": `sh -c 'pwd; echo oops >&2; exit 3'`,
+	})
+	if result["is_error"] != true || result["exit_code"] != 3 || result["timed_out"] != false {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(result["stdout"].(string)), filepath.Base(root)) || result["stderr"] != "oops\n" {
+		t.Errorf("expected stdout and stderr apart, got %q and %q", result["stdout"], result["stderr"])
+	}
+
+	result = runShell(context.Background(), root, &ShellPolicy{Allow: []string{"go *"}}, map[string]any{"command": "sh -c 'echo x'"})
+	if result["is_error"] != true || !strings.Contains(result["output"].(string), "not permitted") {
+		t.Errorf("expected the command to be refused, got %v", result)
+	}
+
+	result = runShell(context.Background(), root, &ShellPolicy{Allow: []string{"pwd"}}, map[string]any{"command": "pwd", "work_dir": "../"})
+	if result["is_error"] != true {
+		t.Errorf("expected a work_dir outside the workspace to be refused, got %v", result)
+	}
+}
+
+func TestRunShellTimesOut(t *testing.T) {
+	policy := &ShellPolicy{Allow: []string{"sh -c *"}, Timeout: Duration(200 * time.Millisecond)}
+	start := time.Now()
+	result := runShell(context.Background(), t.TempDir(), policy, map[string]any{"command": `sh -c 'echo started; sleep 10'`})
+	if result["is_error"] != true || result["timed_out"] != true || result["stdout"] != "started\n" {
+		t.Errorf("unexpected result: %v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the command was not killed in time: %s", elapsed)
+	}
+}
+
+func TestHeadTailBuffer(t *testing.T) {
+	b := newHeadTailBuffer(10)
+	for range 100 {
+		b.Write([]byte("0123456789"))
+	}
+	if !b.Truncated() || b.String() != "01234\n... (990 bytes omitted) ...\n56789" {
+		t.Errorf("unexpected output: %q", b.String())
+	}
+}
@@ -0,0 +1,85 @@
+package makasero
+
+import (
+	"fmt"
+	"time"
+)
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cachedInput,omitempty"` // cached input tokens; Input is used when 0
+	Output      float64 `json:"output"`
+}
+
+func (p ModelPrice) cost(u Usage) float64 {
+	cachedPrice := p.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	uncached := u.InputTokens - u.CachedTokens
+	return (float64(uncached)*p.Input + float64(u.CachedTokens)*cachedPrice + float64(u.OutputTokens)*p.Output) / 1e6
+}
+
+// TurnUsage is the model that served one request and its usage. The token
+// counts are 0 when the provider did not report them.
+type TurnUsage struct {
+	Time  time.Time `json:"time"`
+	Model string    `json:"model,omitempty"`
+	Usage
+	Cost float64 `json:"cost,omitempty"` // USD at the configured price of the time; 0 when unknown
+}
+
+// SessionUsage totals the usage of every request of a session.
+type SessionUsage struct {
+	Requests int `json:"requests"`
+	Usage
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// WithPrices sets the price table used to compute the cost of each request,
+// keyed by model name. It overrides the prices in the config.
+func WithPrices(prices map[string]ModelPrice) AgentOption {
+	return func(a *Agent) {
+		a.prices = prices
+	}
+}
+
+// recordUsage adds the model and usage of a response to the session and the budget.
+func (a *Agent) recordUsage(resp *GenerateResponse) {
+	a.run.addUsage(resp.Usage)
+
+	turn := TurnUsage{Time: time.Now(), Model: resp.Model}
+	if turn.Model == "" {
+		turn.Model = modelNameOf(a.provider)
+	}
+	if resp.Usage != nil {
+		turn.Usage = *resp.Usage
+		if price, ok := a.prices[turn.Model]; ok {
+			turn.Cost = price.cost(*resp.Usage)
+		}
+	}
+	a.session.addUsage(turn)
+}
+
+func (s *Session) addUsage(turn TurnUsage) {
+	s.Usage = append(s.Usage, turn)
+	if s.TotalUsage == nil {
+		s.TotalUsage = &SessionUsage{}
+	}
+	s.TotalUsage.Requests++
+	s.TotalUsage.InputTokens += turn.InputTokens
+	s.TotalUsage.CachedTokens += turn.CachedTokens
+	s.TotalUsage.OutputTokens += turn.OutputTokens
+	s.TotalUsage.TotalTokens += turn.TotalTokens
+	s.TotalUsage.Cost += turn.Cost
+}
+
+// String formats the usage for the session list and history.
+func (u *SessionUsage) String() string {
+	s := fmt.Sprintf("%d requests, input %d tokens (cached %d), output %d tokens", u.Requests, u.InputTokens, u.CachedTokens, u.OutputTokens)
+	if u.Cost > 0 {
+		s += fmt.Sprintf(", $%.4f", u.Cost)
+	}
+	return s
+}
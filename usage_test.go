@@ -0,0 +1,57 @@
+package makasero
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+// namedProvider reports a model name for a provider that has none.
+type namedProvider struct {
+	Provider
+	model string
+}
+
+func (p *namedProvider) ModelName() string {
+	return p.model
+}
+
+func TestProcessMessageRecordsUsage(t *testing.T) {
+	script := &Script{Turns: []ScriptTurn{
+		{
+			FunctionCalls: []ScriptFunctionCall{{Name: "git_status", Args: map[string]any{"path_to_status": "."}}},
+			Usage:         &Usage{InputTokens: 1000, CachedTokens: 400, OutputTokens: 100, TotalTokens: 1100},
+		},
+		{
+			FunctionCalls: []ScriptFunctionCall{{Name: "complete", Args: map[string]any{"message": "done"}}},
+			Usage:         &Usage{InputTokens: 2000, OutputTokens: 50, TotalTokens: 2050},
+		},
+	}}
+	agent, _ := newScriptedAgent(t, script,
+		WithProviderWrapper(func(p Provider) Provider { return &namedProvider{Provider: p, model: "test-model"} }),
+		WithPrices(map[string]ModelPrice{"test-model": {Input: 1, CachedInput: 0.5, Output: 10}}))
+
+	if _, err := agent.ProcessMessage(context.Background(), "status"); err != nil {
+		t.Fatalf("ProcessMessage failed: %v", err)
+	}
+
+	saved, err := agent.LoadSessionFromDir(agent.GetSession().ID)
+	if err != nil {
+		t.Fatalf("failed to load saved session: %v", err)
+	}
+	if len(saved.Usage) != 2 || saved.Usage[0].Model != "test-model" {
+		t.Fatalf("expected 2 turns of test-model, got %+v", saved.Usage)
+	}
+	// (600*1 + 400*0.5 + 100*10) / 1e6
+	if cost := saved.Usage[0].Cost; math.Abs(cost-0.0018) > 1e-9 {
+		t.Errorf("expected the first turn to cost 0.0018, got %v", cost)
+	}
+
+	total := saved.TotalUsage
+	if total == nil || total.Requests != 2 || total.InputTokens != 3000 || total.CachedTokens != 400 || total.OutputTokens != 150 {
+		t.Fatalf("unexpected total usage: %+v", total)
+	}
+	if math.Abs(total.Cost-0.0043) > 1e-9 {
+		t.Errorf("expected the session to cost 0.0043, got %v", total.Cost)
+	}
+}